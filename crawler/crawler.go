@@ -7,28 +7,81 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 
 	"github.com/janicduplessis/resultscrawler/pkg/crawler"
 	"github.com/janicduplessis/resultscrawler/pkg/crawler/mobluqam"
 	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/events"
+	"github.com/janicduplessis/resultscrawler/pkg/secrets"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	boltstore "github.com/janicduplessis/resultscrawler/pkg/store/bolt"
+	"github.com/janicduplessis/resultscrawler/pkg/store/crawlerconfig"
 	"github.com/janicduplessis/resultscrawler/pkg/store/mongo"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	sqlstore "github.com/janicduplessis/resultscrawler/pkg/store/sql"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
 	"github.com/janicduplessis/resultscrawler/pkg/tools"
 )
 
+// dataStore is implemented by every store backend.
+type dataStore interface {
+	user.Store
+	crawlerconfig.Store
+	results.Store
+	store.Migrator
+	Ping() error
+}
+
 type config struct {
-	Database       *tools.MongoConfig
-	Email          *tools.EmailConfig
-	AESSecretKey   string // 16 bytes
+	// Store is the store backend, mongo, sql or bolt. Mongo is used if it
+	// is empty.
+	Store        string
+	Database     *tools.MongoConfig
+	SQL          *sqlstore.Config
+	BoltPath     string
+	Email        *tools.EmailConfig
+	AESSecretKey string // 16, 24 or 32 bytes
+	// AESKeyDir contains more encryption keys, one per file named by the
+	// key id. AESPrimaryKey is the id of the key used to encrypt, the
+	// AESSecretKey if it is empty.
+	AESKeyDir     string
+	AESPrimaryKey string
+	// AESAllowLegacy allows reading the credentials encrypted with
+	// AES-CFB. It is true by default so the credentials saved before the
+	// upgrade keep working, set it to false once rcadmin rotate-keys
+	// upgraded all of them.
+	AESAllowLegacy bool
 	WebservicePort string
+	// APISecret is the secret shared with the webserver to sign requests.
+	APISecret string
+	// Certificate, key and client CA files to use mutual TLS for the
+	// webservice.
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	// AdminPort serves the health checks and metrics. It must not be
+	// exposed publicly.
+	AdminPort string
 }
 
 const (
 	configFile  = "config.json"
 	numCrawlers = 10
+
+	storeMongo = "mongo"
+	storeSQL   = "sql"
+	storeBolt  = "bolt"
 )
 
 var (
 	webservicePort = flag.String("port", "", "Webservice port")
+	apiSecret      = flag.String("api-secret", "", "Webservice api secret")
+	adminPort      = flag.String("admin-port", "", "Admin port for health checks and metrics")
+	storeBackend   = flag.String("store", "", "Store backend, mongo, sql or bolt")
+	sqlDriver      = flag.String("sql-driver", "", "SQL driver, sqlite3 or postgres")
+	sqlDSN         = flag.String("sql-dsn", "", "SQL data source name")
+	boltPath       = flag.String("bolt-path", "", "Bolt database file")
 	dbURL          = flag.String("db-url", "", "DB url")
 	dbUser         = flag.String("db-user", "", "DB user")
 	dbPassword     = flag.String("db-password", "", "DB password")
@@ -37,6 +90,8 @@ var (
 	emailUser      = flag.String("email-user", "", "Email user")
 	emailPassword  = flag.String("email-password", "", "Email password")
 	aesSecret      = flag.String("aes-secret", "", "AES secret key")
+	aesKeyDir      = flag.String("aes-key-dir", "", "Directory of the AES key files")
+	aesPrimaryKey  = flag.String("aes-primary-key", "", "Id of the AES key used to encrypt")
 )
 
 func main() {
@@ -45,15 +100,26 @@ func main() {
 	flag.Parse()
 	config := readConfig()
 
-	crypto.Init(config.AESSecretKey)
+	keyring, err := crypto.LoadKeyring(config.AESSecretKey, config.AESKeyDir, config.AESPrimaryKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyring.SetAllowLegacy(config.AESAllowLegacy)
+	cryptoService, err := crypto.NewKeyringService(keyring)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Inject dependencies
 	emailSender := tools.NewEmailSender(config.Email)
-	mongoHelper := tools.NewMongoHelper(config.Database)
+	dataStore := openStore(config, cryptoService)
+	// The store is not cached, the crawler is not told about the classes
+	// changed in the webserver.
+	userStore := dataStore
+	crawlerConfigStore := dataStore
+	userResultsStore := dataStore
 
-	userStore := mongo.New(mongoHelper)
-	crawlerConfigStore := mongo.New(mongoHelper)
-	userResultsStore := mongo.New(mongoHelper)
+	eventBus := events.NewLocalBus()
 
 	var crawlers []crawler.ResultGetter
 	for i := 0; i < numCrawlers; i++ {
@@ -66,24 +132,70 @@ func main() {
 		CrawlerConfigStore: crawlerConfigStore,
 		UserResultsStore:   userResultsStore,
 		Sender:             emailSender,
+		EventBus:           eventBus,
 	})
 
-	crawler.StartWebservice(scheduler, userStore, config.WebservicePort)
+	webserviceConfig := &crawler.WebserviceConfig{
+		Addr:   ":" + config.WebservicePort,
+		Secret: config.APISecret,
+	}
+	if len(config.TLSCert) > 0 {
+		tlsConfig, err := crawler.LoadServerTLS(config.TLSCert, config.TLSKey, config.TLSClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webserviceConfig.TLS = tlsConfig
+	}
+	crawler.StartWebservice(scheduler, userStore, eventBus, webserviceConfig)
+	if len(config.AdminPort) > 0 {
+		crawler.StartAdmin(scheduler, dataStore.Ping, ":"+config.AdminPort)
+	}
 
 	log.Println("Crawler started")
 	scheduler.Start()
 	log.Println("Crawler stopped")
 }
 
+// openStore opens the store backend of the config and checks that its
+// migrations are applied. The crawler credentials are encrypted with c.
+func openStore(config *config, c *crypto.Service) dataStore {
+	var dataStore dataStore
+	switch config.Store {
+	case "", storeMongo:
+		dataStore = mongo.New(tools.NewMongoHelper(config.Database), c)
+	case storeSQL:
+		sqlStore, err := sqlstore.Open(config.SQL, c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dataStore = sqlStore
+	case storeBolt:
+		boltStore, err := boltstore.Open(config.BoltPath, c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dataStore = boltStore
+	default:
+		log.Fatalf("Unknown store %s", config.Store)
+	}
+	if err := dataStore.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	return dataStore
+}
+
 func readConfig() *config {
 	conf := &config{
-		Database: new(tools.MongoConfig),
-		Email:    new(tools.EmailConfig),
+		Database:       new(tools.MongoConfig),
+		SQL:            new(sqlstore.Config),
+		AESAllowLegacy: true,
+		Email:          new(tools.EmailConfig),
 	}
 
 	readFileConfig(conf)
 	readEnvConfig(conf)
 	readFlagConfig(conf)
+	resolveSecrets(conf)
 	validateConfig(conf)
 
 	return conf
@@ -104,8 +216,29 @@ func readFileConfig(config *config) {
 }
 
 func readEnvConfig(config *config) {
+	// Store
+	val := os.Getenv("RC_STORE")
+	if len(val) > 0 {
+		config.Store = val
+	}
+	val = os.Getenv("RC_SQL_DRIVER")
+	if len(val) > 0 {
+		config.SQL.Driver = val
+	}
+	val = os.Getenv("RC_SQL_DSN")
+	if len(val) > 0 {
+		config.SQL.DSN = val
+	}
+	val = os.Getenv("RC_SQL_PASSWORD")
+	if len(val) > 0 {
+		config.SQL.Password = val
+	}
+	val = os.Getenv("RC_BOLT_PATH")
+	if len(val) > 0 {
+		config.BoltPath = val
+	}
 	// DB
-	val := os.Getenv("RC_DB_SERVICE_HOST")
+	val = os.Getenv("RC_DB_SERVICE_HOST")
 	val2 := os.Getenv("RC_DB_SERVICE_PORT")
 	if len(val) > 0 && len(val2) > 0 {
 		config.Database.URL = fmt.Sprintf("%s:%s", val, val2)
@@ -141,16 +274,69 @@ func readEnvConfig(config *config) {
 	if len(val) > 0 {
 		config.AESSecretKey = val
 	}
+	val = os.Getenv("RC_AES_KEY_DIR")
+	if len(val) > 0 {
+		config.AESKeyDir = val
+	}
+	val = os.Getenv("RC_AES_PRIMARY_KEY")
+	if len(val) > 0 {
+		config.AESPrimaryKey = val
+	}
+	val = os.Getenv("RC_AES_ALLOW_LEGACY")
+	if len(val) > 0 {
+		allow, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Fatalf("Invalid RC_AES_ALLOW_LEGACY %s", val)
+		}
+		config.AESAllowLegacy = allow
+	}
 	// Webservice
 	val = os.Getenv("RC_CRAWLER_PORT")
 	if len(val) > 0 {
 		config.WebservicePort = val
 	}
+	val = os.Getenv("RC_CRAWLER_API_SECRET")
+	if len(val) > 0 {
+		config.APISecret = val
+	}
+	val = os.Getenv("RC_CRAWLER_TLS_CERT")
+	if len(val) > 0 {
+		config.TLSCert = val
+	}
+	val = os.Getenv("RC_CRAWLER_TLS_KEY")
+	if len(val) > 0 {
+		config.TLSKey = val
+	}
+	val = os.Getenv("RC_CRAWLER_TLS_CLIENT_CA")
+	if len(val) > 0 {
+		config.TLSClientCA = val
+	}
+	val = os.Getenv("RC_CRAWLER_ADMIN_PORT")
+	if len(val) > 0 {
+		config.AdminPort = val
+	}
 }
 
 func readFlagConfig(config *config) {
+	// Store
+	val := *storeBackend
+	if len(val) > 0 {
+		config.Store = val
+	}
+	val = *sqlDriver
+	if len(val) > 0 {
+		config.SQL.Driver = val
+	}
+	val = *sqlDSN
+	if len(val) > 0 {
+		config.SQL.DSN = val
+	}
+	val = *boltPath
+	if len(val) > 0 {
+		config.BoltPath = val
+	}
 	// DB
-	val := *dbURL
+	val = *dbURL
 	if len(val) > 0 {
 		config.Database.URL = val
 	}
@@ -184,18 +370,53 @@ func readFlagConfig(config *config) {
 	if len(val) > 0 {
 		config.AESSecretKey = val
 	}
+	val = *aesKeyDir
+	if len(val) > 0 {
+		config.AESKeyDir = val
+	}
+	val = *aesPrimaryKey
+	if len(val) > 0 {
+		config.AESPrimaryKey = val
+	}
 	// Webservice
 	val = *webservicePort
 	if len(val) > 0 {
 		config.WebservicePort = val
 	}
+	val = *apiSecret
+	if len(val) > 0 {
+		config.APISecret = val
+	}
+	val = *adminPort
+	if len(val) > 0 {
+		config.AdminPort = val
+	}
+}
+
+// resolveSecrets replaces the secret references of the config, like
+// file:///run/secrets/aes_key, with the secrets.
+func resolveSecrets(config *config) {
+	if err := secrets.NewResolver().ResolveConfig(config); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func validateConfig(config *config) {
 	// TODO: actually validate the config.
 	// for now it will just get printed.
-	log.Printf("AES: %v", config.AESSecretKey)
+	log.Printf("AES: %v", secrets.Redact(config.AESSecretKey))
+	log.Printf("AES key dir: %v", config.AESKeyDir)
+	log.Printf("AES primary key: %v", config.AESPrimaryKey)
+	log.Printf("AES allow legacy: %v", config.AESAllowLegacy)
+	log.Printf("store: %v", config.Store)
 	log.Printf("db: %+v", config.Database)
+	log.Printf("sql: %+v", config.SQL)
+	log.Printf("bolt path: %v", config.BoltPath)
 	log.Printf("email: %+v", config.Email)
 	log.Printf("webservice port: %v", config.WebservicePort)
+	log.Printf("admin port: %v", config.AdminPort)
+	log.Printf("webservice mutual TLS: %v", len(config.TLSCert) > 0)
+	if len(config.APISecret) == 0 && len(config.TLSCert) == 0 {
+		log.Fatal("The webservice requires an api secret or mutual TLS")
+	}
 }
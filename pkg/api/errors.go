@@ -0,0 +1,6 @@
+package api
+
+import "errors"
+
+// ErrJobNotFound happens when a refresh job does not exist or expired.
+var ErrJobNotFound = errors.New("Refresh job not found")
@@ -2,10 +2,50 @@ package api
 
 import "time"
 
+// Refresh job statuses.
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// User roles.
+const (
+	// RoleAdmin gives access to the admin api.
+	RoleAdmin = "admin"
+)
+
 type (
 	// The Crawler interface exposes the public crawler api.
 	Crawler interface {
-		Refresh(userID string) error
+		// Refresh queues a run of the crawler for the user and returns
+		// the job without waiting for the run to finish.
+		Refresh(userID string) (*RefreshJob, error)
+		// RefreshJob returns a refresh job by id.
+		RefreshJob(jobID string) (*RefreshJob, error)
+	}
+
+	// JobStatus is the status of a refresh job.
+	JobStatus string
+
+	// RefreshJob contains info about a manual run of the crawler.
+	RefreshJob struct {
+		ID       string         `json:"id"`
+		UserID   string         `json:"userId"`
+		Status   JobStatus      `json:"status"`
+		Created  time.Time      `json:"created"`
+		Finished time.Time      `json:"finished"`
+		Classes  []ClassOutcome `json:"classes"`
+		Error    string         `json:"error,omitempty"`
+	}
+
+	// ClassOutcome contains the result of a refresh job for a class.
+	ClassOutcome struct {
+		ClassID    string `json:"classId"`
+		Name       string `json:"name"`
+		NewResults int    `json:"newResults"`
+		Error      string `json:"error,omitempty"`
 	}
 
 	// CrawlerConfig contains info about the crawler configuration.
@@ -15,14 +55,19 @@ type (
 		Code              string `json:"code"`
 		Nip               string `json:"nip"`
 		NotificationEmail string `json:"notificationEmail"`
+		// Disabled is set by an administrator to stop the crawler for the
+		// user, it can't be changed by the user.
+		Disabled bool `json:"disabled"`
+		Version  int  `json:"version"`
 	}
 
 	// User contains info about users.
 	User struct {
-		ID        string `json:"id"`
-		Email     string `json:"email"`
-		FirstName string `json:"firstName"`
-		LastName  string `json:"lastName"`
+		ID        string   `json:"id"`
+		Email     string   `json:"email"`
+		FirstName string   `json:"firstName"`
+		LastName  string   `json:"lastName"`
+		Roles     []string `json:"roles,omitempty"`
 	}
 
 	// Results contains all results for a user organized by class.
@@ -30,6 +75,7 @@ type (
 		UserID     string    `json:"userId"`
 		LastUpdate time.Time `json:"lastUpdate"`
 		Classes    []Class   `json:"classes"`
+		Version    int       `json:"version"`
 	}
 
 	// Class is an entity for a class.
@@ -43,6 +89,13 @@ type (
 		Final   string     `json:"final"`
 	}
 
+	// ResultsChange records the results of a class that were new or
+	// changed when the crawler ran. Class only contains those results.
+	ResultsChange struct {
+		Time  time.Time `json:"time"`
+		Class Class     `json:"class"`
+	}
+
 	// Result is an entity for storing a result
 	Result struct {
 		Name     string     `json:"name"`
@@ -57,3 +110,13 @@ type (
 		StandardDev string `json:"standardDev"`
 	}
 )
+
+// HasRole returns true if the user has the role.
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
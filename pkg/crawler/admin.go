@@ -0,0 +1,123 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Paths of the admin endpoints.
+const (
+	pathHealth    = "/healthz"
+	pathReady     = "/readyz"
+	pathDebug     = "/debug/scheduler"
+	pathMetrics   = "/metrics"
+	metricsPrefix = "resultscrawler_"
+)
+
+// Admin serves the health checks, the scheduler debug page and the
+// metrics of the crawler. It is not authenticated so it must only be
+// reachable from the internal network.
+type Admin struct {
+	scheduler *Scheduler
+	ready     func() error
+	mux       *http.ServeMux
+}
+
+// NewAdmin creates the admin handler. ready is optional, it is called by
+// the readiness check to verify the dependencies of the crawler, like the
+// database connection.
+func NewAdmin(scheduler *Scheduler, ready func() error) *Admin {
+	admin := &Admin{
+		scheduler: scheduler,
+		ready:     ready,
+		mux:       http.NewServeMux(),
+	}
+	admin.mux.HandleFunc(pathHealth, admin.healthHandler)
+	admin.mux.HandleFunc(pathReady, admin.readyHandler)
+	admin.mux.HandleFunc(pathDebug, admin.debugHandler)
+	admin.mux.HandleFunc(pathMetrics, admin.metricsHandler)
+	return admin
+}
+
+// StartAdmin serves the admin endpoints on addr.
+func StartAdmin(scheduler *Scheduler, ready func() error, addr string) {
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, NewAdmin(scheduler, ready)))
+	}()
+}
+
+func (admin *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	admin.mux.ServeHTTP(w, r)
+}
+
+// healthHandler responds as long as the process is alive.
+func (admin *Admin) healthHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// readyHandler responds with a 503 until the scheduler is started and
+// while its dependencies are unavailable.
+func (admin *Admin) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !admin.scheduler.Stats(false).Started {
+		http.Error(w, "Scheduler not started", http.StatusServiceUnavailable)
+		return
+	}
+	if admin.ready != nil {
+		if err := admin.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// debugHandler sends the scheduler stats, including the last run of every
+// user, as json.
+func (admin *Admin) debugHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(admin.scheduler.Stats(true)); err != nil {
+		log.Println(err)
+	}
+}
+
+// metricsHandler writes the scheduler stats in the prometheus text format.
+func (admin *Admin) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := admin.scheduler.Stats(false)
+	c := stats.Counters
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "crawls_total", "counter", "Number of crawler runs.", c.Crawls)
+	writeMetric(w, "crawl_seconds_total", "counter", "Time spent crawling in seconds.", c.CrawlSeconds)
+	writeMetric(w, "new_results_total", "counter", "Number of new or changed results found.", c.NewResults)
+	writeMetric(w, "notifications_sent_total", "counter", "Number of notifications sent.", c.NotificationsSent)
+	writeMetric(w, "notifications_failed_total", "counter", "Number of notifications that could not be sent.", c.NotificationsFailed)
+	writeMetric(w, "upstream_errors_total", "counter", "Number of classes that could not be fetched.", c.UpstreamErrors)
+	writeMetric(w, "save_errors_total", "counter", "Number of runs whose results could not be saved.", c.SaveErrors)
+	writeMetric(w, "queue_depth", "gauge", "Number of runs waiting for a crawler.", stats.Queued)
+	writeMetric(w, "running_crawls", "gauge", "Number of runs in progress.", stats.Running)
+	writeMetric(w, "crawlers", "gauge", "Number of crawlers.", stats.Crawlers)
+	writeMetric(w, "paused", "gauge", "1 if the scheduled updates are paused.", boolMetric(stats.Paused))
+	var lastCheck int64
+	if !stats.LastCheck.IsZero() {
+		lastCheck = stats.LastCheck.Unix()
+	}
+	writeMetric(w, "last_check_timestamp_seconds", "gauge", "Last time the scheduler looked for users to update.", lastCheck)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(w, "# TYPE %s%s %s\n", metricsPrefix, name, kind)
+	fmt.Fprintf(w, "%s%s %v\n", metricsPrefix, name, value)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+)
+
+func TestAdmin(t *testing.T) {
+	scheduler, store := start()
+	defer end()
+
+	var dbErr error
+	ts := httptest.NewServer(NewAdmin(scheduler, func() error { return dbErr }))
+	defer ts.Close()
+
+	if status := getStatus(t, ts.URL+pathHealth); status != http.StatusOK {
+		t.Errorf("Bad status code %d, should be %d", status, http.StatusOK)
+	}
+	// Not ready until the scheduler is started.
+	if status := getStatus(t, ts.URL+pathReady); status != http.StatusServiceUnavailable {
+		t.Errorf("Bad status code %d, should be %d", status, http.StatusServiceUnavailable)
+	}
+
+	go scheduler.Start()
+	defer scheduler.Stop()
+
+	getResultsFunc = func() (res []RunResult) {
+		return []RunResult{
+			RunResult{
+				ClassIndex: 0,
+				Class: &api.Class{
+					Results: []api.Result{api.Result{Name: "A result"}},
+				},
+			},
+			RunResult{
+				ClassIndex: 1,
+				Err:        errors.New("Upstream error"),
+			},
+		}
+	}
+	user := &api.User{Email: "random@user.com"}
+	store.CreateUser(user, "")
+	store.AddClass(user.ID, &api.Class{Name: "MAT1600", Group: "20", Year: "20151"})
+	store.AddClass(user.ID, &api.Class{Name: "INF1120", Group: "10", Year: "20151"})
+	scheduler.Queue(user)
+
+	deadline := time.Now().Add(time.Second)
+	for !scheduler.Stats(false).Started && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := getStatus(t, ts.URL+pathReady); status != http.StatusOK {
+		t.Errorf("Bad status code %d, should be %d", status, http.StatusOK)
+	}
+	dbErr = errors.New("Database unreachable")
+	if status := getStatus(t, ts.URL+pathReady); status != http.StatusServiceUnavailable {
+		t.Errorf("Bad status code %d, should be %d", status, http.StatusServiceUnavailable)
+	}
+
+	res, err := http.Get(ts.URL + pathDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &SchedulerStats{}
+	err = json.NewDecoder(res.Body).Decode(stats)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Users) != 1 || stats.Users[0].UserID != user.ID || stats.Users[0].NewResults != 1 ||
+		stats.Users[0].Error != "Upstream error" {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	res, err = http.Get(ts.URL + pathMetrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	for _, metric := range []string{
+		"resultscrawler_crawls_total 1\n",
+		"resultscrawler_new_results_total 1\n",
+		"resultscrawler_upstream_errors_total 1\n",
+		"resultscrawler_crawlers 10\n",
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Errorf("Missing metric %q in %s", metric, body)
+		}
+	}
+}
+
+func getStatus(t *testing.T, url string) int {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
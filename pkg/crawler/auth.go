@@ -0,0 +1,216 @@
+package crawler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+)
+
+const (
+	headerTimestamp = "X-Timestamp"
+	headerSignature = "X-Signature"
+	headerNonce     = "X-Nonce"
+
+	// Maximum difference between the timestamp of a signed request and the
+	// time it is received. The nonces are remembered for this long so a
+	// captured request can't be replayed.
+	maxSignatureAge = 5 * time.Minute
+)
+
+var (
+	errInvalidSignature = errors.New("Invalid request signature")
+	errExpiredSignature = errors.New("Expired request signature")
+	errReplayedRequest  = errors.New("Replayed request")
+)
+
+// nonceCache remembers the nonces of the signed requests until their
+// timestamp expires.
+type nonceCache struct {
+	mut     sync.Mutex
+	expires map[string]time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{
+		expires: make(map[string]time.Time),
+	}
+}
+
+// add records the nonce of a request signed at t. It returns false if the
+// nonce was already used.
+func (c *nonceCache) add(nonce string, t time.Time) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	now := time.Now()
+	for n, expires := range c.expires {
+		if now.After(expires) {
+			delete(c.expires, n)
+		}
+	}
+	if _, ok := c.expires[nonce]; ok {
+		return false
+	}
+	c.expires[nonce] = t.Add(maxSignatureAge)
+	return true
+}
+
+// SigningTransport signs requests sent to the crawler webservice with the
+// shared secret. Base is used to send the requests, http.DefaultTransport
+// is used if it is nil.
+type SigningTransport struct {
+	Secret string
+	Base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *SigningTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Round trippers must not modify the request.
+	req := new(http.Request)
+	*req = *r
+	req.Header = make(http.Header, len(r.Header)+2)
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(crypto.GenerateRandomKey(16))
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerSignature, signRequest(t.Secret, req, timestamp, nonce, body))
+	return base.RoundTrip(req)
+}
+
+// signRequest returns the hex encoded HMAC-SHA256 of the method, uri,
+// timestamp, nonce and body hash of the request.
+func signRequest(secret string, r *http.Request, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", r.Method, r.URL.RequestURI(), timestamp, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks the signature of a request received by the
+// webservice and that its nonce was not used before. The body is read and
+// replaced so handlers can still use it.
+func verifySignature(secret string, nonces *nonceCache, r *http.Request) error {
+	timestamp := r.Header.Get(headerTimestamp)
+	nonce := r.Header.Get(headerNonce)
+	signature, err := hex.DecodeString(r.Header.Get(headerSignature))
+	if err != nil || len(timestamp) == 0 || len(nonce) == 0 || len(signature) == 0 {
+		return errInvalidSignature
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	signed := time.Unix(unix, 0)
+	age := time.Since(signed)
+	if age > maxSignatureAge || age < -maxSignatureAge {
+		return errExpiredSignature
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	expected, _ := hex.DecodeString(signRequest(secret, r, timestamp, nonce, body))
+	if !hmac.Equal(signature, expected) {
+		return errInvalidSignature
+	}
+	if !nonces.add(nonce, signed) {
+		return errReplayedRequest
+	}
+	return nil
+}
+
+// hasClientCert returns true if the request was made over TLS with a
+// client certificate signed by one of the trusted CAs.
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// LoadServerTLS creates the TLS config of the webservice for mutual TLS.
+// Clients must present a certificate signed by a CA in clientCAFile.
+func LoadServerTLS(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// LoadClientTLS creates the TLS config of a client for mutual TLS. The
+// webservice certificate must be signed by a CA in caFile.
+func LoadClientTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificate found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,155 @@
+package crawler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/events"
+)
+
+func TestVerifySignature(t *testing.T) {
+	sign := func(method, url, body string, ts time.Time) *http.Request {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		nonce := strconv.FormatInt(ts.UnixNano(), 10)
+		r.Header.Set(headerTimestamp, timestamp)
+		r.Header.Set(headerNonce, nonce)
+		r.Header.Set(headerSignature, signRequest(testSecret, r, timestamp, nonce, []byte(body)))
+		return r
+	}
+	nonces := newNonceCache()
+
+	r := sign("POST", "/v1/users/1/refresh", "body", time.Now())
+	if err := verifySignature(testSecret, nonces, r); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+
+	r = sign("POST", "/v1/users/1/refresh", "body", time.Now())
+	if err := verifySignature("othersecret", nonces, r); err != errInvalidSignature {
+		t.Errorf("Expected errInvalidSignature, got %v", err)
+	}
+
+	// Changing the user of a signed request.
+	r = sign("POST", "/v1/users/1/refresh", "", time.Now())
+	r.URL.Path = "/v1/users/2/refresh"
+	if err := verifySignature(testSecret, nonces, r); err != errInvalidSignature {
+		t.Errorf("Expected errInvalidSignature, got %v", err)
+	}
+
+	r = sign("POST", "/v1/users/1/refresh", "", time.Now().Add(-2*maxSignatureAge))
+	if err := verifySignature(testSecret, nonces, r); err != errExpiredSignature {
+		t.Errorf("Expected errExpiredSignature, got %v", err)
+	}
+
+	// Replaying a signed request.
+	r = sign("POST", "/v1/users/1/refresh", "body", time.Now())
+	replay := httptest.NewRequest("POST", "/v1/users/1/refresh", strings.NewReader("body"))
+	replay.Header = r.Header
+	if err := verifySignature(testSecret, nonces, r); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	if err := verifySignature(testSecret, nonces, replay); err != errReplayedRequest {
+		t.Errorf("Expected errReplayedRequest, got %v", err)
+	}
+
+	// Changing the nonce of a signed request.
+	r = sign("POST", "/v1/users/1/refresh", "", time.Now())
+	r.Header.Set(headerNonce, "othernonce")
+	if err := verifySignature(testSecret, nonces, r); err != errInvalidSignature {
+		t.Errorf("Expected errInvalidSignature, got %v", err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	scheduler, store := start()
+	defer end()
+
+	caCert, caKey := newTestCert(t, nil, nil, false)
+	serverCert, _ := newTestCert(t, caCert.Leaf, caKey, false)
+	clientCert, _ := newTestCert(t, caCert.Leaf, caKey, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert.Leaf)
+
+	ts := httptest.NewUnstartedServer(NewWebservice(scheduler, store, events.NewLocalBus(), ""))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := NewClient(&ClientConfig{
+		Addr: ts.Listener.Addr().String(),
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      pool,
+		},
+	})
+	if _, err := client.Stats(); err != nil {
+		t.Error(err)
+	}
+
+	// Without a client certificate the handshake fails.
+	client = NewClient(&ClientConfig{
+		Addr: ts.Listener.Addr().String(),
+		TLS:  &tls.Config{RootCAs: pool},
+	})
+	if _, err := client.Stats(); err == nil {
+		t.Error("Expected an error without a client certificate")
+	}
+}
+
+// newTestCert creates a certificate signed by parent, or a self signed CA
+// if parent is nil.
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, client bool) (tls.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "resultscrawler test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent = template
+		parentKey = key
+	} else if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, key
+}
@@ -1,56 +1,193 @@
 package crawler
 
-import "net/rpc"
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
-// Client implements a rpc client for the crawler.
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+)
+
+const (
+	// Time after which a request to the webservice is abandoned.
+	clientTimeout = 10 * time.Second
+	// Number of times a request is attempted when the webservice can't be
+	// reached.
+	clientMaxAttempts = 3
+	// Delay before the first retry, it doubles after each attempt.
+	clientRetryDelay = 200 * time.Millisecond
+)
+
+// Client implements api.Crawler with the crawler webservice json api.
 type Client struct {
 	url    string
-	client *rpc.Client
+	client *http.Client
 }
 
-// NewClient creates a new client
-func NewClient(url string) *Client {
-	return &Client{url, nil}
+// ClientConfig configures how a client connects to the webservice.
+type ClientConfig struct {
+	// Addr is the address of the webservice. It can omit the scheme, https
+	// is used if TLS is set and http otherwise.
+	Addr string
+	// Secret is the shared secret used to sign requests.
+	Secret string
+	// TLS enables mutual TLS, see LoadClientTLS.
+	TLS *tls.Config
 }
 
-// Refresh calls the crawler webservice Queue method for the specified
-// userID
-func (c *Client) Refresh(userID string) error {
-	var reply int
-	if err := c.doWithRetry("Webservice.Queue", userID, &reply); err != nil {
-		return err
+// NewClient creates a client for the webservice.
+func NewClient(config *ClientConfig) *Client {
+	return &Client{
+		url: config.URL(),
+		client: &http.Client{
+			Transport: config.Transport(),
+			Timeout:   clientTimeout,
+		},
 	}
-	return nil
 }
 
-func (c *Client) prepareConnection() error {
-	if c.client == nil {
-		client, err := rpc.DialHTTP("tcp", c.url)
-		if err != nil {
-			return err
+// URL returns the base url of the webservice.
+func (config *ClientConfig) URL() string {
+	addr := config.Addr
+	if !strings.Contains(addr, "://") {
+		if config.TLS != nil {
+			addr = "https://" + addr
+		} else {
+			addr = "http://" + addr
 		}
-		c.client = client
 	}
-	return nil
+	return strings.TrimSuffix(addr, "/")
 }
 
-func (c *Client) doWithRetry(method string, args, reply interface{}) error {
-	if err := c.prepareConnection(); err != nil {
-		return err
+// Transport returns a transport that authenticates the requests sent to
+// the webservice. It can be used to build other clients of the
+// webservice, like the remote event bus.
+func (config *ClientConfig) Transport() http.RoundTripper {
+	var transport http.RoundTripper = http.DefaultTransport
+	if config.TLS != nil {
+		transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     config.TLS,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
 	}
+	if len(config.Secret) > 0 {
+		transport = &SigningTransport{
+			Secret: config.Secret,
+			Base:   transport,
+		}
+	}
+	return transport
+}
 
-	err := c.client.Call(method, args, reply)
-	if err == rpc.ErrShutdown {
-		c.client = nil
-		if err = c.prepareConnection(); err != nil {
-			return err
+// Refresh queues a run of the crawler for the specified userID.
+func (c *Client) Refresh(userID string) (*api.RefreshJob, error) {
+	job := &api.RefreshJob{}
+	path := strings.Replace(pathRefresh, ":userId", url.PathEscape(userID), 1)
+	if err := c.do("POST", path, job, nil); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// RefreshJob returns the refresh job with the specified jobID.
+func (c *Client) RefreshJob(jobID string) (*api.RefreshJob, error) {
+	job := &api.RefreshJob{}
+	path := strings.Replace(pathJob, ":jobId", url.PathEscape(jobID), 1)
+	if err := c.do("GET", path, job, api.ErrJobNotFound); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Stats returns the state of the scheduler.
+func (c *Client) Stats() (*SchedulerStats, error) {
+	stats := &SchedulerStats{}
+	if err := c.do("GET", pathStats, stats, nil); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Pause stops the scheduled updates.
+func (c *Client) Pause() (*SchedulerStats, error) {
+	stats := &SchedulerStats{}
+	if err := c.do("POST", pathPause, stats, nil); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Resume restarts the scheduled updates.
+func (c *Client) Resume() (*SchedulerStats, error) {
+	stats := &SchedulerStats{}
+	if err := c.do("POST", pathResume, stats, nil); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// do sends a request and decodes the json response in reply. If notFound
+// is set it is returned when the webservice responds with a 404. Requests
+// are retried when the webservice is unavailable. Since queuing a run twice
+// is not idempotent, POST requests are only retried when the connection
+// could not be established.
+func (c *Client) do(method, path string, reply interface{}, notFound error) error {
+	delay := clientRetryDelay
+	var err error
+	for i := 0; i < clientMaxAttempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
 		}
-		if err = c.client.Call(method, args, reply); err != nil {
+
+		var retry bool
+		retry, err = c.doOnce(method, path, reply, notFound)
+		if !retry {
 			return err
 		}
-	} else if err != nil {
-		return err
 	}
+	return err
+}
+
+func (c *Client) doOnce(method, path string, reply interface{}, notFound error) (bool, error) {
+	req, err := http.NewRequest(method, c.url+path, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return method == "GET" || isDialError(err), err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, json.NewDecoder(res.Body).Decode(reply)
+	case res.StatusCode == http.StatusNotFound && notFound != nil:
+		return false, notFound
+	}
+
+	resErr := &webserviceError{}
+	if err = json.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(resErr); err != nil {
+		resErr.Error = res.Status
+	}
+	err = fmt.Errorf("Crawler webservice error %d: %s", res.StatusCode, resErr.Error)
+	retry := res.StatusCode == http.StatusBadGateway ||
+		res.StatusCode == http.StatusServiceUnavailable ||
+		res.StatusCode == http.StatusGatewayTimeout
+	return retry && method == "GET", err
+}
 
-	return nil
+// isDialError returns true if the request failed before being sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
 }
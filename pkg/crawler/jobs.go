@@ -0,0 +1,87 @@
+package crawler
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+)
+
+// Time finished jobs are kept so clients can get their outcome. Jobs that
+// are still not finished this long after they are created are dropped too,
+// like the jobs of a crawler that stopped.
+const jobTTL = time.Hour
+
+// jobList keeps track of refresh jobs.
+type jobList struct {
+	mut  sync.Mutex
+	jobs map[string]*api.RefreshJob
+}
+
+func newJobList() *jobList {
+	return &jobList{
+		jobs: make(map[string]*api.RefreshJob),
+	}
+}
+
+// add creates a queued job for the user.
+func (l *jobList) add(userID string) *api.RefreshJob {
+	job := &api.RefreshJob{
+		ID:      hex.EncodeToString(crypto.GenerateRandomKey(12)),
+		UserID:  userID,
+		Status:  api.JobQueued,
+		Created: time.Now(),
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.removeExpired()
+	l.jobs[job.ID] = job
+
+	jobCopy := *job
+	return &jobCopy
+}
+
+// get returns a copy of the job.
+func (l *jobList) get(id string) (*api.RefreshJob, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	job, ok := l.jobs[id]
+	if !ok {
+		return nil, api.ErrJobNotFound
+	}
+	jobCopy := *job
+	return &jobCopy, nil
+}
+
+// update calls fn with the job while holding the lock.
+func (l *jobList) update(id string, fn func(*api.RefreshJob)) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if job, ok := l.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// fail marks the job as failed.
+func (l *jobList) fail(id string, err error) {
+	l.update(id, func(job *api.RefreshJob) {
+		job.Status = api.JobFailed
+		job.Error = err.Error()
+		job.Finished = time.Now()
+	})
+}
+
+func (l *jobList) removeExpired() {
+	for id, job := range l.jobs {
+		since := job.Finished
+		if since.IsZero() {
+			since = job.Created
+		}
+		if time.Since(since) > jobTTL {
+			delete(l.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package crawler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+)
+
+func TestJobListExpired(t *testing.T) {
+	l := newJobList()
+	finished := l.add("user1")
+	unfinished := l.add("user2")
+	recent := l.add("user3")
+
+	l.update(finished.ID, func(job *api.RefreshJob) {
+		job.Created = time.Now().Add(-2 * jobTTL)
+		job.Status = api.JobDone
+		job.Finished = time.Now().Add(-jobTTL - time.Minute)
+	})
+	l.update(unfinished.ID, func(job *api.RefreshJob) {
+		job.Created = time.Now().Add(-jobTTL - time.Minute)
+	})
+	l.update(recent.ID, func(job *api.RefreshJob) {
+		job.Created = time.Now().Add(-2 * jobTTL)
+		job.Status = api.JobDone
+		job.Finished = time.Now()
+	})
+
+	l.add("user4")
+
+	for _, id := range []string{finished.ID, unfinished.ID} {
+		if _, err := l.get(id); err != api.ErrJobNotFound {
+			t.Errorf("Expired job %s not removed", id)
+		}
+	}
+	if _, err := l.get(recent.ID); err != nil {
+		t.Errorf("Job finished recently was removed: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package mobluqam
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -23,8 +24,17 @@ const (
 	fieldYear  = "annee"
 	fieldClass = "sigle"
 	fieldGroup = "groupe"
+
+	// jsonPrefix is sent before the json to prevent json hijacking.
+	jsonPrefix = "while(1);"
+	// invalidInfoString is the message of the portal when the code or nip
+	// is not valid.
+	invalidInfoString = "Code permanent inexistant ou NIP non valide"
 )
 
+// ErrInvalidResponse happens when the webservice response cannot be parsed.
+var ErrInvalidResponse = errors.New("Invalid response")
+
 // Crawler for getting all grades of a user using the webservice on mobile.uqam.ca
 type Crawler struct {
 	Client crawler.ResultGetterClient
@@ -104,8 +114,9 @@ func (c *Crawler) runClass(user *crawler.User, classIndex int, doneCh chan crawl
 	defer resp.Body.Close()
 
 	respData, err := ioutil.ReadAll(resp.Body)
-	// Remove the while(1); before the actual json.
-	respData = respData[9:]
+	if err == nil {
+		err = checkResponse(resp.StatusCode, respData)
+	}
 	if err != nil {
 		doneCh <- crawler.RunResult{
 			ClassIndex: classIndex,
@@ -113,9 +124,14 @@ func (c *Crawler) runClass(user *crawler.User, classIndex int, doneCh chan crawl
 		}
 		return
 	}
+	// Remove the while(1); before the actual json.
+	respData = respData[len(jsonPrefix):]
 	log.Printf("Parsing response for %s\n", class.Name)
 	resultsResponse := &resultsResponse{}
 	err = json.Unmarshal(respData, resultsResponse)
+	if err == nil && len(resultsResponse.Normal) == 0 {
+		err = ErrInvalidResponse
+	}
 	if err != nil {
 		doneCh <- crawler.RunResult{
 			ClassIndex: classIndex,
@@ -131,6 +147,19 @@ func (c *Crawler) runClass(user *crawler.User, classIndex int, doneCh chan crawl
 	}
 }
 
+// checkResponse returns crawler.ErrInvalidCredentials if the webservice
+// refused the code and nip of the user.
+func checkResponse(status int, data []byte) error {
+	if status == http.StatusUnauthorized || status == http.StatusForbidden ||
+		strings.Contains(string(data), invalidInfoString) {
+		return crawler.ErrInvalidCredentials
+	}
+	if status != http.StatusOK || !strings.HasPrefix(string(data), jsonPrefix) {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
 type resultIndexes struct {
 	Result       int
 	Average      int
@@ -0,0 +1,78 @@
+package mobluqam
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/crawler"
+)
+
+type FakeClient struct {
+	Status int
+	Data   string
+}
+
+func (c *FakeClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: c.Status,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(c.Data)),
+	}, nil
+}
+
+func TestCrawlerNewResults(t *testing.T) {
+	c := &Crawler{&FakeClient{
+		Status: http.StatusOK,
+		Data:   `while(1);{"0":[["Element","Note"],["TP1","18/20"],["Total","18/20"]],"1":[]}`,
+	}}
+	results := c.Run(getTestUser())
+	if len(results) != 1 {
+		t.Fatalf("Bad results count %d, should be 1", len(results))
+	}
+	if results[0].Err != nil {
+		t.Fatalf("Expected no errors. Found error: %s", results[0].Err)
+	}
+	class := results[0].Class
+	if len(class.Results) != 1 || class.Results[0].Name != "TP1" || class.Total.Result != "18/20" {
+		t.Errorf("Bad class %+v", class)
+	}
+}
+
+func TestCrawlerErrorInvalidCredentials(t *testing.T) {
+	for _, client := range []*FakeClient{
+		{Status: http.StatusOK, Data: `while(1);{"erreur":"Code permanent inexistant ou NIP non valide"}`},
+		{Status: http.StatusUnauthorized, Data: ""},
+		{Status: http.StatusForbidden, Data: "while(1);[]"},
+	} {
+		results := (&Crawler{client}).Run(getTestUser())
+		if len(results) != 1 || results[0].Err != crawler.ErrInvalidCredentials {
+			t.Errorf("Expected ErrInvalidCredentials for %d %s. Found: %+v", client.Status, client.Data, results)
+		}
+	}
+}
+
+func TestCrawlerErrorInvalidResponse(t *testing.T) {
+	for _, client := range []*FakeClient{
+		{Status: http.StatusOK, Data: ""},
+		{Status: http.StatusOK, Data: `while(1);{"0":[]}`},
+		{Status: http.StatusInternalServerError, Data: "while(1);"},
+	} {
+		results := (&Crawler{client}).Run(getTestUser())
+		if len(results) != 1 || results[0].Err != ErrInvalidResponse {
+			t.Errorf("Expected ErrInvalidResponse for %d %s. Found: %+v", client.Status, client.Data, results)
+		}
+	}
+}
+
+func getTestUser() *crawler.User {
+	return &crawler.User{
+		Email: "test@test.com",
+		Code:  "code",
+		Nip:   "nip",
+		Classes: []api.Class{
+			{Name: "INF1120", Group: "10", Year: "20151"},
+		},
+	}
+}
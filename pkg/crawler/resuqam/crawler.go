@@ -42,7 +42,7 @@ var (
 	// ErrInvalidGroupClass happens when the group, class or year is invalid.
 	ErrInvalidGroupClass = errors.New("Invalid year/class/group")
 	// ErrInvalidCodeNip happens when the user code or nip is invalid.
-	ErrInvalidCodeNip = errors.New("Invalid code or nip")
+	ErrInvalidCodeNip = crawler.ErrInvalidCredentials
 	// ErrNotRegistered happens when the user isnt registered for the specified class.
 	ErrNotRegistered = errors.New("Not listed for this class")
 )
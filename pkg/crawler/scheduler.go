@@ -2,13 +2,16 @@ package crawler
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/events"
 	"github.com/janicduplessis/resultscrawler/pkg/store/crawlerconfig"
 	"github.com/janicduplessis/resultscrawler/pkg/store/results"
 	"github.com/janicduplessis/resultscrawler/pkg/store/user"
@@ -22,6 +25,15 @@ const (
 	updateInterval time.Duration = 10 * time.Minute
 )
 
+var (
+	// ErrInvalidCredentials is returned by ResultGetters in a RunResult
+	// when the user code or nip is refused.
+	ErrInvalidCredentials = errors.New("Invalid code or nip")
+	// ErrCrawlerDisabled happens when queuing a run for a user whose
+	// crawler was disabled by an administrator.
+	ErrCrawlerDisabled = errors.New("Crawler disabled")
+)
+
 var (
 	// MsgTemplatePath is the html template used to render emails.
 	msgTemplatePath = "msgtemplate.html"
@@ -48,6 +60,8 @@ type User struct {
 	Name    string
 	Email   string
 	DoneCh  chan bool
+	// JobID is the id of the refresh job for manual runs.
+	JobID string
 }
 
 // RunResult contains the result of a ResultGetter run for a class.
@@ -64,6 +78,9 @@ type SchedulerConfig struct {
 	CrawlerConfigStore crawlerconfig.Store
 	UserResultsStore   results.Store
 	Sender             tools.Sender
+	// EventBus is optional, if set the scheduler publishes crawl events
+	// and new results to it.
+	EventBus events.Bus
 }
 
 // Scheduler handles scheduling crawler runs for every user.
@@ -73,9 +90,16 @@ type Scheduler struct {
 	crawlerConfigStore crawlerconfig.Store
 	userResultsStore   results.Store
 	sender             tools.Sender
+	eventBus           events.Bus
+	jobs               *jobList
 
 	queueCh chan *User
 	doneCh  chan bool
+
+	stats *statsRecorder
+
+	mut    sync.Mutex
+	paused bool
 }
 
 // NewScheduler creates a new scuduler object.
@@ -93,9 +117,15 @@ func NewScheduler(config *SchedulerConfig) *Scheduler {
 		config.CrawlerConfigStore,
 		config.UserResultsStore,
 		config.Sender,
+		config.EventBus,
+		newJobList(),
 
 		queueCh,
 		doneCh,
+		newStatsRecorder(),
+
+		sync.Mutex{},
+		false,
 	}
 }
 
@@ -118,6 +148,39 @@ func (s *Scheduler) Stop() {
 	}
 }
 
+// Pause stops the scheduled updates. Runs that are queued manually still
+// happen.
+func (s *Scheduler) Pause() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.paused = true
+}
+
+// Resume restarts the scheduled updates after a pause.
+func (s *Scheduler) Resume() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.paused = false
+}
+
+// Stats returns a snapshot of the state of the scheduler. If withUsers
+// is true it includes the last run of every user.
+func (s *Scheduler) Stats(withUsers bool) *SchedulerStats {
+	stats := &SchedulerStats{
+		Paused:   s.isPaused(),
+		Crawlers: len(s.resultGetters),
+		Queued:   len(s.queueCh),
+	}
+	s.stats.snapshot(stats, withUsers)
+	return stats
+}
+
+func (s *Scheduler) isPaused() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.paused
+}
+
 // Queue tells the scheduler do a run for a user
 func (s *Scheduler) Queue(user *api.User) {
 	doneCh := make(chan bool)
@@ -125,16 +188,45 @@ func (s *Scheduler) Queue(user *api.User) {
 	<-doneCh
 }
 
-// QueueAsync tells the scheduler do a run for a user async
+// QueueAsync tells the scheduler do a run for a user async. doneCh is
+// closed without a value if the run could not be queued.
 func (s *Scheduler) QueueAsync(user *api.User, doneCh chan bool) {
 	// Get the user current results
 	results, err := s.userResultsStore.GetResults(user.ID)
+	if err == nil {
+		err = s.queueInternal(user, results, doneCh, "")
+	}
 	if err != nil {
 		log.Println(err)
-		return
+		if doneCh != nil {
+			close(doneCh)
+		}
 	}
+}
 
-	s.queueInternal(user, results, doneCh)
+// QueueJob tells the scheduler to do a run for a user. It returns
+// immediately with a job that can be used to follow the run with Job.
+func (s *Scheduler) QueueJob(user *api.User) *api.RefreshJob {
+	job := s.jobs.add(user.ID)
+
+	go func() {
+		results, err := s.userResultsStore.GetResults(user.ID)
+		if err == nil {
+			err = s.queueInternal(user, results, nil, job.ID)
+		}
+		if err != nil {
+			log.Println(err)
+			s.jobs.fail(job.ID, err)
+		}
+	}()
+
+	return job
+}
+
+// Job returns the refresh job with the specified id. Finished jobs are
+// kept for an hour.
+func (s *Scheduler) Job(jobID string) (*api.RefreshJob, error) {
+	return s.jobs.get(jobID)
 }
 
 func (s *Scheduler) crawlerLoop(crawler ResultGetter) {
@@ -151,45 +243,73 @@ func (s *Scheduler) crawlerLoop(crawler ResultGetter) {
 // The scheduler main loop.
 // Checks if any user needs to be updated every checkInterval.
 func (s *Scheduler) mainLoop() {
+	s.stats.setStarted(true)
+	defer s.stats.setStarted(false)
+
 	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			users, err := s.userStore.ListUsers()
-			if err != nil {
-				log.Println(err)
+			if s.isPaused() {
 				break
 			}
+			s.stats.checked()
+			s.queueDueUsers()
+		case <-s.doneCh:
+			// Stop the program
+			return
+		}
+	}
+}
 
-			// Check which users need to update
-			for _, user := range users {
-				// Get the user current results
-				results, err := s.userResultsStore.GetResults(user.ID)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
+// queueDueUsers queues a run for every user with the crawler enabled that
+// was not updated in the last updateInterval.
+func (s *Scheduler) queueDueUsers() {
+	query := &user.Query{
+		CrawlerEnabled: true,
+		DueBefore:      time.Now().Add(-updateInterval),
+	}
+	for {
+		page, err := s.userStore.ListUsers(query)
+		if err != nil {
+			log.Println(err)
+			return
+		}
 
-				// Check last update time.
-				if time.Now().Sub(results.LastUpdate) < updateInterval {
-					continue
-				}
+		for _, user := range page.Users {
+			// Get the user current results
+			results, err := s.userResultsStore.GetResults(user.ID)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
 
-				s.queueInternal(user, results, nil)
+			if err = s.queueInternal(user, results, nil, ""); err != nil && err != ErrCrawlerDisabled {
+				log.Println(err)
 			}
-		case <-s.doneCh:
-			// Stop the program
+		}
+
+		if len(page.Next) == 0 {
 			return
 		}
+		query.After = page.Next
 	}
 }
 
-func (s *Scheduler) queueInternal(user *api.User, results *api.Results, doneCh chan bool) {
+func (s *Scheduler) queueInternal(user *api.User, results *api.Results, doneCh chan bool, jobID string) error {
 	// Get crawler config.
 	crawlerConfig, err := s.crawlerConfigStore.GetCrawlerConfig(user.ID)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
+	}
+	if crawlerConfig.Disabled {
+		return ErrCrawlerDisabled
+	}
+	// Scheduled runs only happen for users that turned on the crawler,
+	// manual runs are always done.
+	if !crawlerConfig.Status && doneCh == nil && len(jobID) == 0 {
+		return nil
 	}
 
 	s.queueCh <- &User{
@@ -200,19 +320,42 @@ func (s *Scheduler) queueInternal(user *api.User, results *api.Results, doneCh c
 		Email:   crawlerConfig.NotificationEmail,
 		Name:    fmt.Sprintf("%s %s", user.FirstName, user.LastName),
 		DoneCh:  doneCh,
+		JobID:   jobID,
 	}
+	return nil
 }
 
 func (s *Scheduler) run(user *User, crawler ResultGetter) {
+	stats := &runStats{userID: user.ID, start: time.Now()}
+	s.stats.runStarted()
 	// Notify the caller when the run is done.
 	defer func() {
+		s.stats.runFinished(stats)
 		if user.DoneCh != nil {
 			user.DoneCh <- true
 			close(user.DoneCh)
 		}
 	}()
+	s.publish(events.NewEvent(events.CrawlStarted, user.ID))
+	if len(user.JobID) > 0 {
+		s.jobs.update(user.JobID, func(job *api.RefreshJob) {
+			job.Status = api.JobRunning
+		})
+	}
+
 	// Get results
 	results := crawler.Run(user)
+	for _, res := range results {
+		if res.Err != nil {
+			stats.upstreamErrors++
+			if stats.err == nil {
+				stats.err = res.Err
+			}
+		}
+	}
+	if hasInvalidCredentials(results) {
+		s.publish(events.NewEvent(events.CredentialsInvalid, user.ID))
+	}
 	// Check if results changed
 	newRes := getNewResults(user, results)
 	if len(newRes) > 0 {
@@ -221,31 +364,127 @@ func (s *Scheduler) run(user *User, crawler ResultGetter) {
 			oldRes = append(oldRes, *getClassByID(class.ID, user.Classes))
 		}
 		log.Printf("New results for user %s. Results: %+v. Old results: %+v", user.Email, newRes, oldRes)
-		if len(user.Email) > 0 {
-			err := s.sendEmail(user, newRes)
-			if err != nil {
-				log.Println(err)
-			}
+		for _, class := range newRes {
+			stats.newResults += len(class.Results)
 		}
-		// Update results
-		for _, res := range results {
-			// Ignore results with errors
-			if res.Err == nil {
-				user.Classes[res.ClassIndex].Results = res.Class.Results
-				user.Classes[res.ClassIndex].Total = res.Class.Total
-				user.Classes[res.ClassIndex].Final = res.Class.Final
+		if len(user.Email) > 0 {
+			stats.notified = true
+			stats.notifyErr = s.sendEmail(user, newRes)
+			if stats.notifyErr != nil {
+				log.Println(stats.notifyErr)
 			}
 		}
 	}
 
-	err := s.userResultsStore.UpdateResults(&api.Results{
-		UserID:     user.ID,
-		Classes:    user.Classes,
-		LastUpdate: time.Now(),
-	})
+	finished := events.NewEvent(events.CrawlFinished, user.ID)
+	err := s.saveResults(user, results, newRes)
 	if err != nil {
 		log.Println(err)
+		finished.Error = err.Error()
+		stats.saveErr = err
+		stats.err = err
+	} else if len(newRes) > 0 {
+		event := events.NewEvent(events.NewResults, user.ID)
+		event.Classes = newRes
+		s.publish(event)
+	}
+	if len(user.JobID) > 0 {
+		s.finishJob(user, results, newRes, err)
+	}
+	s.publish(finished)
+}
+
+// finishJob saves the outcome of the run for every class in the user job.
+// The job fails if the results could not be saved or if no class could
+// be crawled.
+func (s *Scheduler) finishJob(user *User, results []RunResult, newRes []api.Class, err error) {
+	outcomes := make([]api.ClassOutcome, len(results))
+	failed := 0
+	for i, res := range results {
+		class := user.Classes[res.ClassIndex]
+		outcomes[i] = api.ClassOutcome{
+			ClassID: class.ID,
+			Name:    class.Name,
+		}
+		if res.Err != nil {
+			outcomes[i].Error = res.Err.Error()
+			failed++
+		} else if c := getClassByID(class.ID, newRes); c != nil {
+			outcomes[i].NewResults = len(c.Results)
+		}
+	}
+
+	s.jobs.update(user.JobID, func(job *api.RefreshJob) {
+		job.Classes = outcomes
+		job.Finished = time.Now()
+		job.Status = api.JobDone
+		if err != nil {
+			job.Status = api.JobFailed
+			job.Error = err.Error()
+		} else if failed > 0 && failed == len(results) {
+			job.Status = api.JobFailed
+			job.Error = "Could not get results for any class"
+		}
+	})
+}
+
+func hasInvalidCredentials(results []RunResult) bool {
+	for _, res := range results {
+		if res.Err == ErrInvalidCredentials {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scheduler) publish(event *events.Event) {
+	if s.eventBus != nil {
+		s.eventBus.Publish(event)
+	}
+}
+
+// saveResults saves the results of every crawled class and adds the new
+// results to the history. Classes can be changed by the user while the
+// crawler runs, the results of the classes that were removed or changed
+// since the run started are ignored.
+func (s *Scheduler) saveResults(user *User, runResults []RunResult, newRes []api.Class) error {
+	saved := make(map[string]bool)
+	for _, res := range runResults {
+		// Ignore results with errors
+		if res.Err != nil {
+			continue
+		}
+		crawled := user.Classes[res.ClassIndex]
+		class := &api.Class{
+			ID:      crawled.ID,
+			Name:    crawled.Name,
+			Group:   crawled.Group,
+			Year:    crawled.Year,
+			Results: res.Class.Results,
+			Total:   res.Class.Total,
+			Final:   res.Class.Final,
+		}
+		err := s.userResultsStore.UpdateClassResults(user.ID, class)
+		if err == nil {
+			saved[class.ID] = true
+		} else if err != results.ErrClassNotFound {
+			return err
+		}
+	}
+
+	now := time.Now()
+	var changes []api.ResultsChange
+	for _, class := range newRes {
+		if saved[class.ID] {
+			changes = append(changes, api.ResultsChange{Time: now, Class: class})
+		}
+	}
+	if len(changes) > 0 {
+		if err := s.userResultsStore.AddChanges(user.ID, changes); err != nil {
+			return err
+		}
 	}
+	return s.userResultsStore.SetLastUpdate(user.ID, now)
 }
 
 func getClassByID(id string, classes []api.Class) *api.Class {
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/events"
 	"github.com/janicduplessis/resultscrawler/pkg/store/fakestore"
 )
 
@@ -68,6 +69,11 @@ func TestSchedulerNewResults(t *testing.T) {
 		messageSent = true
 	}
 
+	bus := events.NewLocalBus()
+	scheduler.eventBus = bus
+	sub := bus.Subscribe()
+	defer sub.Close()
+
 	user := &api.User{
 		Email:     "random@user.com",
 		FirstName: "random",
@@ -84,6 +90,7 @@ func TestSchedulerNewResults(t *testing.T) {
 			Year:  "20142",
 		},
 	}
+	store.SetResults(results)
 
 	go scheduler.Start()
 
@@ -91,14 +98,35 @@ func TestSchedulerNewResults(t *testing.T) {
 
 	scheduler.Stop()
 
+	results, _ = store.GetResults(user.ID)
 	if len(results.Classes[0].Results) == 0 {
 		t.Error("Results not updated")
 	}
+	changes, _ := store.GetChanges(user.ID)
+	if len(changes) != 1 || changes[0].Class.ID != "randomid" || len(changes[0].Class.Results) != 1 ||
+		changes[0].Time.IsZero() {
+		t.Errorf("Bad results history %+v", changes)
+	}
 
 	if !messageSent {
 		t.Error("Message not sent.")
 	}
 
+	expected := []events.Type{events.CrawlStarted, events.NewResults, events.CrawlFinished}
+	for _, eventType := range expected {
+		select {
+		case event := <-sub.C:
+			if event.Type != eventType || event.UserID != user.ID {
+				t.Errorf("Unexpected event %+v, expected %s", event, eventType)
+			}
+			if event.Type == events.NewResults && len(event.Classes) != 1 {
+				t.Errorf("Unexpected classes in new results event %+v", event.Classes)
+			}
+		default:
+			t.Errorf("Event %s not published.", eventType)
+		}
+	}
+
 	end()
 }
 
@@ -157,6 +185,7 @@ func TestSchedulerNoNewResults(t *testing.T) {
 			},
 		},
 	}
+	store.SetResults(results)
 
 	go scheduler.Start()
 
@@ -164,9 +193,13 @@ func TestSchedulerNoNewResults(t *testing.T) {
 
 	scheduler.Stop()
 
+	results, _ = store.GetResults(user.ID)
 	if len(results.Classes[0].Results) != 1 {
 		t.Error("Results not updated")
 	}
+	if changes, _ := store.GetChanges(user.ID); len(changes) != 0 {
+		t.Errorf("History changed without new results %+v", changes)
+	}
 
 	if messageSent {
 		t.Error("Sent an email when it was not supposed to.")
@@ -175,6 +208,200 @@ func TestSchedulerNoNewResults(t *testing.T) {
 	end()
 }
 
+func TestSchedulerClassRemovedDuringRun(t *testing.T) {
+	scheduler, store := start()
+
+	user := &api.User{
+		Email:     "random@user.com",
+		FirstName: "random",
+		LastName:  "user",
+	}
+	store.CreateUser(user, "")
+	class := &api.Class{
+		Name:  "Random Class",
+		Group: "21",
+		Year:  "20142",
+	}
+	store.AddClass(user.ID, class)
+
+	getResultsFunc = func() (res []RunResult) {
+		// The user removes the class while the crawler runs.
+		store.RemoveClass(user.ID, class.ID)
+		res = append(res, RunResult{
+			ClassIndex: 0,
+			Class: &api.Class{
+				Results: []api.Result{
+					api.Result{Name: "A result"},
+				},
+			},
+		})
+		return res
+	}
+
+	go scheduler.Start()
+
+	scheduler.Queue(user)
+
+	scheduler.Stop()
+
+	results, _ := store.GetResults(user.ID)
+	if len(results.Classes) != 0 {
+		t.Errorf("Removed class was saved back %+v", results.Classes)
+	}
+	if changes, _ := store.GetChanges(user.ID); len(changes) != 0 {
+		t.Errorf("Results of a removed class added to the history %+v", changes)
+	}
+	if results.LastUpdate.IsZero() {
+		t.Error("Last update not saved")
+	}
+
+	end()
+}
+
+func TestSchedulerClassChangedDuringRun(t *testing.T) {
+	scheduler, store := start()
+
+	user := &api.User{Email: "random@user.com"}
+	store.CreateUser(user, "")
+	changed := &api.Class{Name: "Random Class", Group: "21", Year: "20142"}
+	other := &api.Class{Name: "Other Class", Group: "10", Year: "20142"}
+	store.AddClass(user.ID, changed)
+	store.AddClass(user.ID, other)
+
+	getResultsFunc = func() (res []RunResult) {
+		// The user changes the group of a class while the crawler runs.
+		store.UpdateClass(user.ID, &api.Class{ID: changed.ID, Name: changed.Name, Group: "30", Year: changed.Year})
+		for i := 0; i < 2; i++ {
+			res = append(res, RunResult{
+				ClassIndex: i,
+				Class: &api.Class{
+					Results: []api.Result{{Name: "A result"}},
+				},
+			})
+		}
+		return res
+	}
+
+	go scheduler.Start()
+
+	scheduler.Queue(user)
+
+	scheduler.Stop()
+
+	results, _ := store.GetResults(user.ID)
+	if len(results.Classes) != 2 {
+		t.Fatalf("Bad classes %+v", results.Classes)
+	}
+	if len(results.Classes[0].Results) != 0 || results.Classes[0].Group != "30" {
+		t.Errorf("Results of the old group were saved %+v", results.Classes[0])
+	}
+	if len(results.Classes[1].Results) != 1 {
+		t.Errorf("Results not saved %+v", results.Classes[1])
+	}
+
+	end()
+}
+
+func TestSchedulerJob(t *testing.T) {
+	scheduler, store := start()
+
+	getResultsFunc = func() (res []RunResult) {
+		res = append(res, RunResult{
+			ClassIndex: 0,
+			Class: &api.Class{
+				Results: []api.Result{
+					api.Result{Name: "A result"},
+				},
+			},
+		}, RunResult{
+			ClassIndex: 1,
+			Err:        ErrInvalidCredentials,
+		})
+		return res
+	}
+
+	user := &api.User{
+		Email:     "random@user.com",
+		FirstName: "random",
+		LastName:  "user",
+	}
+	store.CreateUser(user, "")
+	class1 := &api.Class{Name: "MAT1600", Group: "20", Year: "20151"}
+	class2 := &api.Class{Name: "INF1120", Group: "10", Year: "20151"}
+	store.AddClass(user.ID, class1)
+	store.AddClass(user.ID, class2)
+
+	go scheduler.Start()
+
+	job := scheduler.QueueJob(user)
+	if job.Status != api.JobQueued || job.UserID != user.ID {
+		t.Errorf("Unexpected job %+v", job)
+	}
+
+	// Wait for the job to finish.
+	timeout := time.After(5 * time.Second)
+	for job.Finished.IsZero() {
+		select {
+		case <-timeout:
+			t.Fatal("Job not finished")
+		case <-time.After(10 * time.Millisecond):
+		}
+		job, _ = scheduler.Job(job.ID)
+	}
+
+	scheduler.Stop()
+
+	if job.Status != api.JobDone || len(job.Classes) != 2 {
+		t.Errorf("Unexpected job %+v", job)
+	} else {
+		if job.Classes[0].ClassID != class1.ID || job.Classes[0].NewResults != 1 {
+			t.Errorf("Unexpected outcome %+v", job.Classes[0])
+		}
+		if job.Classes[1].ClassID != class2.ID || job.Classes[1].Error != ErrInvalidCredentials.Error() {
+			t.Errorf("Unexpected outcome %+v", job.Classes[1])
+		}
+	}
+
+	if _, err := scheduler.Job("unknown"); err != api.ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+
+	end()
+}
+
+func TestSchedulerQueueDueUsers(t *testing.T) {
+	scheduler, store := start()
+
+	due := &api.User{Email: "due@user.com"}
+	store.CreateUser(due, "")
+	recent := &api.User{Email: "recent@user.com"}
+	store.CreateUser(recent, "")
+	results, _ := store.GetResults(recent.ID)
+	results.LastUpdate = time.Now()
+	store.SetResults(results)
+	off := &api.User{Email: "off@user.com"}
+	store.CreateUser(off, "")
+	config, _ := store.GetCrawlerConfig(off.ID)
+	config.Status = false
+	store.UpdateCrawlerConfig(config)
+	disabled := &api.User{Email: "disabled@user.com"}
+	store.CreateUser(disabled, "")
+	config, _ = store.GetCrawlerConfig(disabled.ID)
+	config.Disabled = true
+	store.UpdateCrawlerConfig(config)
+
+	scheduler.queueDueUsers()
+
+	if len(scheduler.queueCh) != 1 {
+		t.Fatalf("Expected 1 queued user, got %d", len(scheduler.queueCh))
+	}
+	if user := <-scheduler.queueCh; user.ID != due.ID {
+		t.Errorf("Expected user %s to be queued, got %s", due.Email, user.Email)
+	}
+
+	end()
+}
+
 func TestSchedulerLoad(t *testing.T) {
 	scheduler, store := start()
 	wg := sync.WaitGroup{}
@@ -228,6 +455,7 @@ func TestSchedulerLoad(t *testing.T) {
 			},
 		},
 	}
+	store.SetResults(results)
 
 	go scheduler.Start()
 	wg.Add(100)
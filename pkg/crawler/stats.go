@@ -0,0 +1,159 @@
+package crawler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// SchedulerStats is a snapshot of the state of the scheduler.
+	SchedulerStats struct {
+		// Started is true while the scheduler main loop runs.
+		Started bool `json:"started"`
+		Paused  bool `json:"paused"`
+		// Crawlers is the number of result getters.
+		Crawlers int `json:"crawlers"`
+		// Running is the number of runs in progress.
+		Running int `json:"running"`
+		// Queued is the number of runs waiting for a free result getter.
+		Queued int `json:"queued"`
+		// LastCheck is the last time the scheduler checked for users to
+		// update.
+		LastCheck time.Time         `json:"lastCheck"`
+		Counters  SchedulerCounters `json:"counters"`
+		// Users contains the last run of every user crawled since the
+		// crawler started.
+		Users []*UserStats `json:"users,omitempty"`
+	}
+
+	// SchedulerCounters counts what happened since the crawler started.
+	SchedulerCounters struct {
+		Crawls uint64 `json:"crawls"`
+		// CrawlSeconds is the total time spent crawling.
+		CrawlSeconds float64 `json:"crawlSeconds"`
+		// NewResults is the number of new or changed results found.
+		NewResults          uint64 `json:"newResults"`
+		NotificationsSent   uint64 `json:"notificationsSent"`
+		NotificationsFailed uint64 `json:"notificationsFailed"`
+		// UpstreamErrors is the number of classes that could not be
+		// fetched from the results website.
+		UpstreamErrors uint64 `json:"upstreamErrors"`
+		SaveErrors     uint64 `json:"saveErrors"`
+	}
+
+	// UserStats describes the last run for a user.
+	UserStats struct {
+		UserID    string    `json:"userId"`
+		LastCrawl time.Time `json:"lastCrawl"`
+		// Duration of the run in seconds.
+		Duration   float64 `json:"duration"`
+		NewResults int     `json:"newResults"`
+		Error      string  `json:"error,omitempty"`
+	}
+
+	// statsRecorder keeps the stats updated by the scheduler loops.
+	statsRecorder struct {
+		mut       sync.Mutex
+		started   bool
+		running   int
+		lastCheck time.Time
+		counters  SchedulerCounters
+		users     map[string]*UserStats
+	}
+
+	// runStats is what gets recorded at the end of a run.
+	runStats struct {
+		userID         string
+		start          time.Time
+		newResults     int
+		upstreamErrors int
+		notified       bool
+		notifyErr      error
+		saveErr        error
+		err            error
+	}
+)
+
+func newStatsRecorder() *statsRecorder {
+	return &statsRecorder{
+		users: make(map[string]*UserStats),
+	}
+}
+
+func (r *statsRecorder) setStarted(started bool) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.started = started
+}
+
+func (r *statsRecorder) checked() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.lastCheck = time.Now()
+}
+
+func (r *statsRecorder) runStarted() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.running++
+}
+
+func (r *statsRecorder) runFinished(run *runStats) {
+	duration := time.Since(run.start).Seconds()
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.running--
+	r.counters.Crawls++
+	r.counters.CrawlSeconds += duration
+	r.counters.NewResults += uint64(run.newResults)
+	r.counters.UpstreamErrors += uint64(run.upstreamErrors)
+	if run.notified {
+		if run.notifyErr != nil {
+			r.counters.NotificationsFailed++
+		} else {
+			r.counters.NotificationsSent++
+		}
+	}
+	if run.saveErr != nil {
+		r.counters.SaveErrors++
+	}
+
+	user := &UserStats{
+		UserID:     run.userID,
+		LastCrawl:  run.start,
+		Duration:   duration,
+		NewResults: run.newResults,
+	}
+	if run.err != nil {
+		user.Error = run.err.Error()
+	}
+	r.users[run.userID] = user
+}
+
+// snapshot copies the stats in s.
+func (r *statsRecorder) snapshot(s *SchedulerStats, withUsers bool) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	s.Started = r.started
+	s.Running = r.running
+	s.LastCheck = r.lastCheck
+	s.Counters = r.counters
+	if !withUsers {
+		return
+	}
+	s.Users = make([]*UserStats, 0, len(r.users))
+	for _, user := range r.users {
+		userCopy := *user
+		s.Users = append(s.Users, &userCopy)
+	}
+	sort.Sort(byLastCrawl(s.Users))
+}
+
+// byLastCrawl sorts the most recent runs first.
+type byLastCrawl []*UserStats
+
+func (a byLastCrawl) Len() int           { return len(a) }
+func (a byLastCrawl) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLastCrawl) Less(i, j int) bool { return a[i].LastCrawl.After(a[j].LastCrawl) }
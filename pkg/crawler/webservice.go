@@ -1,49 +1,193 @@
 package crawler
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"log"
-	"net"
 	"net/http"
-	"net/rpc"
 
+	"code.google.com/p/go.net/context"
+
+	"github.com/janicduplessis/resultscrawler/pkg/events"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
 	"github.com/janicduplessis/resultscrawler/pkg/store/user"
+	"github.com/janicduplessis/resultscrawler/pkg/ws"
+)
+
+// Paths of the crawler webservice api.
+const (
+	apiPrefix = "/v1"
+
+	// EventsPath is the path where the crawler events are served to remote
+	// event buses.
+	EventsPath = apiPrefix + "/events"
+
+	pathRefresh = apiPrefix + "/users/:userId/refresh"
+	pathJob     = apiPrefix + "/jobs/:jobId"
+	pathStats   = apiPrefix + "/scheduler/stats"
+	pathPause   = apiPrefix + "/scheduler/pause"
+	pathResume  = apiPrefix + "/scheduler/resume"
+)
+
+var errUserNotFound = errors.New("User not found")
+
+type (
+	// Webservice exposes the scheduler to the other services with a json
+	// http api. Every request must be signed with the shared secret or be
+	// made with a trusted client certificate.
+	Webservice struct {
+		scheduler *Scheduler
+		userStore user.Store
+		secret    string
+		nonces    *nonceCache
+		events    *events.Server
+		router    *ws.Router
+	}
+
+	// WebserviceConfig configures how the webservice listens and
+	// authenticates requests. At least one of Secret or TLS must be set.
+	WebserviceConfig struct {
+		// Addr is the address to listen on, like localhost:9000.
+		Addr string
+		// Secret is the shared secret used to sign requests.
+		Secret string
+		// TLS enables mutual TLS, see LoadServerTLS.
+		TLS *tls.Config
+	}
+
+	// webserviceError is the body of error responses.
+	webserviceError struct {
+		Error string `json:"error"`
+	}
 )
 
-// Webservice is the exported type for rpc.
-type Webservice struct {
-	scheduler *Scheduler
-	userStore user.Store
+// NewWebservice creates the crawler webservice. The events published on
+// eventBus are served at EventsPath. Requests signed with secret are
+// accepted, as well as requests with a client certificate verified by the
+// server TLS config.
+func NewWebservice(scheduler *Scheduler, userStore user.Store, eventBus events.Bus, secret string) *Webservice {
+	service := &Webservice{
+		scheduler: scheduler,
+		userStore: userStore,
+		secret:    secret,
+		nonces:    newNonceCache(),
+		events:    events.NewServer(eventBus, events.DefaultServerLogSize),
+		router:    ws.NewRouter(),
+	}
+
+	handlers := ws.NewMiddlewareGroup(service.authMiddleware)
+	service.router.POST(pathRefresh, handlers.Then(service.refreshHandler))
+	service.router.GET(pathJob, handlers.Then(service.jobHandler))
+	service.router.GET(pathStats, handlers.Then(service.statsHandler))
+	service.router.POST(pathPause, handlers.Then(service.pauseHandler))
+	service.router.POST(pathResume, handlers.Then(service.resumeHandler))
+	service.router.GET(EventsPath, handlers.Then(service.eventsHandler))
+
+	return service
 }
 
 // StartWebservice starts the crawler webservice.
-func StartWebservice(scheduler *Scheduler, userStore user.Store, port string) {
-	ws := &Webservice{
-		scheduler,
-		userStore,
+func StartWebservice(scheduler *Scheduler, userStore user.Store, eventBus events.Bus, config *WebserviceConfig) {
+	if len(config.Secret) == 0 && config.TLS == nil {
+		log.Fatal("The crawler webservice requires a secret or mutual TLS")
 	}
 
-	err := rpc.Register(ws)
-	if err != nil {
-		log.Fatal("register error", err)
+	server := &http.Server{
+		Addr:      config.Addr,
+		Handler:   NewWebservice(scheduler, userStore, eventBus, config.Secret),
+		TLSConfig: config.TLS,
 	}
-	rpc.HandleHTTP()
+	go func() {
+		if config.TLS != nil {
+			log.Fatal(server.ListenAndServeTLS("", ""))
+		} else {
+			log.Fatal(server.ListenAndServe())
+		}
+	}()
+}
 
-	l, err := net.Listen("tcp", ":"+port)
+func (service *Webservice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service.router.ServeHTTP(w, r)
+}
+
+// refreshHandler queues a run of the crawler for a user and returns the
+// refresh job without waiting for the run.
+func (service *Webservice) refreshHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := ws.Params(ctx).ByName("userId")
+	user, err := service.userStore.GetUser(userID)
+	if err == store.ErrNotFound || err == store.ErrInvalidID {
+		sendWebserviceError(w, http.StatusNotFound, errUserNotFound)
+		return
+	}
 	if err != nil {
-		log.Fatal("listen error", err)
+		log.Println(err)
+		sendWebserviceError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	go http.Serve(l, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	sendWebserviceJSON(w, service.scheduler.QueueJob(user))
 }
 
-// Queue starts the crawler for the specified userID.
-// This method is available to clients of the webservice throught the rpc package.
-func (ws *Webservice) Queue(userID string, ret *int) error {
-	user, err := ws.userStore.GetUser(userID)
+// jobHandler returns a refresh job.
+func (service *Webservice) jobHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	job, err := service.scheduler.Job(ws.Params(ctx).ByName("jobId"))
 	if err != nil {
-		return err
+		sendWebserviceError(w, http.StatusNotFound, err)
+		return
+	}
+	sendWebserviceJSON(w, job)
+}
+
+func (service *Webservice) statsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	sendWebserviceJSON(w, service.scheduler.Stats(false))
+}
+
+func (service *Webservice) pauseHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	service.scheduler.Pause()
+	sendWebserviceJSON(w, service.scheduler.Stats(false))
+}
+
+func (service *Webservice) resumeHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	service.scheduler.Resume()
+	sendWebserviceJSON(w, service.scheduler.Stats(false))
+}
+
+func (service *Webservice) eventsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	service.events.ServeHTTP(w, r)
+}
+
+// authMiddleware checks that the request was made with a trusted client
+// certificate or is signed with the shared secret.
+func (service *Webservice) authMiddleware(next ws.Handler) ws.Handler {
+	return ws.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !hasClientCert(r) {
+			err := errInvalidSignature
+			if len(service.secret) > 0 {
+				err = verifySignature(service.secret, service.nonces, r)
+			}
+			if err != nil {
+				sendWebserviceError(w, http.StatusUnauthorized, err)
+				return
+			}
+		}
+		next.ServeHTTP(ctx, w, r)
+	})
+}
+
+func sendWebserviceJSON(w http.ResponseWriter, obj interface{}) {
+	if len(w.Header().Get("Content-Type")) == 0 {
+		w.Header().Set("Content-Type", "application/json")
 	}
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		log.Println(err)
+	}
+}
 
-	ws.scheduler.Queue(user)
-	return nil
+func sendWebserviceError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	sendWebserviceJSON(w, &webserviceError{err.Error()})
 }
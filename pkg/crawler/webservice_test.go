@@ -0,0 +1,88 @@
+package crawler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/events"
+)
+
+const testSecret = "testsecret"
+
+func TestWebservice(t *testing.T) {
+	scheduler, store := start()
+	go scheduler.Start()
+	defer scheduler.Stop()
+
+	ts := httptest.NewServer(NewWebservice(scheduler, store, events.NewLocalBus(), testSecret))
+	defer ts.Close()
+
+	user := &api.User{
+		Email: "random@user.com",
+	}
+	store.CreateUser(user, "")
+
+	// Requests without a signature are refused.
+	res, err := http.Get(ts.URL + pathStats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusUnauthorized)
+	}
+	_, err = NewClient(&ClientConfig{Addr: ts.URL, Secret: "badsecret"}).Stats()
+	if err == nil {
+		t.Error("Expected an error with an invalid secret")
+	}
+
+	client := NewClient(&ClientConfig{Addr: ts.URL, Secret: testSecret})
+
+	job, err := client.Refresh(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.UserID != user.ID || len(job.ID) == 0 {
+		t.Errorf("Unexpected job %+v", job)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for job.Finished.IsZero() {
+		select {
+		case <-timeout:
+			t.Fatal("Job not finished")
+		case <-time.After(10 * time.Millisecond):
+		}
+		job, err = client.RefreshJob(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.Status != api.JobDone {
+		t.Errorf("Unexpected job status %s", job.Status)
+	}
+
+	if _, err = client.RefreshJob("unknown"); err != api.ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+
+	stats, err := client.Pause()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.Paused || stats.Crawlers != 10 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	stats, err = client.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Paused {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	end()
+}
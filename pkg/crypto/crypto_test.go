@@ -18,13 +18,13 @@ func TestCryptoEncryptDecrypt(t *testing.T) {
 
 	// Test if the encrypting and decrypting gives the same string
 	for _, curStr := range data {
-		crypted, err := AESEncrypt([]byte(curStr))
+		crypted, err := AESEncrypt([]byte(curStr), nil)
 		if err != nil {
 			t.Errorf("Error encrypting %s. Err: %s", curStr, err.Error())
 			continue
 		}
 		cryptedStr := string(crypted)
-		decrypted, err := AESDecrypt([]byte(cryptedStr))
+		decrypted, err := AESDecrypt([]byte(cryptedStr), nil)
 		if err != nil {
 			t.Errorf("Error decrypting %s. Err: %s", curStr, err.Error())
 		}
@@ -39,12 +39,47 @@ func TestCryptoEncrypt(t *testing.T) {
 	Init(testAESKey)
 	// Test if encrypting the same data gives different encrypted data
 	data := []byte("TEST")
-	crypted1, err := AESEncrypt(data)
+	crypted1, err := AESEncrypt(data, nil)
 	if err != nil {
 		t.Errorf("Error decrypting %s. Err: %s", string(data), err.Error())
 	}
-	crypted2, err := AESEncrypt(data)
+	crypted2, err := AESEncrypt(data, nil)
 	if string(crypted1) == string(crypted2) {
 		t.Errorf("Encrypted data is the same for the same data. Crypted1: %s, Crypted2: %s", string(crypted1), string(crypted2))
 	}
 }
+
+func TestCryptoServices(t *testing.T) {
+	if err := Init("short"); err == nil {
+		t.Error("Expected an error for a short key")
+	}
+	if _, err := NewKeyringService(NewKeyring()); err != errNoPrimaryKey {
+		t.Errorf("Expected errNoPrimaryKey, got %v", err)
+	}
+
+	// Two services with different keys can be used at the same time.
+	s1, err := NewService(testAESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := NewService(testAESKey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := s1.Encrypt([]byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s2.Decrypt(encrypted, nil); err != ErrDecryptionFailed {
+		t.Errorf("Expected ErrDecryptionFailed, got %v", err)
+	}
+	decrypted, err := s1.Decrypt(encrypted, nil)
+	if err != nil || string(decrypted) != "secret" {
+		t.Errorf("Bad decrypted data %s: %v", decrypted, err)
+	}
+
+	var s *Service
+	if _, err = s.Encrypt([]byte("secret"), nil); err != errNoService {
+		t.Errorf("Expected errNoService, got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultKeyID is the id of the key set with Init. It also decrypts the data
+// encrypted before the key ids were stored with the data.
+const DefaultKeyID = "default"
+
+// The encrypted data starts with a prefix for its format followed by the
+// key id and keyIDEnd. Data encrypted before the key ids were added has no
+// prefix, it is AES-CFB encrypted with the default key.
+const (
+	// cfbPrefix starts the data encrypted with AES-CFB, before AES-GCM was
+	// used. It is followed by the iv and the encrypted bytes.
+	cfbPrefix = "rck:"
+	// gcmPrefix starts the data encrypted with AES-GCM. It is followed by
+	// the nonce and the sealed bytes.
+	gcmPrefix = "rcg:"
+	keyIDEnd  = ':'
+)
+
+var (
+	// ErrUnknownKey happens when the data was encrypted with a key that is
+	// not in the keyring.
+	ErrUnknownKey = errors.New("The data was encrypted with an unknown key")
+
+	// ErrDecryptionFailed happens when the data was modified or was
+	// encrypted with other associated data.
+	ErrDecryptionFailed = errors.New("Decryption failed, the data is not authentic")
+
+	errInvalidKeyID = errors.New("Key ids can only contain letters, digits, - and _")
+	errNoPrimaryKey = errors.New("The keyring has no primary key")
+)
+
+// Keyring encrypts data with its primary key and decrypts data encrypted
+// with any of its keys. The keys must be added before the keyring is used.
+type Keyring struct {
+	// legacyReads is the number of AES-CFB values decrypted, it is first
+	// to be aligned for the atomic operations.
+	legacyReads int64
+	primary     string
+	keys        map[string]*key
+	allowLegacy bool
+}
+
+type key struct {
+	block cipher.Block
+	gcm   cipher.AEAD
+}
+
+// format is how some data was encrypted.
+type format int
+
+const (
+	formatLegacy format = iota
+	formatCFB
+	formatGCM
+)
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]*key)}
+}
+
+// LoadKeyring returns a keyring with secret as the default key, if it is
+// not empty, and the keys in the files of dir, if it is not empty. The file
+// names are the key ids. The primary key is the default key if primary is
+// empty.
+func LoadKeyring(secret string, dir string, primary string) (*Keyring, error) {
+	k := NewKeyring()
+	if len(secret) > 0 {
+		if err := k.Add(DefaultKeyID, []byte(secret)); err != nil {
+			return nil, err
+		}
+	}
+	if len(dir) > 0 {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			// Skip the hidden files, like the ones created when kubernetes
+			// mounts secrets.
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			key, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if !validKeySize(len(key)) {
+				key = bytes.TrimRight(key, "\r\n")
+			}
+			if err = k.Add(f.Name(), key); err != nil {
+				return nil, fmt.Errorf("Key file %s: %v", f.Name(), err)
+			}
+		}
+	}
+	if len(primary) == 0 {
+		primary = DefaultKeyID
+	}
+	if err := k.SetPrimary(primary); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Add adds a key to the keyring. The key must be 16, 24 or 32 bytes long.
+func (k *Keyring) Add(id string, secret []byte) error {
+	if !validKeyID(id) {
+		return errInvalidKeyID
+	}
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("Duplicate key %s", id)
+	}
+	if !validKeySize(len(secret)) {
+		return fmt.Errorf("Key %s must be 16, 24 or 32 bytes long, got %d", id, len(secret))
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = &key{block, gcm}
+	return nil
+}
+
+// SetPrimary sets the key used to encrypt.
+func (k *Keyring) SetPrimary(id string) error {
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("Unknown primary key %s", id)
+	}
+	k.primary = id
+	return nil
+}
+
+// Primary returns the id of the key used to encrypt.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// SetAllowLegacy sets if the data encrypted with AES-CFB can be decrypted.
+// It is not authenticated so it is refused by default, it should only be
+// allowed until rcadmin rotate-keys finds no legacy data.
+func (k *Keyring) SetAllowLegacy(allow bool) {
+	k.allowLegacy = allow
+}
+
+// LegacyReads returns the number of AES-CFB values decrypted.
+func (k *Keyring) LegacyReads() int {
+	return int(atomic.LoadInt64(&k.legacyReads))
+}
+
+// Encrypt encrypts the data with AES-GCM and the primary key. The
+// associated data, like the id of the user who owns the data, must be
+// passed again to decrypt it.
+func (k *Keyring) Encrypt(data []byte, associatedData []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	key, ok := k.keys[k.primary]
+	if !ok {
+		return nil, errNoPrimaryKey
+	}
+	nonce := GenerateRandomKey(key.gcm.NonceSize())
+	if nonce == nil {
+		return nil, errors.New("Failed to generate random nonce")
+	}
+	res := []byte(gcmPrefix + k.primary)
+	res = append(res, keyIDEnd)
+	res = append(res, nonce...)
+	return key.gcm.Seal(res, nonce, data, associatedData), nil
+}
+
+// Decrypt decrypts data encrypted with any of the keys. The data encrypted
+// with AES-CFB returns ErrDecryptionFailed unless legacy data is allowed,
+// its associated data is ignored and it is upgraded to AES-GCM the next
+// time it is encrypted.
+func (k *Keyring) Decrypt(data []byte, associatedData []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	f, id, data := splitHeader(data)
+	if f != formatGCM && !k.allowLegacy {
+		return nil, ErrDecryptionFailed
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if f != formatGCM {
+		atomic.AddInt64(&k.legacyReads, 1)
+		return decryptCFB(key.block, data)
+	}
+
+	size := key.gcm.NonceSize()
+	if len(data) < size {
+		return nil, ErrDecryptionFailed
+	}
+	decrypted, err := key.gcm.Open(nil, data[:size], data[size:], associatedData)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return decrypted, nil
+}
+
+// KeyID returns the id of the key that encrypted the data.
+func KeyID(data []byte) string {
+	_, id, _ := splitHeader(data)
+	return id
+}
+
+// IsLegacy returns true if the data was encrypted with AES-CFB.
+func IsLegacy(data []byte) bool {
+	f, _, _ := splitHeader(data)
+	return len(data) > 0 && f != formatGCM
+}
+
+func decryptCFB(block cipher.Block, data []byte) ([]byte, error) {
+	size := aes.BlockSize
+	if len(data) <= size {
+		return nil, errors.New("Decryption failed, data does not contain iv")
+	}
+	iv := data[:size]
+	data = data[size:]
+	decrypter := cipher.NewCFBDecrypter(block, iv)
+	decrypted := make([]byte, len(data))
+	decrypter.XORKeyStream(decrypted, data)
+	return decrypted, nil
+}
+
+// splitHeader returns the format and key id of encrypted data and the
+// encrypted bytes.
+func splitHeader(data []byte) (format, string, []byte) {
+	var f format
+	switch {
+	case bytes.HasPrefix(data, []byte(gcmPrefix)):
+		f = formatGCM
+	case bytes.HasPrefix(data, []byte(cfbPrefix)):
+		f = formatCFB
+	default:
+		return formatLegacy, DefaultKeyID, data
+	}
+	rest := data[len(gcmPrefix):]
+	end := bytes.IndexByte(rest, keyIDEnd)
+	if end < 0 || !validKeyID(string(rest[:end])) {
+		return formatLegacy, DefaultKeyID, data
+	}
+	return f, string(rest[:end]), rest[end+1:]
+}
+
+func validKeyID(id string) bool {
+	if len(id) == 0 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func validKeySize(size int) bool {
+	return size == 16 || size == 24 || size == 32
+}
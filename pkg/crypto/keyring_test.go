@@ -0,0 +1,223 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testAESKey2 = "abcd1234abcd1234abcd1234"
+
+var testUserID = []byte("55a5a0e6c3a6ef1b47000001")
+
+func TestKeyringRotation(t *testing.T) {
+	old := NewKeyring()
+	old.Add("old", []byte(testAESKey))
+	old.SetPrimary("old")
+	encrypted, err := old.Encrypt([]byte("secret"), testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := KeyID(encrypted); id != "old" {
+		t.Errorf("Bad key id %s, should be old", id)
+	}
+
+	k := NewKeyring()
+	k.Add("old", []byte(testAESKey))
+	k.Add("new", []byte(testAESKey2))
+	if err = k.SetPrimary("new"); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := k.Decrypt(encrypted, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "secret" {
+		t.Errorf("Bad decrypted data %s, should be secret", decrypted)
+	}
+	reencrypted, err := k.Encrypt(decrypted, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := KeyID(reencrypted); id != "new" {
+		t.Errorf("Bad key id %s, should be new", id)
+	}
+
+	// The old keyring doesn't have the new key.
+	if _, err = old.Decrypt(reencrypted, testUserID); err != ErrUnknownKey {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestKeyringLegacyData(t *testing.T) {
+	// Data encrypted before the key ids were added.
+	block, _ := aes.NewCipher([]byte(testAESKey))
+	iv := GenerateRandomKey(aes.BlockSize)
+	legacy := make([]byte, 6)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(legacy, []byte("secret"))
+	legacy = append(iv, legacy...)
+
+	if id := KeyID(legacy); id != DefaultKeyID {
+		t.Errorf("Bad key id %s, should be %s", id, DefaultKeyID)
+	}
+	Init(testAESKey)
+	if _, err := AESDecrypt(legacy, testUserID); err != ErrDecryptionFailed {
+		t.Errorf("Expected ErrDecryptionFailed for legacy data, got %v", err)
+	}
+
+	k, err := LoadKeyring(testAESKey, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.SetAllowLegacy(true)
+	decrypted, err := k.Decrypt(legacy, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "secret" {
+		t.Errorf("Bad decrypted data %s, should be secret", decrypted)
+	}
+	if n := k.LegacyReads(); n != 1 {
+		t.Errorf("Bad legacy reads %d, should be 1", n)
+	}
+}
+
+func TestKeyringLegacyKeyIDData(t *testing.T) {
+	// Data encrypted with AES-CFB after the key ids were added.
+	block, _ := aes.NewCipher([]byte(testAESKey2))
+	iv := GenerateRandomKey(aes.BlockSize)
+	encrypted := make([]byte, 6)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, []byte("secret"))
+	legacy := append([]byte(cfbPrefix+"old:"), iv...)
+	legacy = append(legacy, encrypted...)
+
+	if id := KeyID(legacy); id != "old" {
+		t.Errorf("Bad key id %s, should be old", id)
+	}
+	if !IsLegacy(legacy) {
+		t.Error("Expected AES-CFB data to be legacy")
+	}
+	k := NewKeyring()
+	k.Add("old", []byte(testAESKey2))
+	k.SetPrimary("old")
+	if _, err := k.Decrypt(legacy, testUserID); err != ErrDecryptionFailed {
+		t.Errorf("Expected ErrDecryptionFailed for legacy data, got %v", err)
+	}
+	k.SetAllowLegacy(true)
+	decrypted, err := k.Decrypt(legacy, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "secret" {
+		t.Errorf("Bad decrypted data %s, should be secret", decrypted)
+	}
+
+	// It is upgraded to AES-GCM when encrypted again.
+	upgraded, err := k.Encrypt(decrypted, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsLegacy(upgraded) {
+		t.Error("Expected encrypted data to use AES-GCM")
+	}
+}
+
+func TestKeyringAuthentication(t *testing.T) {
+	k := NewKeyring()
+	k.Add(DefaultKeyID, []byte(testAESKey))
+	k.SetPrimary(DefaultKeyID)
+	encrypted, err := k.Encrypt([]byte("secret"), testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err = k.Decrypt(tampered, testUserID); err != ErrDecryptionFailed {
+		t.Errorf("Expected ErrDecryptionFailed for tampered data, got %v", err)
+	}
+	if _, err = k.Decrypt(encrypted, []byte("55a5a0e6c3a6ef1b47000002")); err != ErrDecryptionFailed {
+		t.Errorf("Expected ErrDecryptionFailed for another user, got %v", err)
+	}
+	if _, err = k.Decrypt(encrypted[:len(gcmPrefix)+len(DefaultKeyID)+2], testUserID); err != ErrDecryptionFailed {
+		t.Errorf("Expected ErrDecryptionFailed for truncated data, got %v", err)
+	}
+
+	// Without its header the data would be read as legacy AES-CFB data.
+	stripped := encrypted[len(gcmPrefix)+len(DefaultKeyID)+1:]
+	if _, err = k.Decrypt(stripped, testUserID); err != ErrDecryptionFailed {
+		t.Errorf("Expected ErrDecryptionFailed for data without its header, got %v", err)
+	}
+	if n := k.LegacyReads(); n != 0 {
+		t.Errorf("Bad legacy reads %d, should be 0", n)
+	}
+}
+
+func TestKeyringKeySizes(t *testing.T) {
+	for _, secret := range []string{testAESKey, testAESKey2, testAESKey + testAESKey} {
+		Init(secret)
+		encrypted, err := AESEncrypt([]byte("secret"), testUserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := AESDecrypt(encrypted, testUserID)
+		if err != nil || string(decrypted) != "secret" {
+			t.Errorf("Bad decrypted data %s with a key of %d bytes: %v", decrypted, len(secret), err)
+		}
+	}
+}
+
+func TestKeyringInvalidKeys(t *testing.T) {
+	k := NewKeyring()
+	if err := k.Add("bad:id", []byte(testAESKey)); err == nil {
+		t.Error("Expected an error for an invalid key id")
+	}
+	if err := k.Add("short", []byte("short")); err == nil {
+		t.Error("Expected an error for a short key")
+	}
+	if err := k.Add("key", []byte(testAESKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Add("key", []byte(testAESKey)); err == nil {
+		t.Error("Expected an error for a duplicate key")
+	}
+	if err := k.SetPrimary("unknown"); err == nil {
+		t.Error("Expected an error for an unknown primary key")
+	}
+	if _, err := k.Encrypt([]byte("secret"), nil); err != errNoPrimaryKey {
+		t.Errorf("Expected errNoPrimaryKey, got %v", err)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "2015-06"), []byte(testAESKey2+"\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("ignored"), 0600)
+
+	k, err := LoadKeyring(testAESKey, dir, "2015-06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k.keys) != 2 || k.Primary() != "2015-06" {
+		t.Errorf("Bad keyring with %d keys and primary key %s", len(k.keys), k.Primary())
+	}
+
+	k, err = LoadKeyring(testAESKey, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Primary() != DefaultKeyID {
+		t.Errorf("Bad primary key %s, should be %s", k.Primary(), DefaultKeyID)
+	}
+
+	if _, err = LoadKeyring("", dir, ""); err == nil {
+		t.Error("Expected an error without a primary key")
+	}
+}
@@ -0,0 +1,176 @@
+package crypto
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"golang.org/x/crypto/argon2"
+)
+
+// Password hashing algorithms.
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+const (
+	argon2Prefix  = "$argon2id$"
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+
+	defaultArgon2Time    = 1
+	defaultArgon2Memory  = 64 * 1024
+	defaultArgon2Threads = 4
+)
+
+var errInvalidHash = errors.New("Invalid password hash")
+
+// PasswordConfig is the password hashing policy. The zero value uses bcrypt
+// with the default cost.
+type PasswordConfig struct {
+	// Algorithm is bcrypt or argon2id, bcrypt if it is empty.
+	Algorithm  string
+	BcryptCost int
+	// Argon2Time is the number of passes, Argon2Memory the memory used in
+	// KiB and Argon2Threads the parallelism.
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+// PasswordHasher hashes the passwords with the algorithm and parameters of
+// its config. The algorithm and parameters are part of the hash so the
+// passwords hashed with an older policy can still be checked.
+type PasswordHasher struct {
+	config PasswordConfig
+}
+
+// argon2Params are the parameters encoded in an argon2id hash.
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// defaultHasher is used by GenerateFromPassword and CompareHashAndPassword.
+var defaultHasher = &PasswordHasher{PasswordConfig{
+	Algorithm:  AlgorithmBcrypt,
+	BcryptCost: bcrypt.DefaultCost,
+}}
+
+// NewPasswordHasher returns a hasher for the config, the zero values are
+// replaced by the defaults.
+func NewPasswordHasher(config *PasswordConfig) (*PasswordHasher, error) {
+	c := *config
+	switch c.Algorithm {
+	case "", AlgorithmBcrypt:
+		c.Algorithm = AlgorithmBcrypt
+		if c.BcryptCost == 0 {
+			c.BcryptCost = bcrypt.DefaultCost
+		}
+		if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("Bcrypt cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, c.BcryptCost)
+		}
+	case AlgorithmArgon2id:
+		if c.Argon2Time == 0 {
+			c.Argon2Time = defaultArgon2Time
+		}
+		if c.Argon2Memory == 0 {
+			c.Argon2Memory = defaultArgon2Memory
+		}
+		if c.Argon2Threads == 0 {
+			c.Argon2Threads = defaultArgon2Threads
+		}
+	default:
+		return nil, fmt.Errorf("Unknown password algorithm %s", c.Algorithm)
+	}
+	return &PasswordHasher{c}, nil
+}
+
+// Hash creates a hash from the plain text password.
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.config.Algorithm == AlgorithmArgon2id {
+		salt := GenerateRandomKey(argon2SaltLen)
+		if salt == nil {
+			return "", errors.New("Failed to generate random salt")
+		}
+		return encodeArgon2(h.argon2Params(), salt, []byte(password)), nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.config.BcryptCost)
+	return string(hash), err
+}
+
+// Compare checks if the hashed password matches the plain text one, the
+// hash can use any supported algorithm.
+func (h *PasswordHasher) Compare(hash string, password string) (bool, error) {
+	if strings.HasPrefix(hash, argon2Prefix) {
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// NeedsRehash returns true if the hash doesn't use the algorithm and
+// parameters of the hasher. The password should be hashed again the next
+// time it is known, after a successful login.
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	if h.config.Algorithm == AlgorithmArgon2id {
+		params, _, _, err := decodeArgon2(hash)
+		return err != nil || params != h.argon2Params()
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.config.BcryptCost
+}
+
+func (h *PasswordHasher) argon2Params() argon2Params {
+	return argon2Params{h.config.Argon2Time, h.config.Argon2Memory, h.config.Argon2Threads}
+}
+
+// encodeArgon2 returns the hash of the password in the PHC string format,
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>.
+func encodeArgon2(params argon2Params, salt []byte, password []byte) string {
+	key := argon2.IDKey(password, salt, params.time, params.memory, params.threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version,
+		params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func decodeArgon2(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return params, nil, nil, errInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errInvalidHash
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return params, nil, nil, errInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errInvalidHash
+	}
+	return params, salt, key, nil
+}
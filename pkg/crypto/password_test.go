@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+// testArgon2Config keeps the tests fast.
+var testArgon2Config = &PasswordConfig{
+	Algorithm:     AlgorithmArgon2id,
+	Argon2Memory:  1024,
+	Argon2Threads: 1,
+}
+
+func TestPasswordHashers(t *testing.T) {
+	for _, config := range []*PasswordConfig{{}, {BcryptCost: 5}, testArgon2Config} {
+		h, err := NewPasswordHasher(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := h.Hash("h4ck3r")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := h.Compare(hash, "h4ck3r"); !ok || err != nil {
+			t.Errorf("Password doesn't match %s: %v", hash, err)
+		}
+		if ok, err := h.Compare(hash, "h4ck3r2"); ok || err != nil {
+			t.Errorf("Bad password matches %s: %v", hash, err)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("Hash %s should not need a rehash", hash)
+		}
+	}
+}
+
+func TestPasswordRehash(t *testing.T) {
+	bcryptHasher, _ := NewPasswordHasher(&PasswordConfig{BcryptCost: 5})
+	argon2Hasher, _ := NewPasswordHasher(testArgon2Config)
+	strongerHasher, _ := NewPasswordHasher(&PasswordConfig{
+		Algorithm:     AlgorithmArgon2id,
+		Argon2Time:    2,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+	})
+
+	bcryptHash, _ := bcryptHasher.Hash("h4ck3r")
+	argon2Hash, _ := argon2Hasher.Hash("h4ck3r")
+	if !strings.HasPrefix(argon2Hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Bad argon2id hash %s", argon2Hash)
+	}
+
+	// Every hasher checks the hashes of the other algorithms.
+	if ok, _ := argon2Hasher.Compare(bcryptHash, "h4ck3r"); !ok {
+		t.Error("Argon2id hasher doesn't check bcrypt hashes")
+	}
+	if ok, _ := bcryptHasher.Compare(argon2Hash, "h4ck3r"); !ok {
+		t.Error("Bcrypt hasher doesn't check argon2id hashes")
+	}
+
+	if !argon2Hasher.NeedsRehash(bcryptHash) || !bcryptHasher.NeedsRehash(argon2Hash) {
+		t.Error("Hashes of another algorithm should need a rehash")
+	}
+	if !strongerHasher.NeedsRehash(argon2Hash) {
+		t.Error("Hashes with other parameters should need a rehash")
+	}
+	if !defaultHasher.NeedsRehash(bcryptHash) {
+		t.Error("Hashes with another bcrypt cost should need a rehash")
+	}
+}
+
+func TestPasswordInvalidConfig(t *testing.T) {
+	if _, err := NewPasswordHasher(&PasswordConfig{Algorithm: "md5"}); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+	if _, err := NewPasswordHasher(&PasswordConfig{BcryptCost: 50}); err == nil {
+		t.Error("Expected an error for a bad bcrypt cost")
+	}
+	h, _ := NewPasswordHasher(testArgon2Config)
+	if _, err := h.Compare("$argon2id$v=19$bad", "h4ck3r"); err != errInvalidHash {
+		t.Errorf("Expected errInvalidHash, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package crypto
+
+import "errors"
+
+var errNoService = errors.New("No encryption keys were configured")
+
+// Service encrypts and decrypts the data of the stores with a keyring.
+// Every store gets its own service so stores with different keys can be
+// used at the same time.
+type Service struct {
+	keyring *Keyring
+}
+
+// NewService returns a service with a single key, the default key. Key must
+// be 16, 24 or 32 bytes long.
+func NewService(key string) (*Service, error) {
+	k := NewKeyring()
+	if err := k.Add(DefaultKeyID, []byte(key)); err != nil {
+		return nil, err
+	}
+	if err := k.SetPrimary(DefaultKeyID); err != nil {
+		return nil, err
+	}
+	return &Service{k}, nil
+}
+
+// NewKeyringService returns a service that uses the keys of the keyring,
+// it must have a primary key.
+func NewKeyringService(k *Keyring) (*Service, error) {
+	if _, ok := k.keys[k.primary]; !ok {
+		return nil, errNoPrimaryKey
+	}
+	return &Service{k}, nil
+}
+
+// Primary returns the id of the key used to encrypt.
+func (s *Service) Primary() string {
+	return s.keyring.Primary()
+}
+
+// LegacyReads returns the number of AES-CFB values decrypted, see
+// Keyring.LegacyReads.
+func (s *Service) LegacyReads() int {
+	return s.keyring.LegacyReads()
+}
+
+// Encrypt encrypts the data with the primary key, see Keyring.Encrypt.
+func (s *Service) Encrypt(data []byte, associatedData []byte) ([]byte, error) {
+	if s == nil {
+		return nil, errNoService
+	}
+	return s.keyring.Encrypt(data, associatedData)
+}
+
+// Decrypt decrypts the data with the key that encrypted it, see
+// Keyring.Decrypt.
+func (s *Service) Decrypt(data []byte, associatedData []byte) ([]byte, error) {
+	if s == nil {
+		return nil, errNoService
+	}
+	return s.keyring.Decrypt(data, associatedData)
+}
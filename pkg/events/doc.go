@@ -0,0 +1,3 @@
+// Package events provides a bus to publish events, like new results for
+// a user, to the parts of the application interested in them.
+package events
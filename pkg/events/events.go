@@ -0,0 +1,125 @@
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+)
+
+const (
+	// Number of events kept for a subscriber that is not receiving them
+	// fast enough. Events are dropped after that.
+	subscriptionBufferSize = 16
+)
+
+type (
+	// Type is the type of an event.
+	Type string
+
+	// Event is something that happened for a user.
+	Event struct {
+		Type    Type        `json:"type"`
+		UserID  string      `json:"userId"`
+		Time    time.Time   `json:"time"`
+		Classes []api.Class `json:"classes,omitempty"`
+		Error   string      `json:"error,omitempty"`
+	}
+
+	// Bus is an interface for publishing and receiving events.
+	Bus interface {
+		// Publish sends the event to every subscriber.
+		Publish(event *Event)
+		// Subscribe returns a subscription that receives every event
+		// published after the call.
+		Subscribe() *Subscription
+	}
+
+	// Subscription receives events from a bus until it is closed.
+	Subscription struct {
+		// C is the channel on which the events are delivered.
+		C <-chan *Event
+
+		ch  chan *Event
+		bus *LocalBus
+	}
+
+	// LocalBus implements a bus for subscribers in the same process.
+	LocalBus struct {
+		mut  sync.RWMutex
+		subs map[*Subscription]struct{}
+	}
+)
+
+// Event types.
+const (
+	// NewResults is published when the crawler finds new results. The
+	// event contains the classes with new results.
+	NewResults Type = "new-results"
+	// CrawlStarted is published when the crawler starts fetching results
+	// for a user.
+	CrawlStarted Type = "crawl-started"
+	// CrawlFinished is published when the crawler is done with a user. The
+	// event contains the error if the results could not be saved.
+	CrawlFinished Type = "crawl-finished"
+	// CredentialsInvalid is published when the UQAM code or nip of a user
+	// is refused.
+	CredentialsInvalid Type = "credentials-invalid"
+)
+
+// NewEvent creates an event of the specified type for a user.
+func NewEvent(eventType Type, userID string) *Event {
+	return &Event{
+		Type:   eventType,
+		UserID: userID,
+		Time:   time.Now(),
+	}
+}
+
+// NewLocalBus creates a new in process bus.
+func NewLocalBus() *LocalBus {
+	return &LocalBus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends the event to every subscriber. It never blocks, if a
+// subscriber is too slow the event is dropped for that subscriber.
+func (b *LocalBus) Publish(event *Event) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	for sub := range b.subs {
+		select {
+		case sub.ch <- event:
+		default:
+			log.Printf("Event %s dropped for a slow subscriber", event.Type)
+		}
+	}
+}
+
+// Subscribe returns a new subscription to the bus.
+func (b *LocalBus) Subscribe() *Subscription {
+	ch := make(chan *Event, subscriptionBufferSize)
+	sub := &Subscription{
+		C:   ch,
+		ch:  ch,
+		bus: b,
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.subs[sub] = struct{}{}
+
+	return sub
+}
+
+// Close stops the subscription and closes its channel.
+func (s *Subscription) Close() {
+	s.bus.mut.Lock()
+	defer s.bus.mut.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.ch)
+	}
+}
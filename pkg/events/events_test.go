@@ -0,0 +1,131 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLocalBusPublish(t *testing.T) {
+	bus := NewLocalBus()
+	sub1 := bus.Subscribe()
+	sub2 := bus.Subscribe()
+
+	bus.Publish(NewEvent(NewResults, "user1"))
+
+	for _, sub := range []*Subscription{sub1, sub2} {
+		select {
+		case event := <-sub.C:
+			if event.Type != NewResults || event.UserID != "user1" {
+				t.Errorf("Unexpected event %+v", event)
+			}
+		default:
+			t.Error("Event not received")
+		}
+	}
+
+	sub1.Close()
+	bus.Publish(NewEvent(NewResults, "user2"))
+	if _, ok := <-sub1.C; ok {
+		t.Error("Received an event after closing the subscription")
+	}
+	if event := <-sub2.C; event.UserID != "user2" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	// Closing twice does nothing.
+	sub1.Close()
+}
+
+func TestLocalBusSlowSubscriber(t *testing.T) {
+	bus := NewLocalBus()
+	sub := bus.Subscribe()
+	defer sub.Close()
+
+	// Publish must not block when the subscriber doesn't read its events.
+	for i := 0; i < subscriptionBufferSize*2; i++ {
+		bus.Publish(NewEvent(NewResults, "user"))
+	}
+
+	if len(sub.C) != subscriptionBufferSize {
+		t.Errorf("Expected %d buffered events, got %d", subscriptionBufferSize, len(sub.C))
+	}
+}
+
+func TestRemoteBus(t *testing.T) {
+	bus := NewLocalBus()
+	server := NewServer(bus, 10)
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	remote := NewRemoteBus(ts.URL, nil)
+	sub := remote.Subscribe()
+	defer sub.Close()
+	go remote.Start()
+	defer remote.Stop()
+
+	// Events published before the remote bus is connected are not
+	// received so publish until one is.
+	timeout := time.After(5 * time.Second)
+	for {
+		bus.Publish(NewEvent(CrawlStarted, "user"))
+		select {
+		case event := <-sub.C:
+			if event.Type != CrawlStarted || event.UserID != "user" {
+				t.Errorf("Unexpected event %+v", event)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Error("Event not received by the remote bus")
+			return
+		}
+	}
+}
+
+func TestServerRestarted(t *testing.T) {
+	old := NewServer(NewLocalBus(), 10)
+	old.Close()
+
+	// The new server published more events than the client received
+	// from the old one.
+	bus := NewLocalBus()
+	server := NewServer(bus, 10)
+	defer server.Close()
+	for i := 0; i < 7; i++ {
+		bus.Publish(NewEvent(CrawlStarted, "user"))
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		server.mut.Lock()
+		last := server.lastSeq
+		server.mut.Unlock()
+		if last == 7 {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("Events not recorded by the server")
+		}
+	}
+
+	for epoch, count := range map[string]int{old.epoch: 7, server.epoch: 2} {
+		url := fmt.Sprintf("/?%s=5&%s=%s", paramAfter, paramEpoch, epoch)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		res := &pollResponse{}
+		if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Events) != count {
+			t.Errorf("Bad events count %d for epoch %s, should be %d", len(res.Events), epoch, count)
+		}
+		if res.Epoch != server.epoch || res.Last != 7 {
+			t.Errorf("Bad poll response epoch %s last %d", res.Epoch, res.Last)
+		}
+	}
+}
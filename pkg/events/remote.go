@@ -0,0 +1,247 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of events kept by a server for remote buses.
+	DefaultServerLogSize = 1000
+
+	// Maximum time a poll request waits for new events.
+	maxPollWait = 30 * time.Second
+	// Time to wait before polling again after an error.
+	pollRetryDelay = 5 * time.Second
+
+	paramAfter = "after"
+	paramEpoch = "epoch"
+)
+
+type (
+	// Server serves the events published on a bus to remote buses over
+	// http. It keeps the last events in memory and remote buses long poll
+	// for the events after the last one they received. The sequence
+	// numbers restart with the process so they are only valid with the
+	// epoch of the server that sent them.
+	Server struct {
+		epoch   string
+		mut     sync.Mutex
+		events  []*pollEvent
+		size    int
+		lastSeq uint64
+		// waitCh is closed and replaced when an event is added.
+		waitCh chan struct{}
+		sub    *Subscription
+	}
+
+	// RemoteBus is a bus that receives the events of a bus in another
+	// process from its Server. Events published on a RemoteBus are only
+	// sent to its local subscribers.
+	RemoteBus struct {
+		*LocalBus
+		url     string
+		client  *http.Client
+		epoch   string
+		lastSeq uint64
+		doneCh  chan bool
+	}
+
+	pollEvent struct {
+		Seq   uint64 `json:"seq"`
+		Event *Event `json:"event"`
+	}
+
+	pollResponse struct {
+		Events []*pollEvent `json:"events"`
+		// Epoch identifies the server process, it changes when the
+		// server restarts.
+		Epoch string `json:"epoch"`
+		// Last is the sequence number of the last event published.
+		Last uint64 `json:"last"`
+	}
+)
+
+// NewServer creates a server that keeps the last size events published
+// on bus.
+func NewServer(bus Bus, size int) *Server {
+	s := &Server{
+		epoch:  newEpoch(),
+		size:   size,
+		waitCh: make(chan struct{}),
+		sub:    bus.Subscribe(),
+	}
+	go s.run()
+	return s
+}
+
+func newEpoch() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Close stops recording events.
+func (s *Server) Close() {
+	s.sub.Close()
+}
+
+func (s *Server) run() {
+	for event := range s.sub.C {
+		s.mut.Lock()
+		s.lastSeq++
+		s.events = append(s.events, &pollEvent{s.lastSeq, event})
+		if len(s.events) > s.size {
+			s.events = s.events[len(s.events)-s.size:]
+		}
+		close(s.waitCh)
+		s.waitCh = make(chan struct{})
+		s.mut.Unlock()
+	}
+}
+
+// ServeHTTP returns the events after the sequence number in the after
+// param. If there are none it waits until there is one or the poll
+// times out. Without the after param it only returns the last sequence
+// number so the client can start polling from there. An after param
+// from another epoch is for a server that restarted since, all the kept
+// events are returned.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	afterParam := r.URL.Query().Get(paramAfter)
+	if len(afterParam) == 0 {
+		s.mut.Lock()
+		res := &pollResponse{Epoch: s.epoch, Last: s.lastSeq}
+		s.mut.Unlock()
+		sendPollResponse(w, res)
+		return
+	}
+	after, err := strconv.ParseUint(afterParam, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid after param", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get(paramEpoch) != s.epoch {
+		after = 0
+	}
+
+	timeout := time.NewTimer(maxPollWait)
+	defer timeout.Stop()
+	for {
+		s.mut.Lock()
+		// The client is ahead of the server, send everything we have.
+		if after > s.lastSeq {
+			after = 0
+		}
+		res := &pollResponse{Epoch: s.epoch, Last: s.lastSeq}
+		for _, e := range s.events {
+			if e.Seq > after {
+				res.Events = append(res.Events, e)
+			}
+		}
+		waitCh := s.waitCh
+		s.mut.Unlock()
+
+		if len(res.Events) > 0 {
+			sendPollResponse(w, res)
+			return
+		}
+
+		select {
+		case <-waitCh:
+		case <-timeout.C:
+			sendPollResponse(w, res)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func sendPollResponse(w http.ResponseWriter, res *pollResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Println(err)
+	}
+}
+
+// NewRemoteBus creates a bus receiving events from the server at url.
+// The client is used for the poll requests, it must not time out before
+// a poll does.
+func NewRemoteBus(url string, client *http.Client) *RemoteBus {
+	if client == nil {
+		client = &http.Client{Timeout: 2 * maxPollWait}
+	}
+	return &RemoteBus{
+		LocalBus: NewLocalBus(),
+		url:      url,
+		client:   client,
+		doneCh:   make(chan bool),
+	}
+}
+
+// Start polls the server for events until Stop is called.
+func (b *RemoteBus) Start() {
+	synced := false
+	for {
+		select {
+		case <-b.doneCh:
+			return
+		default:
+		}
+
+		res, err := b.poll(synced)
+		if err != nil {
+			log.Printf("Error polling events from %s: %s", b.url, err)
+			select {
+			case <-time.After(pollRetryDelay):
+			case <-b.doneCh:
+				return
+			}
+			continue
+		}
+
+		for _, e := range res.Events {
+			b.LocalBus.Publish(e.Event)
+		}
+		// The cursor is only valid for the epoch of the server, it
+		// is reset when the server restarts.
+		b.epoch = res.Epoch
+		b.lastSeq = res.Last
+		synced = true
+	}
+}
+
+// Stop stops polling the server.
+func (b *RemoteBus) Stop() {
+	close(b.doneCh)
+}
+
+func (b *RemoteBus) poll(synced bool) (*pollResponse, error) {
+	url := b.url
+	if synced {
+		url = fmt.Sprintf("%s?%s=%d&%s=%s", b.url, paramAfter, b.lastSeq, paramEpoch, b.epoch)
+	}
+	resp, err := b.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	res := &pollResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,193 @@
+// Package secrets resolves the secrets of the configs so they don't have to
+// be written in plain text in the config files. A config value can be a
+// reference to a secret:
+//
+//	file:///run/secrets/aes_key  the content of a file, like the secrets
+//	                             mounted by docker and kubernetes
+//	env://RC_DB_PASSWORD         an environment variable
+//	<scheme>://<name>            a secret of a provider added with Register
+//
+// The other values are the secrets themselves.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces the secrets in the logs.
+const Redacted = "REDACTED"
+
+const schemeEnd = "://"
+
+// ErrNotFound happens when a provider doesn't have the requested secret.
+var ErrNotFound = errors.New("Secret not found")
+
+// ConfigFields are the config fields that contain secrets, as paths of
+// struct fields. Every executable resolves them with ResolveConfig, a
+// config doesn't need to have all of them.
+var ConfigFields = []string{
+	"Database.Password",
+	"SQL.Password",
+	"Email.Password",
+	"AESSecretKey",
+	"RSAPublic",
+	"RSAPrivate",
+	"APISecret",
+	"CrawlerAPISecret",
+}
+
+// passwordParam matches the password of a key=value data source name.
+var passwordParam = regexp.MustCompile(`(password=)('[^']*'|\S*)`)
+
+type (
+	// Provider returns secrets by name.
+	Provider interface {
+		Secret(name string) (string, error)
+	}
+
+	// ProviderFunc is a function used as a provider.
+	ProviderFunc func(name string) (string, error)
+
+	// Resolver resolves the secret references of the config values with
+	// its providers.
+	Resolver struct {
+		providers map[string]Provider
+	}
+)
+
+// Secret calls f.
+func (f ProviderFunc) Secret(name string) (string, error) {
+	return f(name)
+}
+
+// NewResolver returns a resolver with the file and env providers.
+func NewResolver() *Resolver {
+	r := &Resolver{providers: make(map[string]Provider)}
+	r.Register("file", ProviderFunc(fileSecret))
+	r.Register("env", ProviderFunc(envSecret))
+	return r
+}
+
+// Register adds a provider for the references starting with scheme://,
+// like a secret manager.
+func (r *Resolver) Register(scheme string, p Provider) {
+	r.providers[scheme] = p
+}
+
+// Resolve returns the secret referenced by value, or value if it is not a
+// reference.
+func (r *Resolver) Resolve(value string) (string, error) {
+	end := strings.Index(value, schemeEnd)
+	if end < 0 {
+		return value, nil
+	}
+	p, ok := r.providers[value[:end]]
+	if !ok {
+		return value, nil
+	}
+	name := value[end+len(schemeEnd):]
+	secret, err := p.Secret(name)
+	if err != nil {
+		return "", fmt.Errorf("Secret %s: %v", value, err)
+	}
+	return secret, nil
+}
+
+// ResolveAll replaces the references of the values with their secrets.
+func (r *Resolver) ResolveAll(values ...*string) error {
+	for _, value := range values {
+		secret, err := r.Resolve(*value)
+		if err != nil {
+			return err
+		}
+		*value = secret
+	}
+	return nil
+}
+
+// ResolveConfig resolves the ConfigFields of config, a pointer to a struct.
+// The fields it doesn't have and the nil structs are skipped.
+func (r *Resolver) ResolveConfig(config interface{}) error {
+	for _, path := range ConfigFields {
+		value := configField(reflect.ValueOf(config), strings.Split(path, "."))
+		if !value.IsValid() {
+			continue
+		}
+		secret, err := r.Resolve(value.String())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		value.SetString(secret)
+	}
+	return nil
+}
+
+// configField returns the string field at path in v, or the zero value if
+// there is none.
+func configField(v reflect.Value, path []string) reflect.Value {
+	for _, name := range path {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}
+		}
+		v = v.FieldByName(name)
+		if !v.IsValid() {
+			return v
+		}
+	}
+	if v.Kind() != reflect.String || !v.CanSet() {
+		return reflect.Value{}
+	}
+	return v
+}
+
+// Redact returns the text to log instead of a secret, it is empty if the
+// secret is not set.
+func Redact(secret string) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	return Redacted
+}
+
+// RedactDSN returns a data source name without its password. It can be an
+// url or key=value pairs.
+func RedactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), Redacted)
+			return u.String()
+		}
+	}
+	return passwordParam.ReplaceAllString(dsn, "${1}"+Redacted)
+}
+
+// fileSecret reads a secret file. The trailing new line added by editors
+// is removed.
+func fileSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func envSecret(name string) (string, error) {
+	secret, ok := os.LookupEnv(name)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return secret, nil
+}
@@ -0,0 +1,552 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
+)
+
+// lockTimeout is how long an operation waits for another process to release
+// the database file.
+const lockTimeout = 10 * time.Second
+
+var (
+	usersBucket          = []byte("users")
+	emailsBucket         = []byte("emails")
+	crawlerConfigsBucket = []byte("crawler_configs")
+	resultsBucket        = []byte("results")
+	// changesBucket has a bucket of results changes per user, keyed by
+	// sequence number.
+	changesBucket = []byte("results_changes")
+)
+
+type (
+	// Store implements the interfaces for storing users, crawlerconfigs and
+	// results in a bolt database file. Bolt lets a single process open the
+	// file, the store opens it for every operation so the crawler and the
+	// webserver can share it. Opening it takes about 10µs and waits up to
+	// lockTimeout while the other process has it open, so every call pays
+	// for it even without contention.
+	Store struct {
+		path   string
+		crypto *crypto.Service
+	}
+
+	boltUser struct {
+		User         *api.User `json:"user"`
+		PasswordHash string    `json:"passwordHash"`
+	}
+
+	// boltCrawlerConfig keeps the encrypted code and nip as bytes, json
+	// strings must be valid utf8.
+	boltCrawlerConfig struct {
+		Status            bool   `json:"status"`
+		Code              []byte `json:"code"`
+		Nip               []byte `json:"nip"`
+		NotificationEmail string `json:"notificationEmail"`
+		Disabled          bool   `json:"disabled"`
+		Version           int    `json:"version"`
+	}
+)
+
+// Open returns a store for the database file at path. The file is created
+// if it does not exist. The crawler credentials are encrypted with c.
+func Open(path string, c *crypto.Service) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Close(); err != nil {
+		return nil, err
+	}
+	return &Store{path, c}, nil
+}
+
+// Ping checks that the database file can be opened.
+func (s *Store) Ping() error {
+	return s.view(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// Backup writes a consistent copy of the database to w.
+func (s *Store) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// BackupFile writes a copy of the database to a file. The copy is written to
+// a temporary file first so an existing backup is only replaced by a
+// complete one.
+func (s *Store) BackupFile(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = s.Backup(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// GetCrawlerConfig returns the crawler config for the specified user.
+func (s *Store) GetCrawlerConfig(userID string) (*api.CrawlerConfig, error) {
+	config := boltCrawlerConfig{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(crawlerConfigsBucket), userID, &config)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	crawlerConfig := &api.CrawlerConfig{
+		UserID:            userID,
+		Status:            config.Status,
+		Code:              string(config.Code),
+		Nip:               string(config.Nip),
+		NotificationEmail: config.NotificationEmail,
+		Disabled:          config.Disabled,
+		Version:           config.Version,
+	}
+	err = store.DecryptCrawlerConfig(s.crypto, crawlerConfig)
+	if err != nil {
+		return nil, err
+	}
+	return crawlerConfig, nil
+}
+
+// UpdateCrawlerConfig updates the crawler config with the specified config
+// if its version matches the stored one.
+func (s *Store) UpdateCrawlerConfig(crawlerConfig *api.CrawlerConfig) error {
+	encrypted := *crawlerConfig
+	err := store.EncryptCrawlerConfig(s.crypto, &encrypted)
+	if err != nil {
+		return err
+	}
+
+	err = s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(crawlerConfigsBucket)
+		current := boltCrawlerConfig{}
+		if err := getJSON(b, crawlerConfig.UserID, &current); err != nil {
+			return err
+		}
+		if current.Version != crawlerConfig.Version {
+			return store.ErrConflict
+		}
+		return putJSON(b, crawlerConfig.UserID, &boltCrawlerConfig{
+			Status:            encrypted.Status,
+			Code:              []byte(encrypted.Code),
+			Nip:               []byte(encrypted.Nip),
+			NotificationEmail: encrypted.NotificationEmail,
+			Disabled:          encrypted.Disabled,
+			Version:           crawlerConfig.Version + 1,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	crawlerConfig.Version++
+	return nil
+}
+
+// GetResults returns results for a user.
+func (s *Store) GetResults(userID string) (*api.Results, error) {
+	userResults := &api.Results{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(resultsBucket), userID, userResults)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if userResults.Classes == nil {
+		userResults.Classes = []api.Class{}
+	}
+	return userResults, nil
+}
+
+// AddClass adds a class to the user results.
+func (s *Store) AddClass(userID string, class *api.Class) error {
+	class.ID = store.NewID()
+	return s.modifyResults(userID, func(userResults *api.Results) (bool, error) {
+		userResults.Classes = append(userResults.Classes, *class)
+		return true, nil
+	})
+}
+
+// UpdateClass updates the name, group and year of a class. If any of them
+// changed the class results are cleared in the same update.
+func (s *Store) UpdateClass(userID string, class *api.Class) (*api.Class, error) {
+	var updated api.Class
+	err := s.modifyResults(userID, func(userResults *api.Results) (bool, error) {
+		current := findClass(userResults, class.ID)
+		if current == nil {
+			return false, results.ErrClassNotFound
+		}
+		if current.Name == class.Name && current.Group == class.Group && current.Year == class.Year {
+			updated = *current
+			return false, nil
+		}
+		*current = api.Class{
+			ID:    class.ID,
+			Name:  class.Name,
+			Group: class.Group,
+			Year:  class.Year,
+		}
+		updated = *current
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// RemoveClass removes a class from the user results.
+func (s *Store) RemoveClass(userID string, classID string) error {
+	return s.modifyResults(userID, func(userResults *api.Results) (bool, error) {
+		for i, c := range userResults.Classes {
+			if c.ID == classID {
+				userResults.Classes = append(userResults.Classes[:i], userResults.Classes[i+1:]...)
+				return true, nil
+			}
+		}
+		return false, results.ErrClassNotFound
+	})
+}
+
+// UpdateClassResults updates the results, total and final grade of a class.
+func (s *Store) UpdateClassResults(userID string, class *api.Class) error {
+	return s.modifyResults(userID, func(userResults *api.Results) (bool, error) {
+		current := findClass(userResults, class.ID)
+		if current == nil || current.Name != class.Name || current.Group != class.Group || current.Year != class.Year {
+			return false, results.ErrClassNotFound
+		}
+		current.Results = class.Results
+		current.Total = class.Total
+		current.Final = class.Final
+		return true, nil
+	})
+}
+
+// SetLastUpdate sets the time the results were last crawled.
+func (s *Store) SetLastUpdate(userID string, lastUpdate time.Time) error {
+	return s.modifyResults(userID, func(userResults *api.Results) (bool, error) {
+		userResults.LastUpdate = lastUpdate
+		return true, nil
+	})
+}
+
+// AddChanges adds changes to the history of the user results.
+func (s *Store) AddChanges(userID string, changes []api.ResultsChange) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if err := getJSON(tx.Bucket(resultsBucket), userID, &api.Results{}); err != nil {
+			return err
+		}
+		b, err := tx.Bucket(changesBucket).CreateBucketIfNotExists([]byte(userID))
+		if err != nil {
+			return err
+		}
+		for i := range changes {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(&changes[i])
+			if err != nil {
+				return err
+			}
+			if err = b.Put(sequenceKey(seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetChanges returns the history of the user results, oldest first.
+func (s *Store) GetChanges(userID string) ([]api.ResultsChange, error) {
+	changes := []api.ResultsChange{}
+	err := s.view(func(tx *bolt.Tx) error {
+		if err := getJSON(tx.Bucket(resultsBucket), userID, &api.Results{}); err != nil {
+			return err
+		}
+		b := tx.Bucket(changesBucket).Bucket([]byte(userID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			change := api.ResultsChange{}
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// GetUser returns a user with the specified id.
+func (s *Store) GetUser(id string) (*api.User, error) {
+	u := boltUser{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(usersBucket), id, &u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u.User, nil
+}
+
+// GetUserForLogin return a user by email with a password hash.
+func (s *Store) GetUserForLogin(email string) (*api.User, string, error) {
+	var u *boltUser
+	err := s.view(func(tx *bolt.Tx) error {
+		id := tx.Bucket(emailsBucket).Get([]byte(email))
+		if id == nil {
+			return store.ErrNotFound
+		}
+		u = &boltUser{}
+		return getJSON(tx.Bucket(usersBucket), string(id), u)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return u.User, u.PasswordHash, nil
+}
+
+// ListUsers returns a page of the users matching the query.
+func (s *Store) ListUsers(query *user.Query) (*user.Page, error) {
+	if len(query.After) > 0 && !store.ValidID(query.After) {
+		return nil, user.ErrInvalidCursor
+	}
+
+	// Get one more user to know if there is a next page.
+	limit := query.GetLimit()
+	page := &user.Page{Users: []*api.User{}}
+	err := s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(usersBucket).Cursor()
+		k, v := c.First()
+		if len(query.After) > 0 {
+			k, v = c.Seek([]byte(query.After))
+			if k != nil && string(k) == query.After {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && len(page.Users) <= limit; k, v = c.Next() {
+			u := boltUser{}
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			ok, err := matchUser(tx, query, u.User)
+			if err != nil {
+				return err
+			}
+			if ok {
+				page.Users = append(page.Users, u.User)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Users) > limit {
+		page.Users = page.Users[:limit]
+		page.Next = page.Users[limit-1].ID
+	}
+	return page, nil
+}
+
+// UpdateUser updates a user.
+func (s *Store) UpdateUser(u *api.User) error {
+	return s.update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		current := boltUser{}
+		if err := getJSON(users, u.ID, &current); err != nil {
+			return err
+		}
+		if current.User.Email != u.Email {
+			emails := tx.Bucket(emailsBucket)
+			if emails.Get([]byte(u.Email)) != nil {
+				return store.ErrDuplicate
+			}
+			if err := emails.Delete([]byte(current.User.Email)); err != nil {
+				return err
+			}
+			if err := emails.Put([]byte(u.Email), []byte(u.ID)); err != nil {
+				return err
+			}
+		}
+		current.User = u
+		return putJSON(users, u.ID, &current)
+	})
+}
+
+// UpdatePassword replaces the password hash of a user.
+func (s *Store) UpdatePassword(id string, passwordHash string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		current := boltUser{}
+		if err := getJSON(users, id, &current); err != nil {
+			return err
+		}
+		current.PasswordHash = passwordHash
+		return putJSON(users, id, &current)
+	})
+}
+
+// CreateUser adds a new user with an empty crawler config and results.
+func (s *Store) CreateUser(u *api.User, password string) error {
+	id := store.NewID()
+	created := *u
+	created.ID = id
+	err := s.update(func(tx *bolt.Tx) error {
+		emails := tx.Bucket(emailsBucket)
+		if emails.Get([]byte(u.Email)) != nil {
+			return store.ErrDuplicate
+		}
+		if err := emails.Put([]byte(u.Email), []byte(id)); err != nil {
+			return err
+		}
+		err := putJSON(tx.Bucket(usersBucket), id, &boltUser{&created, password})
+		if err != nil {
+			return err
+		}
+		err = putJSON(tx.Bucket(crawlerConfigsBucket), id, &boltCrawlerConfig{NotificationEmail: u.Email})
+		if err != nil {
+			return err
+		}
+		return putJSON(tx.Bucket(resultsBucket), id, &api.Results{UserID: id})
+	})
+	if err != nil {
+		return err
+	}
+	u.ID = id
+	return nil
+}
+
+// modifyResults applies a change to the results of a user in a transaction.
+// The version is incremented if fn returns true.
+func (s *Store) modifyResults(userID string, fn func(userResults *api.Results) (bool, error)) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(resultsBucket)
+		userResults := api.Results{}
+		if err := getJSON(b, userID, &userResults); err != nil {
+			return err
+		}
+		changed, err := fn(&userResults)
+		if err != nil || !changed {
+			return err
+		}
+		userResults.Version++
+		return putJSON(b, userID, &userResults)
+	})
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: lockTimeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// matchUser returns true if the user matches the filters of the query.
+func matchUser(tx *bolt.Tx, query *user.Query, u *api.User) (bool, error) {
+	if !user.MatchSearch(u, query.Search) {
+		return false, nil
+	}
+	if query.CrawlerEnabled {
+		config := boltCrawlerConfig{}
+		if err := getJSON(tx.Bucket(crawlerConfigsBucket), u.ID, &config); err != nil {
+			return false, err
+		}
+		if !config.Status || config.Disabled {
+			return false, nil
+		}
+	}
+	if !query.DueBefore.IsZero() {
+		userResults := api.Results{}
+		if err := getJSON(tx.Bucket(resultsBucket), u.ID, &userResults); err != nil {
+			return false, err
+		}
+		if !userResults.LastUpdate.Before(query.DueBefore) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func findClass(userResults *api.Results, classID string) *api.Class {
+	for i := range userResults.Classes {
+		if userResults.Classes[i].ID == classID {
+			return &userResults.Classes[i]
+		}
+	}
+	return nil
+}
+
+// getJSON decodes the value of a user id in a bucket.
+// sequenceKey encodes a sequence number so the keys are sorted by it.
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func getJSON(b *bolt.Bucket, key string, v interface{}) error {
+	if !store.ValidID(key) {
+		return store.ErrInvalidID
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return store.ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+func putJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
@@ -0,0 +1,208 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	"github.com/janicduplessis/resultscrawler/pkg/store/storetest"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
+)
+
+func openTestStore(t *testing.T) (*Store, string) {
+	return openCryptoStore(t, storetest.NewCrypto(t))
+}
+
+func openCryptoStore(t *testing.T, c *crypto.Service) (*Store, string) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(filepath.Join(dir, "test.db"), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureIndexes(); err != store.ErrMigrationsPending {
+		t.Errorf("Expected ErrMigrationsPending, got %v", err)
+	}
+	if _, err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestStore(t *testing.T) {
+	s, dir := openTestStore(t)
+	defer os.RemoveAll(dir)
+
+	u := &api.User{Email: "test@test.com", FirstName: "Test"}
+	if err := s.CreateUser(u, "hash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateUser(&api.User{Email: "test@test.com"}, "hash"); err != store.ErrDuplicate {
+		t.Errorf("Expected ErrDuplicate, got %v", err)
+	}
+	other := &api.User{Email: "other@test.com"}
+	if err := s.CreateUser(other, "hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	loginUser, hash, err := s.GetUserForLogin("test@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loginUser.ID != u.ID || hash != "hash" {
+		t.Errorf("Unexpected user %+v with hash %s", loginUser, hash)
+	}
+
+	// Changing the email updates the login.
+	u.Email = "new@test.com"
+	if err = s.UpdateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if loginUser, _, _ = s.GetUserForLogin("test@test.com"); loginUser != nil {
+		t.Error("The old email should not be used to login")
+	}
+	if loginUser, _, _ = s.GetUserForLogin("new@test.com"); loginUser == nil || loginUser.ID != u.ID {
+		t.Errorf("Unexpected user %+v for the new email", loginUser)
+	}
+
+	crawlerConfig, err := s.GetCrawlerConfig(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crawlerConfig.Status = true
+	crawlerConfig.Code = "code"
+	crawlerConfig.Nip = "nip"
+	if err = s.UpdateCrawlerConfig(crawlerConfig); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetCrawlerConfig(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *crawlerConfig {
+		t.Errorf("Got %+v, should be %+v", got, crawlerConfig)
+	}
+	crawlerConfig.Version = 0
+	if err = s.UpdateCrawlerConfig(crawlerConfig); err != store.ErrConflict {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	page, err := s.ListUsers(&user.Query{CrawlerEnabled: true, DueBefore: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Users) != 1 || page.Users[0].ID != u.ID {
+		t.Errorf("Unexpected due users %+v", page.Users)
+	}
+	page, err = s.ListUsers(&user.Query{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = s.ListUsers(&user.Query{Limit: 1, After: page.Next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Users) != 1 || page.Users[0].ID != other.ID || len(page.Next) != 0 {
+		t.Errorf("Unexpected last page %+v", page)
+	}
+}
+
+func TestResults(t *testing.T) {
+	s, dir := openTestStore(t)
+	defer os.RemoveAll(dir)
+
+	u := &api.User{Email: "test@test.com"}
+	if err := s.CreateUser(u, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	class := &api.Class{Name: "INF1120", Group: "10", Year: "20151"}
+	if err := s.AddClass(u.ID, class); err != nil {
+		t.Fatal(err)
+	}
+	class.Final = "A"
+	if err := s.UpdateClassResults(u.ID, class); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := s.UpdateClass(u.ID, &api.Class{ID: class.ID, Name: class.Name, Group: "20", Year: class.Year})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Final != "" || updated.Group != "20" {
+		t.Errorf("Results should be cleared when the class changes, got %+v", updated)
+	}
+	if err = s.RemoveClass(u.ID, class.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.UpdateClassResults(u.ID, class); err != results.ErrClassNotFound {
+		t.Errorf("Expected ErrClassNotFound, got %v", err)
+	}
+
+	userResults, err := s.GetResults(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userResults.Classes) != 0 || userResults.Version != 4 {
+		t.Errorf("Unexpected results %+v", userResults)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	s, dir := openTestStore(t)
+	defer os.RemoveAll(dir)
+
+	u := &api.User{Email: "test@test.com"}
+	if err := s.CreateUser(u, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	backupPath := filepath.Join(dir, "backup.db")
+	if err := s.BackupFile(backupPath); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := Open(backupPath, s.crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := backup.GetUser(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != u.Email {
+		t.Errorf("Email is %s, should be %s", got.Email, u.Email)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	var dirs []string
+	defer func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	storetest.Run(t, func(t *testing.T, c *crypto.Service) storetest.Store {
+		s, dir := openCryptoStore(t, c)
+		dirs = append(dirs, dir)
+		return s
+	}, func(s storetest.Store, userID string) ([]byte, []byte, error) {
+		config := boltCrawlerConfig{}
+		err := s.(*Store).view(func(tx *bolt.Tx) error {
+			return getJSON(tx.Bucket(crawlerConfigsBucket), userID, &config)
+		})
+		return config.Code, config.Nip, err
+	})
+}
@@ -0,0 +1,4 @@
+// Package bolt implements the interfaces for storing users, results and
+// crawler config in a bolt database file. It needs no database server, which
+// suits small single node deployments.
+package bolt
@@ -0,0 +1,144 @@
+package bolt
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+)
+
+var migrationsBucket = []byte("migrations")
+
+// migration changes the database from the previous version to its version.
+// A migration runs in a single transaction.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *bolt.Tx) error
+}
+
+// migrations are applied in order. Never change or remove a migration that
+// was released, add a new one instead.
+var migrations = []migration{
+	{1, "Create buckets", migrateCreateBuckets},
+	{2, "Create the results changes bucket", migrateCreateChangesBucket},
+}
+
+// EnsureIndexes fails with store.ErrMigrationsPending if the database is
+// not up to date. Bolt has no indexes, the email index bucket is created by
+// the migrations.
+func (s *Store) EnsureIndexes() error {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return store.ErrMigrationsPending
+	}
+	return nil
+}
+
+// Migrations returns every migration with the time it was applied. The
+// time is zero for pending migrations.
+func (s *Store) Migrations() ([]*store.MigrationStatus, error) {
+	res := make([]*store.MigrationStatus, len(migrations))
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(migrationsBucket)
+		for i, m := range migrations {
+			res[i] = &store.MigrationStatus{Version: m.Version, Name: m.Name}
+			if b == nil {
+				continue
+			}
+			if data := b.Get(versionKey(m.Version)); data != nil {
+				if err := json.Unmarshal(data, res[i]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// PendingMigrations returns the migrations that were not applied.
+func (s *Store) PendingMigrations() ([]*store.MigrationStatus, error) {
+	all, err := s.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var pending []*store.MigrationStatus
+	for _, m := range all {
+		if m.Applied.IsZero() {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order and returns the ones
+// that were applied. It stops at the first migration that fails.
+func (s *Store) Migrate() ([]*store.MigrationStatus, error) {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []*store.MigrationStatus
+	for _, status := range pending {
+		m := getMigration(status.Version)
+		status.Applied = time.Now()
+		err = s.update(func(tx *bolt.Tx) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			b, err := tx.CreateBucketIfNotExists(migrationsBucket)
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(status)
+			if err != nil {
+				return err
+			}
+			return b.Put(versionKey(status.Version), data)
+		})
+		if err != nil {
+			return applied, fmt.Errorf("Migration %d failed: %s", m.Version, err)
+		}
+		applied = append(applied, status)
+	}
+	return applied, nil
+}
+
+func getMigration(version int) *migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
+
+// versionKey encodes a migration version so the keys are sorted by version.
+func versionKey(version int) []byte {
+	return sequenceKey(uint64(version))
+}
+
+func migrateCreateBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{usersBucket, emailsBucket, crawlerConfigsBucket, resultsBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateCreateChangesBucket(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(changesBucket)
+	return err
+}
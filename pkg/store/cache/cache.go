@@ -0,0 +1,260 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/events"
+	"github.com/janicduplessis/resultscrawler/pkg/store/crawlerconfig"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
+)
+
+type (
+	// Backend is the store whose reads are cached.
+	Backend interface {
+		user.Store
+		crawlerconfig.Store
+		results.Store
+	}
+
+	// Stats are the hits and misses of the cache since it was created and
+	// the number of cached values.
+	Stats struct {
+		Hits    uint64 `json:"hits"`
+		Misses  uint64 `json:"misses"`
+		Entries int    `json:"entries"`
+	}
+
+	// Store caches the results read from the backend for ttl. Writes made
+	// through the Store invalidate the cached results of the user, writes
+	// made by another process are seen once InvalidateResults is called
+	// or the cached results expire. The users and crawler configs are not
+	// cached, the admin changes made by another process must be seen right
+	// away.
+	Store struct {
+		backend Backend
+		ttl     time.Duration
+
+		hits   uint64
+		misses uint64
+
+		mut     sync.Mutex
+		results map[string]entry
+		// gen is incremented by every invalidation. A value read from the
+		// backend is only cached if no invalidation happened during the
+		// read, otherwise it could be older than a concurrent write.
+		gen       uint64
+		lastSweep time.Time
+	}
+
+	entry struct {
+		value   *api.Results
+		expires time.Time
+	}
+)
+
+// New returns a store that caches the reads of backend for ttl.
+func New(backend Backend, ttl time.Duration) *Store {
+	return &Store{
+		backend:   backend,
+		ttl:       ttl,
+		results:   make(map[string]entry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Stats returns the hits and misses of the cache.
+func (s *Store) Stats() Stats {
+	s.mut.Lock()
+	entries := len(s.results)
+	s.mut.Unlock()
+	return Stats{
+		Hits:    atomic.LoadUint64(&s.hits),
+		Misses:  atomic.LoadUint64(&s.misses),
+		Entries: entries,
+	}
+}
+
+// InvalidateResults removes the cached results of a user, after they were
+// changed by another process.
+func (s *Store) InvalidateResults(userID string) {
+	s.invalidate(userID)
+}
+
+// InvalidateOnEvents invalidates the cached results of the users for which
+// the crawler publishes NewResults or CrawlFinished on bus, until the
+// returned subscription is closed.
+func (s *Store) InvalidateOnEvents(bus events.Bus) *events.Subscription {
+	sub := bus.Subscribe()
+	go func() {
+		for event := range sub.C {
+			if event.Type == events.NewResults || event.Type == events.CrawlFinished {
+				s.InvalidateResults(event.UserID)
+			}
+		}
+	}()
+	return sub
+}
+
+// GetUser is not cached.
+func (s *Store) GetUser(id string) (*api.User, error) {
+	return s.backend.GetUser(id)
+}
+
+// GetUserForLogin is not cached, logins must see password changes.
+func (s *Store) GetUserForLogin(email string) (*api.User, string, error) {
+	return s.backend.GetUserForLogin(email)
+}
+
+// ListUsers is not cached.
+func (s *Store) ListUsers(query *user.Query) (*user.Page, error) {
+	return s.backend.ListUsers(query)
+}
+
+// UpdateUser updates a user.
+func (s *Store) UpdateUser(u *api.User) error {
+	return s.backend.UpdateUser(u)
+}
+
+// UpdatePassword updates the password hash of a user.
+func (s *Store) UpdatePassword(id string, passwordHash string) error {
+	return s.backend.UpdatePassword(id, passwordHash)
+}
+
+// CreateUser adds a new user.
+func (s *Store) CreateUser(u *api.User, password string) error {
+	return s.backend.CreateUser(u, password)
+}
+
+// GetCrawlerConfig is not cached.
+func (s *Store) GetCrawlerConfig(userID string) (*api.CrawlerConfig, error) {
+	return s.backend.GetCrawlerConfig(userID)
+}
+
+// UpdateCrawlerConfig updates the crawler config.
+func (s *Store) UpdateCrawlerConfig(crawlerConfig *api.CrawlerConfig) error {
+	return s.backend.UpdateCrawlerConfig(crawlerConfig)
+}
+
+// GetResults returns results for a user.
+func (s *Store) GetResults(userID string) (*api.Results, error) {
+	if v, ok := s.get(userID); ok {
+		return copyResults(v), nil
+	}
+	gen := s.generation()
+	userResults, err := s.backend.GetResults(userID)
+	if err != nil {
+		return nil, err
+	}
+	s.set(userID, copyResults(userResults), gen)
+	return userResults, nil
+}
+
+// AddClass adds a class to the user results.
+func (s *Store) AddClass(userID string, class *api.Class) error {
+	defer s.invalidate(userID)
+	return s.backend.AddClass(userID, class)
+}
+
+// UpdateClass updates the name, group and year of a class.
+func (s *Store) UpdateClass(userID string, class *api.Class) (*api.Class, error) {
+	defer s.invalidate(userID)
+	return s.backend.UpdateClass(userID, class)
+}
+
+// RemoveClass removes a class from the user results.
+func (s *Store) RemoveClass(userID string, classID string) error {
+	defer s.invalidate(userID)
+	return s.backend.RemoveClass(userID, classID)
+}
+
+// UpdateClassResults updates the results, total and final grade of a class.
+func (s *Store) UpdateClassResults(userID string, class *api.Class) error {
+	defer s.invalidate(userID)
+	return s.backend.UpdateClassResults(userID, class)
+}
+
+// SetLastUpdate sets the time the results were last crawled.
+func (s *Store) SetLastUpdate(userID string, lastUpdate time.Time) error {
+	defer s.invalidate(userID)
+	return s.backend.SetLastUpdate(userID, lastUpdate)
+}
+
+// AddChanges adds changes to the history of the user results.
+func (s *Store) AddChanges(userID string, changes []api.ResultsChange) error {
+	return s.backend.AddChanges(userID, changes)
+}
+
+// GetChanges is not cached.
+func (s *Store) GetChanges(userID string) ([]api.ResultsChange, error) {
+	return s.backend.GetChanges(userID)
+}
+
+func (s *Store) get(key string) (*api.Results, bool) {
+	s.mut.Lock()
+	e, ok := s.results[key]
+	if ok && time.Now().After(e.expires) {
+		delete(s.results, key)
+		ok = false
+	}
+	s.mut.Unlock()
+
+	if ok {
+		atomic.AddUint64(&s.hits, 1)
+		return e.value, true
+	}
+	atomic.AddUint64(&s.misses, 1)
+	return nil, false
+}
+
+// set caches results read from the backend if no results were invalidated
+// since gen.
+func (s *Store) set(key string, value *api.Results, gen uint64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.gen != gen {
+		return
+	}
+	now := time.Now()
+	s.results[key] = entry{value, now.Add(s.ttl)}
+	if now.Sub(s.lastSweep) > s.ttl {
+		s.sweep(now)
+	}
+}
+
+func (s *Store) invalidate(key string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.gen++
+	delete(s.results, key)
+}
+
+func (s *Store) generation() uint64 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.gen
+}
+
+// sweep removes the expired values so the values of users that are not
+// read anymore don't stay in memory.
+func (s *Store) sweep(now time.Time) {
+	for key, e := range s.results {
+		if now.After(e.expires) {
+			delete(s.results, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+func copyResults(r *api.Results) *api.Results {
+	resultsCopy := *r
+	resultsCopy.Classes = make([]api.Class, len(r.Classes))
+	for i, class := range r.Classes {
+		class.Results = append([]api.Result(nil), class.Results...)
+		resultsCopy.Classes[i] = class
+	}
+	return &resultsCopy
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/events"
+	"github.com/janicduplessis/resultscrawler/pkg/store/fakestore"
+	"github.com/janicduplessis/resultscrawler/pkg/store/storetest"
+)
+
+func newTestStore(ttl time.Duration) (*Store, *fakestore.FakeStore) {
+	backend := fakestore.New(nil)
+	return New(backend, ttl), backend
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, c *crypto.Service) storetest.Store {
+		return New(fakestore.New(c), time.Minute)
+	}, func(s storetest.Store, userID string) ([]byte, []byte, error) {
+		config := s.(*Store).backend.(*fakestore.FakeStore).Data[userID].CrawlerConfig
+		return []byte(config.Code), []byte(config.Nip), nil
+	})
+}
+
+func TestCache(t *testing.T) {
+	s, backend := newTestStore(time.Minute)
+
+	u := &api.User{Email: "test@test.com", FirstName: "Test"}
+	if err := s.CreateUser(u, "hash"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.GetUser(u.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetResults(u.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := s.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// The users and crawler configs are not cached, the changes made by
+	// another process are seen right away.
+	backendUser, _ := backend.GetUser(u.ID)
+	backendUser.Roles = []string{api.RoleAdmin}
+	backend.UpdateUser(backendUser)
+	backendUser.Roles = nil
+	backend.UpdateUser(backendUser)
+	got, _ := s.GetUser(u.ID)
+	if got.HasRole(api.RoleAdmin) {
+		t.Error("Cached user still has the revoked admin role")
+	}
+	backendConfig, _ := backend.GetCrawlerConfig(u.ID)
+	backendConfig.Disabled = true
+	backend.UpdateCrawlerConfig(backendConfig)
+	config, _ := s.GetCrawlerConfig(u.ID)
+	if !config.Disabled {
+		t.Error("Cached crawler config is not disabled")
+	}
+
+	// Results written directly to the backend are not seen until they
+	// expire or are invalidated.
+	backend.AddClass(u.ID, &api.Class{Name: "INF1120"})
+	res, _ := s.GetResults(u.ID)
+	if len(res.Classes) != 0 {
+		t.Errorf("Bad class count %d, should be the cached 0", len(res.Classes))
+	}
+	s.InvalidateResults(u.ID)
+	res, _ = s.GetResults(u.ID)
+	if len(res.Classes) != 1 {
+		t.Errorf("Bad class count %d, should be 1", len(res.Classes))
+	}
+
+	// Writes made through the cache invalidate the cached results.
+	class := &api.Class{Name: "MAT1600"}
+	if err := s.AddClass(u.ID, class); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = s.GetResults(u.ID)
+	if len(res.Classes) != 2 {
+		t.Errorf("Bad class count %d, should be 2", len(res.Classes))
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	s, backend := newTestStore(10 * time.Millisecond)
+
+	u := &api.User{Email: "test@test.com"}
+	s.CreateUser(u, "hash")
+	if _, err := s.GetResults(u.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.AddClass(u.ID, &api.Class{Name: "MAT1600"})
+	time.Sleep(20 * time.Millisecond)
+
+	got, err := s.GetResults(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Classes) != 1 {
+		t.Errorf("Expired results not reloaded %+v", got)
+	}
+	if stats := s.Stats(); stats.Hits != 0 || stats.Misses != 2 || stats.Entries != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestInvalidateOnEvents(t *testing.T) {
+	s, backend := newTestStore(time.Minute)
+	bus := events.NewLocalBus()
+	sub := s.InvalidateOnEvents(bus)
+	defer sub.Close()
+
+	u := &api.User{Email: "test@test.com"}
+	s.CreateUser(u, "hash")
+	s.GetResults(u.ID)
+
+	// The crawler saves the results directly in the database then
+	// publishes the event.
+	backend.AddClass(u.ID, &api.Class{Name: "MAT1600"})
+	bus.Publish(events.NewEvent(events.NewResults, u.ID))
+
+	timeout := time.After(5 * time.Second)
+	for {
+		res, err := s.GetResults(u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Classes) == 1 {
+			return
+		}
+		select {
+		case <-time.After(time.Millisecond):
+		case <-timeout:
+			t.Fatal("Results not invalidated by the new results event")
+		}
+	}
+}
@@ -0,0 +1,3 @@
+// Package cache implements a store that caches the reads of another store
+// to avoid loading the same results from the database on every request.
+package cache
@@ -5,5 +5,8 @@ import "github.com/janicduplessis/resultscrawler/pkg/api"
 // Store is an interface for storing the crawler configuration.
 type Store interface {
 	GetCrawlerConfig(userID string) (*api.CrawlerConfig, error)
+	// UpdateCrawlerConfig replaces the config if its version matches the
+	// stored version, otherwise it returns store.ErrConflict. The version
+	// is incremented on success.
 	UpdateCrawlerConfig(crawlerConfig *api.CrawlerConfig) error
 }
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+)
+
+// EncryptCrawlerConfig encrypts the code and nip of the config with c
+// before it is saved. They are bound to the user id of the config so they
+// can't be copied to the config of another user.
+func EncryptCrawlerConfig(c *crypto.Service, crawlerConfig *api.CrawlerConfig) error {
+	userID := []byte(crawlerConfig.UserID)
+	userCode, err := c.Encrypt([]byte(crawlerConfig.Code), userID)
+	if err != nil {
+		return err
+	}
+	crawlerConfig.Code = string(userCode)
+	userNip, err := c.Encrypt([]byte(crawlerConfig.Nip), userID)
+	if err != nil {
+		return err
+	}
+	crawlerConfig.Nip = string(userNip)
+	return nil
+}
+
+// DecryptCrawlerConfig decrypts the code and nip of a saved config with c,
+// its user id must be set.
+func DecryptCrawlerConfig(c *crypto.Service, crawlerConfig *api.CrawlerConfig) error {
+	userID := []byte(crawlerConfig.UserID)
+	userCode, err := c.Decrypt([]byte(crawlerConfig.Code), userID)
+	if err != nil {
+		return err
+	}
+	crawlerConfig.Code = string(userCode)
+	userNip, err := c.Decrypt([]byte(crawlerConfig.Nip), userID)
+	if err != nil {
+		return err
+	}
+	crawlerConfig.Nip = string(userNip)
+	return nil
+}
@@ -0,0 +1,3 @@
+// Package store contains what is shared by the store interfaces and
+// their implementations.
+package store
@@ -0,0 +1,22 @@
+package store
+
+import "errors"
+
+// ErrConflict happens when a versioned update is based on an outdated
+// version of the document.
+var ErrConflict = errors.New("Document was modified by another request")
+
+// ErrMigrationsPending happens when the store is used before running the
+// migrations of the current version.
+var ErrMigrationsPending = errors.New("The database has pending migrations, run rcadmin migrate")
+
+// ErrNotFound happens when the user, or the crawler config or results of
+// the user, does not exist.
+var ErrNotFound = errors.New("Not found")
+
+// ErrDuplicate happens when a user is created or updated with the email of
+// another user.
+var ErrDuplicate = errors.New("Email is already used")
+
+// ErrInvalidID happens when an id is not in the format used by the store.
+var ErrInvalidID = errors.New("Invalid id")
@@ -1,11 +1,15 @@
 package fakestore
 
 import (
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/janicduplessis/resultscrawler/pkg/api"
 	"github.com/janicduplessis/resultscrawler/pkg/crypto"
-	"labix.org/v2/mgo/bson"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
 )
 
 type TestUser struct {
@@ -13,83 +17,301 @@ type TestUser struct {
 	CrawlerConfig *api.CrawlerConfig
 	Results       *api.Results
 	Password      string
+	Changes       []api.ResultsChange
 }
 
+// FakeStore keeps the data in memory. Like a real store it returns copies
+// so changes must be saved with the update methods. The crawler credentials
+// are kept encrypted when Crypto is set.
 type FakeStore struct {
-	Data map[string]*TestUser
-	mut  sync.RWMutex
+	Data   map[string]*TestUser
+	Crypto *crypto.Service
+	mut    sync.RWMutex
+}
+
+// New returns an empty store that encrypts the crawler credentials with c.
+func New(c *crypto.Service) *FakeStore {
+	return &FakeStore{
+		Data:   make(map[string]*TestUser),
+		Crypto: c,
+	}
 }
 
 func (s *FakeStore) GetCrawlerConfig(userID string) (*api.CrawlerConfig, error) {
 	s.mut.RLock()
 	defer s.mut.RUnlock()
-	return s.Data[userID].CrawlerConfig, nil
+	u, err := s.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	crawlerConfig := *u.CrawlerConfig
+	if s.Crypto != nil {
+		if err = store.DecryptCrawlerConfig(s.Crypto, &crawlerConfig); err != nil {
+			return nil, err
+		}
+	}
+	return &crawlerConfig, nil
 }
 
 func (s *FakeStore) UpdateCrawlerConfig(crawlerConfig *api.CrawlerConfig) error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
-	s.Data[crawlerConfig.UserID].CrawlerConfig = crawlerConfig
+	u, err := s.getUser(crawlerConfig.UserID)
+	if err != nil {
+		return err
+	}
+	if u.CrawlerConfig.Version != crawlerConfig.Version {
+		return store.ErrConflict
+	}
+	updated := *crawlerConfig
+	updated.Version++
+	if s.Crypto != nil {
+		if err = store.EncryptCrawlerConfig(s.Crypto, &updated); err != nil {
+			return err
+		}
+	}
+	crawlerConfig.Version++
+	u.CrawlerConfig = &updated
 	return nil
 }
 
 func (s *FakeStore) GetResults(userID string) (*api.Results, error) {
 	s.mut.RLock()
 	defer s.mut.RUnlock()
-	return s.Data[userID].Results, nil
+	u, err := s.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return copyResults(u.Results), nil
+}
+
+// SetResults replaces the results of a user, classes included. It is not
+// part of the results store, the tests use it to add results.
+func (s *FakeStore) SetResults(userResults *api.Results) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	u, err := s.getUser(userResults.UserID)
+	if err != nil {
+		return err
+	}
+	userResults.Version = u.Results.Version + 1
+	u.Results = copyResults(userResults)
+	return nil
+}
+
+func (s *FakeStore) AddClass(userID string, class *api.Class) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	u, err := s.getUser(userID)
+	if err != nil {
+		return err
+	}
+	class.ID = store.NewID()
+	added := *class
+	added.Results = append([]api.Result(nil), class.Results...)
+	u.Results.Classes = append(u.Results.Classes, added)
+	u.Results.Version++
+	return nil
 }
 
-func (s *FakeStore) UpdateResults(userResults *api.Results) error {
+func (s *FakeStore) UpdateClass(userID string, class *api.Class) (*api.Class, error) {
 	s.mut.Lock()
 	defer s.mut.Unlock()
-	s.Data[userResults.UserID].Results = userResults
+	u, cur, err := s.findClass(userID, class.ID)
+	if err != nil {
+		return nil, err
+	}
+	if cur.Name != class.Name || cur.Group != class.Group || cur.Year != class.Year {
+		*cur = api.Class{
+			ID:    class.ID,
+			Name:  class.Name,
+			Group: class.Group,
+			Year:  class.Year,
+		}
+		u.Results.Version++
+	}
+	updated := *cur
+	return &updated, nil
+}
+
+func (s *FakeStore) RemoveClass(userID string, classID string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	u, err := s.getUser(userID)
+	if err != nil {
+		return err
+	}
+	res := u.Results
+	for i, c := range res.Classes {
+		if c.ID == classID {
+			res.Classes = append(res.Classes[:i:i], res.Classes[i+1:]...)
+			res.Version++
+			return nil
+		}
+	}
+	return results.ErrClassNotFound
+}
+
+func (s *FakeStore) UpdateClassResults(userID string, class *api.Class) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	u, cur, err := s.findClass(userID, class.ID)
+	if err != nil {
+		return err
+	}
+	if cur.Name != class.Name || cur.Group != class.Group || cur.Year != class.Year {
+		return results.ErrClassNotFound
+	}
+	cur.Results = append([]api.Result(nil), class.Results...)
+	cur.Total = class.Total
+	cur.Final = class.Final
+	u.Results.Version++
 	return nil
 }
 
+func (s *FakeStore) SetLastUpdate(userID string, lastUpdate time.Time) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	u, err := s.getUser(userID)
+	if err != nil {
+		return err
+	}
+	u.Results.LastUpdate = lastUpdate
+	u.Results.Version++
+	return nil
+}
+
+func (s *FakeStore) AddChanges(userID string, changes []api.ResultsChange) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	u, err := s.getUser(userID)
+	if err != nil {
+		return err
+	}
+	u.Changes = append(u.Changes, copyChanges(changes)...)
+	return nil
+}
+
+func (s *FakeStore) GetChanges(userID string) ([]api.ResultsChange, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	u, err := s.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return copyChanges(u.Changes), nil
+}
+
+// findClass returns the user and a pointer to the stored class.
+func (s *FakeStore) findClass(userID string, classID string) (*TestUser, *api.Class, error) {
+	u, err := s.getUser(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	classes := u.Results.Classes
+	for i := range classes {
+		if classes[i].ID == classID {
+			return u, &classes[i], nil
+		}
+	}
+	return nil, nil, results.ErrClassNotFound
+}
+
 func (s *FakeStore) GetUser(id string) (*api.User, error) {
 	s.mut.RLock()
 	defer s.mut.RUnlock()
-	return s.Data[id].User, nil
+	u, err := s.getUser(id)
+	if err != nil {
+		return nil, err
+	}
+	return copyUser(u.User), nil
 }
 
 func (s *FakeStore) GetUserForLogin(email string) (*api.User, string, error) {
 	s.mut.RLock()
 	defer s.mut.RUnlock()
-	for id, user := range s.Data {
-		if user.User.Email == email {
-			return s.Data[id].User, s.Data[id].Password, nil
+	for _, u := range s.Data {
+		if u.User.Email == email {
+			return copyUser(u.User), u.Password, nil
 		}
 	}
-	return nil, "", nil
+	return nil, "", store.ErrNotFound
 }
 
-func (s *FakeStore) ListUsers() ([]*api.User, error) {
+func (s *FakeStore) ListUsers(query *user.Query) (*user.Page, error) {
+	if len(query.After) > 0 && !store.ValidID(query.After) {
+		return nil, user.ErrInvalidCursor
+	}
 	s.mut.RLock()
 	defer s.mut.RUnlock()
-	var users []*api.User
-	for _, u := range s.Data {
-		users = append(users, u.User)
+	users := []*api.User{}
+	for id, u := range s.Data {
+		if len(query.After) > 0 && id <= query.After {
+			continue
+		}
+		if !user.MatchSearch(u.User, query.Search) {
+			continue
+		}
+		if query.CrawlerEnabled && (!u.CrawlerConfig.Status || u.CrawlerConfig.Disabled) {
+			continue
+		}
+		if !query.DueBefore.IsZero() && !u.Results.LastUpdate.Before(query.DueBefore) {
+			continue
+		}
+		users = append(users, copyUser(u.User))
 	}
-	return users, nil
+	sort.Sort(byID(users))
+
+	page := &user.Page{Users: users}
+	if limit := query.GetLimit(); len(users) > limit {
+		page.Users = users[:limit]
+		page.Next = users[limit-1].ID
+	}
+	return page, nil
 }
 
+type byID []*api.User
+
+func (a byID) Len() int           { return len(a) }
+func (a byID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
 func (s *FakeStore) UpdateUser(user *api.User) error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
-
+	u, err := s.getUser(user.ID)
+	if err != nil {
+		return err
+	}
+	if user.Email != u.User.Email && s.emailUsed(user.Email) {
+		return store.ErrDuplicate
+	}
+	u.User = copyUser(user)
 	return nil
 }
 
-func (s *FakeStore) CreateUser(user *api.User, password string) error {
+func (s *FakeStore) UpdatePassword(id string, passwordHash string) error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
-	user.ID = bson.NewObjectId().Hex()
-	passHash, err := crypto.GenerateFromPassword(password)
+	u, err := s.getUser(id)
 	if err != nil {
 		return err
 	}
+	u.Password = passwordHash
+	return nil
+}
+
+// CreateUser adds a user, the crawler of the new user is on so the
+// scheduler tests don't have to turn it on.
+func (s *FakeStore) CreateUser(user *api.User, password string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.emailUsed(user.Email) {
+		return store.ErrDuplicate
+	}
+	user.ID = store.NewID()
 	s.Data[user.ID] = &TestUser{
-		user,
+		copyUser(user),
 		&api.CrawlerConfig{
 			UserID:            user.ID,
 			Status:            true,
@@ -98,7 +320,53 @@ func (s *FakeStore) CreateUser(user *api.User, password string) error {
 		&api.Results{
 			UserID: user.ID,
 		},
-		passHash,
+		password,
+		nil,
 	}
 	return nil
 }
+
+func (s *FakeStore) getUser(id string) (*TestUser, error) {
+	if !store.ValidID(id) {
+		return nil, store.ErrInvalidID
+	}
+	u, ok := s.Data[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *FakeStore) emailUsed(email string) bool {
+	for _, u := range s.Data {
+		if u.User.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+func copyUser(u *api.User) *api.User {
+	userCopy := *u
+	userCopy.Roles = append([]string(nil), u.Roles...)
+	return &userCopy
+}
+
+func copyResults(r *api.Results) *api.Results {
+	resultsCopy := *r
+	resultsCopy.Classes = make([]api.Class, len(r.Classes))
+	for i, class := range r.Classes {
+		class.Results = append([]api.Result(nil), class.Results...)
+		resultsCopy.Classes[i] = class
+	}
+	return &resultsCopy
+}
+
+func copyChanges(changes []api.ResultsChange) []api.ResultsChange {
+	res := make([]api.ResultsChange, len(changes))
+	for i, change := range changes {
+		change.Class.Results = append([]api.Result(nil), change.Class.Results...)
+		res[i] = change
+	}
+	return res
+}
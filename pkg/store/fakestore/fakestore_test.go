@@ -0,0 +1,23 @@
+package fakestore
+
+import (
+	"testing"
+
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, c *crypto.Service) storetest.Store {
+		return New(c)
+	}, Credentials)
+}
+
+// Credentials returns the encrypted code and nip of a user of a FakeStore.
+func Credentials(s storetest.Store, userID string) ([]byte, []byte, error) {
+	u, err := s.(*FakeStore).getUser(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(u.CrawlerConfig.Code), []byte(u.CrawlerConfig.Nip), nil
+}
@@ -0,0 +1,45 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+)
+
+// The ids have the layout of the mongo ObjectIds so the stores can share
+// them: 4 bytes of time, 5 random bytes picked per process and a 3 bytes
+// counter. The ids created by a process are ordered.
+var (
+	idProcess [5]byte
+	idCounter uint32
+)
+
+func init() {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	copy(idProcess[:], b[:5])
+	idCounter = binary.BigEndian.Uint32(b[4:])
+}
+
+// NewID returns a new unique id.
+func NewID() string {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:], uint32(time.Now().Unix()))
+	copy(b[4:], idProcess[:])
+	i := atomic.AddUint32(&idCounter, 1)
+	b[9], b[10], b[11] = byte(i>>16), byte(i>>8), byte(i)
+	return hex.EncodeToString(b[:])
+}
+
+// ValidID returns if id could have been returned by NewID.
+func ValidID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestNewID(t *testing.T) {
+	// The order is lost when the counter wraps.
+	atomic.StoreUint32(&idCounter, 0)
+	last := NewID()
+	for i := 0; i < 1000; i++ {
+		id := NewID()
+		if !ValidID(id) || !bson.IsObjectIdHex(id) {
+			t.Fatalf("Invalid id %s", id)
+		}
+		if id <= last {
+			t.Fatalf("Bad id order %s, should be after %s", id, last)
+		}
+		last = id
+	}
+}
+
+func TestValidID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		bson.NewObjectId().Hex():   true,
+		"":                         false,
+		"invalid":                  false,
+		"zzzzzzzzzzzzzzzzzzzzzzzz": false,
+		"0123456789abcdef01234567": true,
+	} {
+		if ValidID(id) != valid {
+			t.Errorf("Bad ValidID(%q) %v, should be %v", id, !valid, valid)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package store
+
+import "time"
+
+type (
+	// Migrator is implemented by the stores whose database schema is
+	// changed by migrations.
+	Migrator interface {
+		// Migrations returns every migration with the time it was applied.
+		Migrations() ([]*MigrationStatus, error)
+		// Migrate applies the pending migrations and returns them.
+		Migrate() ([]*MigrationStatus, error)
+		// EnsureIndexes is called every time a program starts, it fails
+		// with ErrMigrationsPending if the database is not up to date.
+		EnsureIndexes() error
+	}
+
+	// MigrationStatus describes a migration and when it was applied. The
+	// time is zero for pending migrations.
+	MigrationStatus struct {
+		Version int       `bson:"_id"`
+		Name    string    `bson:"name"`
+		Applied time.Time `bson:"applied"`
+	}
+)
@@ -1,3 +1,4 @@
 // Package mongo implements the interfaces for storing users, results and
-// crawler config in a mongodb datastore.
+// crawler config in a mongodb datastore. Users, crawler configs, results and
+// classes are stored in separate collections.
 package mongo
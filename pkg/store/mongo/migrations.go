@@ -0,0 +1,279 @@
+package mongo
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+)
+
+const migrationsKey = "migrations"
+
+type (
+	// migration changes the database from the previous version to its
+	// version. Migrations must be safe to run again if they fail halfway.
+	migration struct {
+		Version int
+		Name    string
+		Up      func(db *mgo.Database) error
+	}
+
+	// collectionIndex is an index of a collection.
+	collectionIndex struct {
+		Collection string
+		Index      mgo.Index
+	}
+
+	// legacyUser is a user document from before the crawler config and
+	// results had their own collections.
+	legacyUser struct {
+		ID            bson.ObjectId      `bson:"_id"`
+		CrawlerConfig *api.CrawlerConfig `bson:"crawler_config"`
+		Results       *api.Results       `bson:"results"`
+	}
+)
+
+// migrations are applied in order. Never change or remove a migration that
+// was released, add a new one instead.
+var migrations = []migration{
+	{1, "Unique user email index", migrateUniqueEmail},
+	{2, "Scheduler indexes", migrateSchedulerIndexes},
+	{3, "Separate crawler config, results and class collections", migrateSeparateCollections},
+	{4, "Results change index", migrateChangeIndex},
+}
+
+// indexes are the indexes of the collections once every migration is
+// applied.
+var indexes = []collectionIndex{
+	// Login and user search.
+	{userKey, mgo.Index{Key: []string{"user.email"}, Unique: true}},
+	// Users due for an update.
+	{userKey, mgo.Index{Key: []string{"crawler_enabled", "last_update"}}},
+	// Classes of a user.
+	{classKey, mgo.Index{Key: []string{"user_id", "id"}, Unique: true}},
+	// History of the results of a user.
+	{changeKey, mgo.Index{Key: []string{"user_id", "_id"}}},
+}
+
+// EnsureIndexes makes sure the indexes used by the store queries exist. It
+// is called every time the program starts and fails with
+// ErrMigrationsPending if the database is not up to date.
+func (s *Store) EnsureIndexes() error {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return store.ErrMigrationsPending
+	}
+
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	for _, index := range indexes {
+		if err := db.C(index.Collection).EnsureIndex(index.Index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrations returns every migration with the time it was applied. The
+// time is zero for pending migrations.
+func (s *Store) Migrations() ([]*store.MigrationStatus, error) {
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	applied := []*store.MigrationStatus{}
+	if err := db.C(migrationsKey).Find(nil).All(&applied); err != nil {
+		return nil, err
+	}
+	appliedByVersion := make(map[int]*store.MigrationStatus)
+	for _, m := range applied {
+		appliedByVersion[m.Version] = m
+	}
+
+	res := make([]*store.MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		res[i] = &store.MigrationStatus{Version: m.Version, Name: m.Name}
+		if a, ok := appliedByVersion[m.Version]; ok {
+			res[i].Applied = a.Applied
+		}
+	}
+	return res, nil
+}
+
+// PendingMigrations returns the migrations that were not applied.
+func (s *Store) PendingMigrations() ([]*store.MigrationStatus, error) {
+	all, err := s.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var pending []*store.MigrationStatus
+	for _, m := range all {
+		if m.Applied.IsZero() {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order and returns the ones
+// that were applied. It stops at the first migration that fails. Only one
+// process must run the migrations at a time.
+func (s *Store) Migrate() ([]*store.MigrationStatus, error) {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	var applied []*store.MigrationStatus
+	for _, status := range pending {
+		m := getMigration(status.Version)
+		if err = m.Up(db); err != nil {
+			return applied, fmt.Errorf("Migration %d failed: %s", m.Version, err)
+		}
+		status.Applied = time.Now()
+		if err = db.C(migrationsKey).Insert(status); err != nil {
+			return applied, err
+		}
+		applied = append(applied, status)
+	}
+	return applied, nil
+}
+
+func getMigration(version int) *migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
+
+// migrateUniqueEmail replaces the user email index with a unique one. It
+// fails if some emails are used by more than one user, they must be fixed
+// by hand.
+func migrateUniqueEmail(db *mgo.Database) error {
+	var duplicates []struct {
+		Email string `bson:"_id"`
+	}
+	err := db.C(userKey).Pipe([]bson.M{
+		{"$group": bson.M{"_id": "$user.email", "count": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}).All(&duplicates)
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		emails := make([]string, len(duplicates))
+		for i, d := range duplicates {
+			emails[i] = d.Email
+		}
+		return fmt.Errorf("Emails used by more than one user: %s", strings.Join(emails, ", "))
+	}
+
+	// Older versions created a non unique index on the email.
+	existing, err := db.C(userKey).Indexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range existing {
+		if len(index.Key) == 1 && index.Key[0] == "user.email" && !index.Unique {
+			if err = db.C(userKey).DropIndex("user.email"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return db.C(userKey).EnsureIndex(mgo.Index{Key: []string{"user.email"}, Unique: true})
+}
+
+func migrateSchedulerIndexes(db *mgo.Database) error {
+	return db.C(userKey).EnsureIndex(mgo.Index{Key: []string{"crawler_config.status", "results.lastupdate"}})
+}
+
+// migrateSeparateCollections moves the crawler config, results and classes
+// embedded in the user documents to their own collections.
+func migrateSeparateCollections(db *mgo.Database) error {
+	iter := db.C(userKey).Find(bson.M{"crawler_config": bson.M{"$exists": true}}).Iter()
+	for {
+		user := legacyUser{}
+		if !iter.Next(&user) {
+			break
+		}
+		if err := splitLegacyUser(db, &user); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	existing, err := db.C(userKey).Indexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range existing {
+		if len(index.Key) == 2 && index.Key[0] == "crawler_config.status" {
+			if err = db.C(userKey).DropIndex(index.Key...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitLegacyUser copies the embedded documents of a user to their
+// collection and removes them from the user. Documents already copied by
+// a previous run are replaced.
+func splitLegacyUser(db *mgo.Database, user *legacyUser) error {
+	crawlerConfig := api.CrawlerConfig{}
+	if user.CrawlerConfig != nil {
+		crawlerConfig = *user.CrawlerConfig
+	}
+	crawlerConfig.UserID = user.ID.Hex()
+	_, err := db.C(crawlerConfigKey).UpsertId(user.ID, &mongoCrawlerConfig{user.ID, crawlerConfig})
+	if err != nil {
+		return err
+	}
+
+	results := user.Results
+	if results == nil {
+		results = &api.Results{}
+	}
+	_, err = db.C(resultsKey).UpsertId(user.ID, &mongoResults{user.ID, results.LastUpdate, results.Version})
+	if err != nil {
+		return err
+	}
+	for _, class := range results.Classes {
+		_, err = db.C(classKey).Upsert(
+			bson.M{"user_id": user.ID, "id": class.ID},
+			&mongoClass{UserID: user.ID, Class: class},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.C(userKey).UpdateId(user.ID, bson.M{
+		"$set": bson.M{
+			"crawler_enabled": crawlerConfig.Status && !crawlerConfig.Disabled,
+			"last_update":     results.LastUpdate,
+		},
+		"$unset": bson.M{"crawler_config": "", "results": ""},
+	})
+}
+
+func migrateChangeIndex(db *mgo.Database) error {
+	return db.C(changeKey).EnsureIndex(mgo.Index{Key: []string{"user_id", "_id"}})
+}
@@ -1,13 +1,17 @@
 package mongo
 
 import (
-	"errors"
+	"regexp"
+	"time"
 
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 
 	"github.com/janicduplessis/resultscrawler/pkg/api"
 	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
 	"github.com/janicduplessis/resultscrawler/pkg/tools"
 )
 
@@ -15,81 +19,331 @@ import (
 // in a mongo data store.
 type Store struct {
 	helper *tools.MongoHelper
+	crypto *crypto.Service
 }
 
 const (
-	userKey = "user"
+	userKey          = "user"
+	crawlerConfigKey = "crawler_config"
+	resultsKey       = "results"
+	classKey         = "class"
+	changeKey        = "results_change"
 )
 
-// New returns a new mongo store.
-func New(helper *tools.MongoHelper) *Store {
+// New returns a new mongo store that encrypts the crawler credentials
+// with c.
+func New(helper *tools.MongoHelper, c *crypto.Service) *Store {
 	return &Store{
 		helper,
+		c,
 	}
 }
 
+// Ping checks that the database server is reachable.
+func (s *Store) Ping() error {
+	return s.helper.Ping()
+}
+
 // GetCrawlerConfig returns the crawler config for the specified user.
 func (s *Store) GetCrawlerConfig(userID string) (*api.CrawlerConfig, error) {
+	id, err := toOID(userID)
+	if err != nil {
+		return nil, err
+	}
+
 	db, conn := s.helper.Client()
 	defer conn.Close()
 
-	user := mongoUser{}
-	err := db.C(userKey).
-		FindId(bson.ObjectIdHex(userID)).
-		Select(bson.M{"crawler_config": 1}).
-		One(&user)
+	config := mongoCrawlerConfig{}
+	err = db.C(crawlerConfigKey).FindId(id).One(&config)
 	if err != nil {
-		return nil, err
+		return nil, storeError(err)
 	}
 
-	err = decryptCrawlerConfig(user.CrawlerConfig)
+	crawlerConfig := &config.CrawlerConfig
+	crawlerConfig.UserID = userID
+	err = store.DecryptCrawlerConfig(s.crypto, crawlerConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	return user.CrawlerConfig, err
+	return crawlerConfig, err
 }
 
-// UpdateCrawlerConfig updates the crawler config with the specified config.
+// UpdateCrawlerConfig updates the crawler config with the specified config
+// if its version matches the stored one.
 func (s *Store) UpdateCrawlerConfig(crawlerConfig *api.CrawlerConfig) error {
-	err := encryptCrawlerConfig(crawlerConfig)
+	id, err := toOID(crawlerConfig.UserID)
+	if err != nil {
+		return err
+	}
+	encrypted := *crawlerConfig
+	err = store.EncryptCrawlerConfig(s.crypto, &encrypted)
 	if err != nil {
 		return err
 	}
 
 	db, conn := s.helper.Client()
 	defer conn.Close()
-	return db.C(userKey).UpdateId(bson.ObjectIdHex(crawlerConfig.UserID), bson.M{"$set": bson.M{"crawler_config": crawlerConfig}})
+
+	encrypted.Version++
+	err = db.C(crawlerConfigKey).Update(
+		bson.M{"_id": id, "version": versionQuery(crawlerConfig.Version)},
+		&mongoCrawlerConfig{id, encrypted},
+	)
+	if err == mgo.ErrNotFound {
+		return conflictOrNotFound(db.C(crawlerConfigKey), id)
+	}
+	if err != nil {
+		return err
+	}
+	crawlerConfig.Version++
+
+	enabled := crawlerConfig.Status && !crawlerConfig.Disabled
+	return storeError(db.C(userKey).UpdateId(id, bson.M{"$set": bson.M{"crawler_enabled": enabled}}))
 }
 
 // GetResults returns results for a user.
 func (s *Store) GetResults(userID string) (*api.Results, error) {
+	id, err := toOID(userID)
+	if err != nil {
+		return nil, err
+	}
+
 	db, conn := s.helper.Client()
 	defer conn.Close()
-	user := mongoUser{}
-	err := db.C(userKey).
-		FindId(bson.ObjectIdHex(userID)).
-		Select(bson.M{"results.": 1}).
-		One(&user)
-	return user.Results, err
+
+	results := mongoResults{}
+	err = db.C(resultsKey).FindId(id).One(&results)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	classes := []mongoClass{}
+	err = db.C(classKey).Find(bson.M{"user_id": id}).Sort("_id").All(&classes)
+	if err != nil {
+		return nil, err
+	}
+
+	userResults := &api.Results{
+		UserID:     userID,
+		LastUpdate: results.LastUpdate,
+		Classes:    make([]api.Class, len(classes)),
+		Version:    results.Version,
+	}
+	for i, c := range classes {
+		userResults.Classes[i] = c.Class
+	}
+	return userResults, nil
+}
+
+// AddClass adds a class to the user results.
+func (s *Store) AddClass(userID string, class *api.Class) error {
+	id, err := toOID(userID)
+	if err != nil {
+		return err
+	}
+
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	// Incrementing the version first also checks that the user exists.
+	err = incResultsVersion(db, id)
+	if err != nil {
+		return err
+	}
+
+	class.ID = bson.NewObjectId().Hex()
+	return db.C(classKey).Insert(&mongoClass{UserID: id, Class: *class})
+}
+
+// UpdateClass updates the name, group and year of a class. If any of them
+// changed the class results are cleared in the same update.
+func (s *Store) UpdateClass(userID string, class *api.Class) (*api.Class, error) {
+	id, err := toOID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	updated := &api.Class{
+		ID:    class.ID,
+		Name:  class.Name,
+		Group: class.Group,
+		Year:  class.Year,
+	}
+	// Only matches if the class identity changed.
+	query := bson.M{
+		"user_id": id,
+		"id":      class.ID,
+		"$or": []bson.M{
+			{"name": bson.M{"$ne": class.Name}},
+			{"group": bson.M{"$ne": class.Group}},
+			{"year": bson.M{"$ne": class.Year}},
+		},
+	}
+	err = db.C(classKey).Update(query, bson.M{"$set": bson.M{
+		"name":    updated.Name,
+		"group":   updated.Group,
+		"year":    updated.Year,
+		"results": updated.Results,
+		"total":   updated.Total,
+		"final":   updated.Final,
+	}})
+	if err == nil {
+		return updated, incResultsVersion(db, id)
+	}
+	if err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	// Nothing changed, return the current class.
+	current := mongoClass{}
+	err = db.C(classKey).Find(bson.M{"user_id": id, "id": class.ID}).One(&current)
+	if err == mgo.ErrNotFound {
+		return nil, classNotFound(db, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &current.Class, nil
+}
+
+// RemoveClass removes a class from the user results.
+func (s *Store) RemoveClass(userID string, classID string) error {
+	id, err := toOID(userID)
+	if err != nil {
+		return err
+	}
+
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	err = db.C(classKey).Remove(bson.M{"user_id": id, "id": classID})
+	if err == mgo.ErrNotFound {
+		return classNotFound(db, id)
+	}
+	if err != nil {
+		return err
+	}
+	return incResultsVersion(db, id)
+}
+
+// UpdateClassResults updates the results, total and final grade of a class.
+func (s *Store) UpdateClassResults(userID string, class *api.Class) error {
+	id, err := toOID(userID)
+	if err != nil {
+		return err
+	}
+
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	err = db.C(classKey).Update(
+		bson.M{
+			"user_id": id,
+			"id":      class.ID,
+			"name":    class.Name,
+			"group":   class.Group,
+			"year":    class.Year,
+		},
+		bson.M{"$set": bson.M{
+			"results": class.Results,
+			"total":   class.Total,
+			"final":   class.Final,
+		}},
+	)
+	if err == mgo.ErrNotFound {
+		return classNotFound(db, id)
+	}
+	if err != nil {
+		return err
+	}
+	return incResultsVersion(db, id)
+}
+
+// SetLastUpdate sets the time the results were last crawled.
+func (s *Store) SetLastUpdate(userID string, lastUpdate time.Time) error {
+	id, err := toOID(userID)
+	if err != nil {
+		return err
+	}
+
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	err = db.C(resultsKey).UpdateId(id, bson.M{
+		"$set": bson.M{"lastupdate": lastUpdate},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		return storeError(err)
+	}
+	return storeError(db.C(userKey).UpdateId(id, bson.M{"$set": bson.M{"last_update": lastUpdate}}))
+}
+
+// AddChanges adds changes to the history of the user results.
+func (s *Store) AddChanges(userID string, changes []api.ResultsChange) error {
+	id, err := toOID(userID)
+	if err != nil {
+		return err
+	}
+
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	if err = resultsExist(db, id); err != nil || len(changes) == 0 {
+		return err
+	}
+	docs := make([]interface{}, len(changes))
+	for i, change := range changes {
+		docs[i] = &mongoChange{bson.NewObjectId(), id, change.Time, change.Class}
+	}
+	return db.C(changeKey).Insert(docs...)
 }
 
-// UpdateResults updates results for a user.
-func (s *Store) UpdateResults(userResults *api.Results) error {
+// GetChanges returns the history of the user results, oldest first.
+func (s *Store) GetChanges(userID string) ([]api.ResultsChange, error) {
+	id, err := toOID(userID)
+	if err != nil {
+		return nil, err
+	}
+
 	db, conn := s.helper.Client()
 	defer conn.Close()
 
-	return db.C(userKey).UpdateId(bson.ObjectIdHex(userResults.UserID), bson.M{"$set": bson.M{"results": userResults}})
+	if err = resultsExist(db, id); err != nil {
+		return nil, err
+	}
+	docs := []mongoChange{}
+	err = db.C(changeKey).Find(bson.M{"user_id": id}).Sort("_id").All(&docs)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]api.ResultsChange, len(docs))
+	for i, doc := range docs {
+		changes[i] = api.ResultsChange{Time: doc.Time, Class: doc.Class}
+	}
+	return changes, nil
 }
 
 // GetUser returns a user with the specified id.
 func (s *Store) GetUser(id string) (*api.User, error) {
+	oid, err := toOID(id)
+	if err != nil {
+		return nil, err
+	}
+
 	db, conn := s.helper.Client()
 	defer conn.Close()
 
 	user := &mongoUser{}
-	err := db.C(userKey).FindId(bson.ObjectIdHex(id)).Select(bson.M{"user": 1}).One(&user)
-	return user.User, err
+	err = db.C(userKey).FindId(oid).Select(bson.M{"user": 1}).One(&user)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return user.User, nil
 }
 
 // GetUserForLogin return a user by email with a password hash.
@@ -102,37 +356,92 @@ func (s *Store) GetUserForLogin(email string) (*api.User, string, error) {
 		Find(bson.M{"user.email": email}).
 		Select(bson.M{"user": 1, "password_hash": 1}).
 		One(&user)
-
-	if err == mgo.ErrNotFound {
-		return nil, "", nil
+	if err != nil {
+		return nil, "", storeError(err)
 	}
 
-	return user.User, user.PasswordHash, err
+	return user.User, user.PasswordHash, nil
 }
 
-// ListUsers returns all users.
-func (s *Store) ListUsers() ([]*api.User, error) {
+// ListUsers returns a page of the users matching the query.
+func (s *Store) ListUsers(query *user.Query) (*user.Page, error) {
+	filter := bson.M{}
+	if len(query.After) > 0 {
+		if !bson.IsObjectIdHex(query.After) {
+			return nil, user.ErrInvalidCursor
+		}
+		filter["_id"] = bson.M{"$gt": bson.ObjectIdHex(query.After)}
+	}
+	if len(query.Search) > 0 {
+		search := bson.RegEx{Pattern: regexp.QuoteMeta(query.Search), Options: "i"}
+		filter["$or"] = []bson.M{
+			{"user.email": search},
+			{"user.firstname": search},
+			{"user.lastname": search},
+		}
+	}
+	if query.CrawlerEnabled {
+		filter["crawler_enabled"] = true
+	}
+	if !query.DueBefore.IsZero() {
+		filter["last_update"] = bson.M{"$lt": query.DueBefore}
+	}
+
 	db, conn := s.helper.Client()
 	defer conn.Close()
 
+	// Get one more user to know if there is a next page.
+	limit := query.GetLimit()
 	mongoUsers := []mongoUser{}
-	err := db.C(userKey).Find(nil).Select(bson.M{"_id": 0, "user": 1}).All(&mongoUsers)
-	users := make([]*api.User, len(mongoUsers))
+	err := db.C(userKey).
+		Find(filter).
+		Select(bson.M{"user": 1}).
+		Sort("_id").
+		Limit(limit + 1).
+		All(&mongoUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &user.Page{}
+	if len(mongoUsers) > limit {
+		mongoUsers = mongoUsers[:limit]
+		page.Next = mongoUsers[limit-1].ID.Hex()
+	}
+	page.Users = make([]*api.User, len(mongoUsers))
 	for i, u := range mongoUsers {
-		users[i] = u.User
+		page.Users[i] = u.User
 	}
-	return users, err
+	return page, nil
 }
 
 // UpdateUser updates a user.
 func (s *Store) UpdateUser(user *api.User) error {
+	id, err := toOID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	db, conn := s.helper.Client()
+	defer conn.Close()
+
+	return storeError(db.C(userKey).UpdateId(id, bson.M{"$set": bson.M{"user": user}}))
+}
+
+// UpdatePassword replaces the password hash of a user.
+func (s *Store) UpdatePassword(id string, passwordHash string) error {
+	oid, err := toOID(id)
+	if err != nil {
+		return err
+	}
+
 	db, conn := s.helper.Client()
 	defer conn.Close()
 
-	return db.C(userKey).UpdateId(bson.ObjectIdHex(user.ID), bson.M{"$set": bson.M{"user": user}})
+	return storeError(db.C(userKey).UpdateId(oid, bson.M{"$set": bson.M{"password_hash": passwordHash}}))
 }
 
-// CreateUser adds a new user.
+// CreateUser adds a new user with an empty crawler config and results.
 func (s *Store) CreateUser(user *api.User, password string) error {
 	db, conn := s.helper.Client()
 	defer conn.Close()
@@ -140,51 +449,82 @@ func (s *Store) CreateUser(user *api.User, password string) error {
 	id := bson.NewObjectId()
 	hexID := id.Hex()
 	user.ID = hexID
-	crawlerConfig := &api.CrawlerConfig{UserID: hexID, NotificationEmail: user.Email}
-	results := &api.Results{UserID: hexID}
-	mongoUser := mongoUser{
-		id,
-		user,
-		crawlerConfig,
-		results,
-		password,
+	// Insert the user first so a duplicate email doesn't leave an orphan
+	// crawler config.
+	err := db.C(userKey).Insert(&mongoUser{
+		ID:           id,
+		User:         user,
+		PasswordHash: password,
+	})
+	if err != nil {
+		return storeError(err)
 	}
-	return db.C(userKey).Insert(&mongoUser)
-}
-
-func encryptCrawlerConfig(crawlerConfig *api.CrawlerConfig) error {
-	// Encrypt code and nip before saving.
-	userCode, err := crypto.AESEncrypt([]byte(crawlerConfig.Code))
+	crawlerConfig := api.CrawlerConfig{UserID: hexID, NotificationEmail: user.Email}
+	err = db.C(crawlerConfigKey).Insert(&mongoCrawlerConfig{id, crawlerConfig})
 	if err != nil {
 		return err
 	}
-	crawlerConfig.Code = string(userCode)
-	userNip, err := crypto.AESEncrypt([]byte(crawlerConfig.Nip))
-	if err != nil {
+	return db.C(resultsKey).Insert(&mongoResults{ID: id})
+}
+
+// versionQuery matches the specified version. Documents created before
+// versioning have no version field so they match version 0.
+func versionQuery(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return version
+}
+
+// incResultsVersion increments the results version after a class update.
+func incResultsVersion(db *mgo.Database, id bson.ObjectId) error {
+	return storeError(db.C(resultsKey).UpdateId(id, bson.M{"$inc": bson.M{"version": 1}}))
+}
+
+// resultsExist returns store.ErrNotFound if the user doesn't exist.
+func resultsExist(db *mgo.Database, id bson.ObjectId) error {
+	if err := conflictOrNotFound(db.C(resultsKey), id); err != store.ErrConflict {
 		return err
 	}
-	crawlerConfig.Nip = string(userNip)
 	return nil
 }
 
-func decryptCrawlerConfig(crawlerConfig *api.CrawlerConfig) error {
-	// Encrypt code and nip before saving.
-	userCode, err := crypto.AESDecrypt([]byte(crawlerConfig.Code))
-	if err != nil {
+// classNotFound returns store.ErrNotFound if the user doesn't exist and
+// results.ErrClassNotFound otherwise.
+func classNotFound(db *mgo.Database, id bson.ObjectId) error {
+	if err := resultsExist(db, id); err != nil {
 		return err
 	}
-	crawlerConfig.Code = string(userCode)
-	userNip, err := crypto.AESDecrypt([]byte(crawlerConfig.Nip))
+	return results.ErrClassNotFound
+}
+
+// conflictOrNotFound returns the error for a versioned update that didn't
+// match any document.
+func conflictOrNotFound(c *mgo.Collection, id bson.ObjectId) error {
+	n, err := c.FindId(id).Count()
 	if err != nil {
 		return err
 	}
-	crawlerConfig.Nip = string(userNip)
-	return nil
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	return store.ErrConflict
+}
+
+// storeError converts the mgo errors that have a store equivalent.
+func storeError(err error) error {
+	if err == mgo.ErrNotFound {
+		return store.ErrNotFound
+	}
+	if mgo.IsDup(err) {
+		return store.ErrDuplicate
+	}
+	return err
 }
 
 func toOID(id string) (bson.ObjectId, error) {
 	if !bson.IsObjectIdHex(id) {
-		return bson.ObjectId(""), errors.New("Invalid object ID")
+		return bson.ObjectId(""), store.ErrInvalidID
 	}
 
 	return bson.ObjectIdHex(id), nil
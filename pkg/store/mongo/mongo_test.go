@@ -0,0 +1,48 @@
+package mongo
+
+import (
+	"os"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/store/storetest"
+	"github.com/janicduplessis/resultscrawler/pkg/tools"
+)
+
+// The tests need a mongodb server, they run only if RC_TEST_MONGO_URL is
+// set. Every test uses a new database that is dropped at the end.
+func TestConformance(t *testing.T) {
+	url := os.Getenv("RC_TEST_MONGO_URL")
+	if len(url) == 0 {
+		t.Skip("RC_TEST_MONGO_URL is not set")
+	}
+
+	var helpers []*tools.MongoHelper
+	defer func() {
+		for _, helper := range helpers {
+			db, conn := helper.Client()
+			db.DropDatabase()
+			conn.Close()
+		}
+	}()
+	storetest.Run(t, func(t *testing.T, c *crypto.Service) storetest.Store {
+		helper := tools.NewMongoHelper(&tools.MongoConfig{
+			URL:  url,
+			Name: "rctest_" + bson.NewObjectId().Hex(),
+		})
+		helpers = append(helpers, helper)
+		s := New(helper, c)
+		if _, err := s.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}, func(s storetest.Store, userID string) ([]byte, []byte, error) {
+		db, conn := s.(*Store).helper.Client()
+		defer conn.Close()
+		config := mongoCrawlerConfig{}
+		err := db.C(crawlerConfigKey).FindId(bson.ObjectIdHex(userID)).One(&config)
+		return []byte(config.CrawlerConfig.Code), []byte(config.CrawlerConfig.Nip), err
+	})
+}
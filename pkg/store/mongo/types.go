@@ -1,17 +1,54 @@
 package mongo
 
 import (
+	"time"
+
 	"labix.org/v2/mgo/bson"
 
 	"github.com/janicduplessis/resultscrawler/pkg/api"
 )
 
 type (
+	// mongoUser is a document of the user collection. CrawlerEnabled and
+	// LastUpdate are copied from the crawler config and results so the
+	// scheduler can find the users due for an update with one query.
 	mongoUser struct {
-		ID            bson.ObjectId      `bson:"_id,omitempty"`
-		User          *api.User          `bson:"user"`
-		CrawlerConfig *api.CrawlerConfig `bson:"crawler_config"`
-		Results       *api.Results       `bson:"results"`
-		PasswordHash  string             `bson:"password_hash"`
+		ID             bson.ObjectId `bson:"_id,omitempty"`
+		User           *api.User     `bson:"user"`
+		PasswordHash   string        `bson:"password_hash"`
+		CrawlerEnabled bool          `bson:"crawler_enabled"`
+		LastUpdate     time.Time     `bson:"last_update"`
+	}
+
+	// mongoCrawlerConfig is a document of the crawler config collection,
+	// its id is the user id.
+	mongoCrawlerConfig struct {
+		ID            bson.ObjectId     `bson:"_id"`
+		CrawlerConfig api.CrawlerConfig `bson:",inline"`
+	}
+
+	// mongoResults is a document of the results collection, its id is the
+	// user id. The classes are stored in their own collection.
+	mongoResults struct {
+		ID         bson.ObjectId `bson:"_id"`
+		LastUpdate time.Time     `bson:"lastupdate"`
+		Version    int           `bson:"version"`
+	}
+
+	// mongoClass is a document of the class collection. Classes are
+	// ordered by their document id.
+	mongoClass struct {
+		ID     bson.ObjectId `bson:"_id,omitempty"`
+		UserID bson.ObjectId `bson:"user_id"`
+		Class  api.Class     `bson:",inline"`
+	}
+
+	// mongoChange is a document of the results change collection. Changes
+	// are ordered by their document id.
+	mongoChange struct {
+		ID     bson.ObjectId `bson:"_id"`
+		UserID bson.ObjectId `bson:"user_id"`
+		Time   time.Time     `bson:"time"`
+		Class  api.Class     `bson:"class"`
 	}
 )
@@ -1,9 +1,37 @@
 package results
 
-import "github.com/janicduplessis/resultscrawler/pkg/api"
+import (
+	"errors"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+)
+
+// ErrClassNotFound happens when the class to update or remove does not exist.
+var ErrClassNotFound = errors.New("Class not found")
 
 // Store provides an interface for storing results.
 type Store interface {
+	// GetResults returns the results of a user. Their version is
+	// incremented by every change, each class is changed on its own.
 	GetResults(userID string) (*api.Results, error)
-	UpdateResults(results *api.Results) error
+	// AddClass adds a class to the user results. A new id is assigned
+	// to the class.
+	AddClass(userID string, class *api.Class) error
+	// UpdateClass updates the name, group and year of a class and returns
+	// the updated class. The results of the class are cleared if any of
+	// them changed.
+	UpdateClass(userID string, class *api.Class) (*api.Class, error)
+	// RemoveClass removes a class from the user results.
+	RemoveClass(userID string, classID string) error
+	// UpdateClassResults updates the results, total and final grade of
+	// a class. It returns ErrClassNotFound if the class was removed or if
+	// its name, group or year changed, the results are for another class.
+	UpdateClassResults(userID string, class *api.Class) error
+	// SetLastUpdate sets the time the results were last crawled.
+	SetLastUpdate(userID string, lastUpdate time.Time) error
+	// AddChanges adds changes to the history of the user results.
+	AddChanges(userID string, changes []api.ResultsChange) error
+	// GetChanges returns the history of the user results, oldest first.
+	GetChanges(userID string) ([]api.ResultsChange, error)
 }
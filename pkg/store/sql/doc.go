@@ -0,0 +1,4 @@
+// Package sql implements the interfaces for storing users, results and
+// crawler config in a sql database. SQLite and PostgreSQL are supported,
+// SQLite is convenient for development and small deployments.
+package sql
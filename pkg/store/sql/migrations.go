@@ -0,0 +1,181 @@
+package sql
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+)
+
+// migration changes the schema from the previous version to its version.
+// The statements of a migration run in a transaction.
+type migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// migrations are applied in order. Never change or remove a migration that
+// was released, add a new one instead. The statements must work with every
+// supported driver.
+var migrations = []migration{
+	{1, "Initial schema", []string{
+		`CREATE TABLE users (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			first_name TEXT NOT NULL,
+			last_name TEXT NOT NULL,
+			roles TEXT NOT NULL,
+			password_hash TEXT NOT NULL
+		)`,
+		`CREATE TABLE crawler_configs (
+			user_id TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+			status BOOLEAN NOT NULL,
+			code TEXT NOT NULL,
+			nip TEXT NOT NULL,
+			notification_email TEXT NOT NULL,
+			disabled BOOLEAN NOT NULL,
+			version INTEGER NOT NULL
+		)`,
+		`CREATE TABLE results (
+			user_id TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+			last_update TIMESTAMP NOT NULL,
+			version INTEGER NOT NULL
+		)`,
+		`CREATE INDEX results_last_update ON results (last_update)`,
+		`CREATE TABLE classes (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			class_group TEXT NOT NULL,
+			year TEXT NOT NULL,
+			results TEXT NOT NULL,
+			total TEXT NOT NULL,
+			final TEXT NOT NULL
+		)`,
+		`CREATE INDEX classes_user_id ON classes (user_id, position)`,
+	}},
+	{2, "Results changes", []string{
+		`CREATE TABLE results_changes (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			changed_at TIMESTAMP NOT NULL,
+			class TEXT NOT NULL
+		)`,
+		`CREATE INDEX results_changes_user_id ON results_changes (user_id, changed_at)`,
+	}},
+}
+
+// EnsureIndexes fails with store.ErrMigrationsPending if the database is
+// not up to date. The indexes are created by the migrations.
+func (s *Store) EnsureIndexes() error {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return store.ErrMigrationsPending
+	}
+	return nil
+}
+
+// Migrations returns every migration with the time it was applied. The
+// time is zero for pending migrations.
+func (s *Store) Migrations() ([]*store.MigrationStatus, error) {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("SELECT version, applied FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var t time.Time
+		if err = rows.Scan(&version, &t); err != nil {
+			return nil, err
+		}
+		applied[version] = t
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make([]*store.MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		res[i] = &store.MigrationStatus{Version: m.Version, Name: m.Name, Applied: applied[m.Version]}
+	}
+	return res, nil
+}
+
+// PendingMigrations returns the migrations that were not applied.
+func (s *Store) PendingMigrations() ([]*store.MigrationStatus, error) {
+	all, err := s.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var pending []*store.MigrationStatus
+	for _, m := range all {
+		if m.Applied.IsZero() {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order and returns the ones
+// that were applied. It stops at the first migration that fails.
+func (s *Store) Migrate() ([]*store.MigrationStatus, error) {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []*store.MigrationStatus
+	for _, status := range pending {
+		status.Applied = time.Now().UTC()
+		if err = s.applyMigration(getMigration(status.Version), status); err != nil {
+			return applied, fmt.Errorf("Migration %d failed: %s", status.Version, err)
+		}
+		applied = append(applied, status)
+	}
+	return applied, nil
+}
+
+func (s *Store) applyMigration(m *migration, status *store.MigrationStatus) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.Statements {
+		if _, err = tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	_, err = s.exec(tx, "INSERT INTO schema_migrations (version, name, applied) VALUES (?, ?, ?)",
+		status.Version, status.Name, status.Applied)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func getMigration(version int) *migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,776 @@
+package sql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/secrets"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
+)
+
+// Supported drivers.
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+type (
+	// Config contains the driver and data source name of the database.
+	// Password is added to the postgres data source name, it can be a
+	// secret reference while the DSN is not.
+	Config struct {
+		Driver   string
+		DSN      string
+		Password string
+	}
+
+	// Store implements the interfaces for storing users, crawlerconfigs and
+	// results in a sql database.
+	Store struct {
+		db       *sql.DB
+		postgres bool
+		crypto   *crypto.Service
+	}
+
+	// querier is implemented by *sql.DB and *sql.Tx.
+	querier interface {
+		Exec(query string, args ...interface{}) (sql.Result, error)
+		Query(query string, args ...interface{}) (*sql.Rows, error)
+		QueryRow(query string, args ...interface{}) *sql.Row
+	}
+
+	// scanner is implemented by *sql.Row and *sql.Rows.
+	scanner interface {
+		Scan(dest ...interface{}) error
+	}
+)
+
+// uniqueViolation is the postgres error code of a unique constraint
+// violation.
+const uniqueViolation = "23505"
+
+// passwordEscaper escapes a quoted value of a key=value data source name.
+var passwordEscaper = strings.NewReplacer(`\`, `\\`, "'", `\'`)
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+const (
+	userColumns  = "id, email, first_name, last_name, roles"
+	classColumns = "id, name, class_group, year, results, total, final"
+)
+
+// String returns the config without the password of the data source name
+// so it can be logged.
+func (c *Config) String() string {
+	return fmt.Sprintf("{Driver:%s DSN:%s Password:%s}", c.Driver, secrets.RedactDSN(c.DSN),
+		secrets.Redact(c.Password))
+}
+
+// Open opens the database described by the config. The crawler credentials
+// are encrypted with c.
+func Open(config *Config, c *crypto.Service) (*Store, error) {
+	switch config.Driver {
+	case DriverSQLite, DriverPostgres:
+	default:
+		return nil, fmt.Errorf("Unsupported sql driver %s", config.Driver)
+	}
+	dsn := config.DSN
+	if len(config.Password) > 0 {
+		if config.Driver != DriverPostgres {
+			return nil, fmt.Errorf("The %s driver has no password", config.Driver)
+		}
+		dsn = dsnWithPassword(dsn, config.Password)
+	}
+	db, err := sql.Open(config.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if config.Driver == DriverSQLite {
+		// SQLite allows a single writer, using one connection avoids locking
+		// errors and keeps in memory databases alive.
+		db.SetMaxOpenConns(1)
+	}
+	return &Store{db, config.Driver == DriverPostgres, c}, nil
+}
+
+// dsnWithPassword sets the password of a postgres data source name, an url
+// or key=value pairs.
+func dsnWithPassword(dsn string, password string) string {
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		var username string
+		if u.User != nil {
+			username = u.User.Username()
+		}
+		u.User = url.UserPassword(username, password)
+		return u.String()
+	}
+	return dsn + " password='" + passwordEscaper.Replace(password) + "'"
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks that the database is reachable.
+func (s *Store) Ping() error {
+	return s.db.Ping()
+}
+
+// GetCrawlerConfig returns the crawler config for the specified user.
+func (s *Store) GetCrawlerConfig(userID string) (*api.CrawlerConfig, error) {
+	if !store.ValidID(userID) {
+		return nil, store.ErrInvalidID
+	}
+
+	crawlerConfig := &api.CrawlerConfig{UserID: userID}
+	var code, nip string
+	err := s.queryRow(s.db, `SELECT status, code, nip, notification_email, disabled, version
+		FROM crawler_configs WHERE user_id = ?`, userID).
+		Scan(&crawlerConfig.Status, &code, &nip, &crawlerConfig.NotificationEmail,
+			&crawlerConfig.Disabled, &crawlerConfig.Version)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	if crawlerConfig.Code, err = decodeSecret(code); err != nil {
+		return nil, err
+	}
+	if crawlerConfig.Nip, err = decodeSecret(nip); err != nil {
+		return nil, err
+	}
+	err = store.DecryptCrawlerConfig(s.crypto, crawlerConfig)
+	if err != nil {
+		return nil, err
+	}
+	return crawlerConfig, nil
+}
+
+// UpdateCrawlerConfig updates the crawler config with the specified config
+// if its version matches the stored one.
+func (s *Store) UpdateCrawlerConfig(crawlerConfig *api.CrawlerConfig) error {
+	if !store.ValidID(crawlerConfig.UserID) {
+		return store.ErrInvalidID
+	}
+
+	encrypted := *crawlerConfig
+	err := store.EncryptCrawlerConfig(s.crypto, &encrypted)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.exec(s.db, `UPDATE crawler_configs
+		SET status = ?, code = ?, nip = ?, notification_email = ?, disabled = ?, version = version + 1
+		WHERE user_id = ? AND version = ?`,
+		encrypted.Status, encodeSecret(encrypted.Code), encodeSecret(encrypted.Nip),
+		encrypted.NotificationEmail, encrypted.Disabled, crawlerConfig.UserID, crawlerConfig.Version)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return s.conflictOrNotFound(s.db, "crawler_configs", crawlerConfig.UserID)
+	}
+	crawlerConfig.Version++
+	return nil
+}
+
+// GetResults returns results for a user.
+func (s *Store) GetResults(userID string) (*api.Results, error) {
+	if !store.ValidID(userID) {
+		return nil, store.ErrInvalidID
+	}
+
+	userResults := &api.Results{UserID: userID, Classes: []api.Class{}}
+	err := s.queryRow(s.db, "SELECT last_update, version FROM results WHERE user_id = ?", userID).
+		Scan(&userResults.LastUpdate, &userResults.Version)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	rows, err := s.query(s.db, "SELECT "+classColumns+" FROM classes WHERE user_id = ? ORDER BY position", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		class, err := scanClass(rows)
+		if err != nil {
+			return nil, err
+		}
+		userResults.Classes = append(userResults.Classes, *class)
+	}
+	return userResults, rows.Err()
+}
+
+// AddClass adds a class to the user results.
+func (s *Store) AddClass(userID string, class *api.Class) error {
+	if !store.ValidID(userID) {
+		return store.ErrInvalidID
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Incrementing the version first also checks that the user exists.
+	if err = s.incResultsVersion(tx, userID); err != nil {
+		return err
+	}
+	var position int
+	err = s.queryRow(tx, "SELECT COALESCE(MAX(position), 0) FROM classes WHERE user_id = ?", userID).
+		Scan(&position)
+	if err != nil {
+		return err
+	}
+
+	class.ID = store.NewID()
+	if err = s.insertClass(tx, userID, position+1, class); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateClass updates the name, group and year of a class. If any of them
+// changed the class results are cleared in the same update.
+func (s *Store) UpdateClass(userID string, class *api.Class) (*api.Class, error) {
+	if !store.ValidID(userID) {
+		return nil, store.ErrInvalidID
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanClass(s.queryRow(tx, "SELECT "+classColumns+" FROM classes WHERE id = ? AND user_id = ?",
+		class.ID, userID))
+	if err == sql.ErrNoRows {
+		return nil, s.classNotFound(tx, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current.Name == class.Name && current.Group == class.Group && current.Year == class.Year {
+		return current, nil
+	}
+
+	updated := &api.Class{
+		ID:    class.ID,
+		Name:  class.Name,
+		Group: class.Group,
+		Year:  class.Year,
+	}
+	resultsJSON, totalJSON, err := encodeClassResults(updated)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.exec(tx, `UPDATE classes SET name = ?, class_group = ?, year = ?, results = ?, total = ?, final = ?
+		WHERE id = ? AND user_id = ?`,
+		updated.Name, updated.Group, updated.Year, resultsJSON, totalJSON, updated.Final, class.ID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.incResultsVersion(tx, userID); err != nil {
+		return nil, err
+	}
+	return updated, tx.Commit()
+}
+
+// RemoveClass removes a class from the user results.
+func (s *Store) RemoveClass(userID string, classID string) error {
+	if !store.ValidID(userID) {
+		return store.ErrInvalidID
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := s.exec(tx, "DELETE FROM classes WHERE id = ? AND user_id = ?", classID, userID)
+	if err != nil {
+		return err
+	}
+	if err = s.classAffected(tx, res, userID); err != nil {
+		return err
+	}
+	if err = s.incResultsVersion(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateClassResults updates the results, total and final grade of a class.
+func (s *Store) UpdateClassResults(userID string, class *api.Class) error {
+	if !store.ValidID(userID) {
+		return store.ErrInvalidID
+	}
+
+	resultsJSON, totalJSON, err := encodeClassResults(class)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := s.exec(tx, `UPDATE classes SET results = ?, total = ?, final = ?
+		WHERE id = ? AND user_id = ? AND name = ? AND class_group = ? AND year = ?`,
+		resultsJSON, totalJSON, class.Final, class.ID, userID, class.Name, class.Group, class.Year)
+	if err != nil {
+		return err
+	}
+	if err = s.classAffected(tx, res, userID); err != nil {
+		return err
+	}
+	if err = s.incResultsVersion(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetLastUpdate sets the time the results were last crawled.
+func (s *Store) SetLastUpdate(userID string, lastUpdate time.Time) error {
+	if !store.ValidID(userID) {
+		return store.ErrInvalidID
+	}
+
+	res, err := s.exec(s.db, "UPDATE results SET last_update = ?, version = version + 1 WHERE user_id = ?",
+		lastUpdate.UTC(), userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// AddChanges adds changes to the history of the user results.
+func (s *Store) AddChanges(userID string, changes []api.ResultsChange) error {
+	if !store.ValidID(userID) {
+		return store.ErrInvalidID
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = s.resultsExist(tx, userID); err != nil {
+		return err
+	}
+	for i := range changes {
+		classJSON, err := json.Marshal(&changes[i].Class)
+		if err != nil {
+			return err
+		}
+		_, err = s.exec(tx, "INSERT INTO results_changes (id, user_id, changed_at, class) VALUES (?, ?, ?, ?)",
+			store.NewID(), userID, changes[i].Time.UTC(), string(classJSON))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetChanges returns the history of the user results, oldest first.
+func (s *Store) GetChanges(userID string) ([]api.ResultsChange, error) {
+	if !store.ValidID(userID) {
+		return nil, store.ErrInvalidID
+	}
+
+	if err := s.resultsExist(s.db, userID); err != nil {
+		return nil, err
+	}
+	rows, err := s.query(s.db, "SELECT changed_at, class FROM results_changes WHERE user_id = ? ORDER BY changed_at, id",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []api.ResultsChange{}
+	for rows.Next() {
+		var change api.ResultsChange
+		var classJSON string
+		if err = rows.Scan(&change.Time, &classJSON); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(classJSON), &change.Class); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// GetUser returns a user with the specified id.
+func (s *Store) GetUser(id string) (*api.User, error) {
+	if !store.ValidID(id) {
+		return nil, store.ErrInvalidID
+	}
+
+	u, err := scanUser(s.queryRow(s.db, "SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return u, nil
+}
+
+// GetUserForLogin return a user by email with a password hash.
+func (s *Store) GetUserForLogin(email string) (*api.User, string, error) {
+	var roles, passwordHash string
+	u := &api.User{}
+	err := s.queryRow(s.db, "SELECT "+userColumns+", password_hash FROM users WHERE email = ?", email).
+		Scan(&u.ID, &u.Email, &u.FirstName, &u.LastName, &roles, &passwordHash)
+	if err != nil {
+		return nil, "", storeError(err)
+	}
+	if err = json.Unmarshal([]byte(roles), &u.Roles); err != nil {
+		return nil, "", err
+	}
+	return u, passwordHash, nil
+}
+
+// ListUsers returns a page of the users matching the query.
+func (s *Store) ListUsers(query *user.Query) (*user.Page, error) {
+	q := `SELECT u.id, u.email, u.first_name, u.last_name, u.roles FROM users u
+		JOIN crawler_configs c ON c.user_id = u.id
+		JOIN results r ON r.user_id = u.id
+		WHERE 1 = 1`
+	var args []interface{}
+	if len(query.After) > 0 {
+		if !store.ValidID(query.After) {
+			return nil, user.ErrInvalidCursor
+		}
+		q += " AND u.id > ?"
+		args = append(args, query.After)
+	}
+	if len(query.Search) > 0 {
+		q += ` AND (LOWER(u.email) LIKE ? ESCAPE '\' OR LOWER(u.first_name) LIKE ? ESCAPE '\'
+			OR LOWER(u.last_name) LIKE ? ESCAPE '\')`
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(query.Search)) + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+	if query.CrawlerEnabled {
+		q += " AND c.status = ? AND c.disabled = ?"
+		args = append(args, true, false)
+	}
+	if !query.DueBefore.IsZero() {
+		q += " AND r.last_update < ?"
+		args = append(args, query.DueBefore.UTC())
+	}
+	// Get one more user to know if there is a next page.
+	limit := query.GetLimit()
+	q += " ORDER BY u.id LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := s.query(s.db, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &user.Page{Users: []*api.User{}}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Users = append(page.Users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Users) > limit {
+		page.Users = page.Users[:limit]
+		page.Next = page.Users[limit-1].ID
+	}
+	return page, nil
+}
+
+// UpdateUser updates a user.
+func (s *Store) UpdateUser(u *api.User) error {
+	if !store.ValidID(u.ID) {
+		return store.ErrInvalidID
+	}
+
+	roles, err := json.Marshal(u.Roles)
+	if err != nil {
+		return err
+	}
+	res, err := s.exec(s.db, "UPDATE users SET email = ?, first_name = ?, last_name = ?, roles = ? WHERE id = ?",
+		u.Email, u.FirstName, u.LastName, string(roles), u.ID)
+	if err != nil {
+		return storeError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// UpdatePassword replaces the password hash of a user.
+func (s *Store) UpdatePassword(id string, passwordHash string) error {
+	if !store.ValidID(id) {
+		return store.ErrInvalidID
+	}
+
+	res, err := s.exec(s.db, "UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, id)
+	if err != nil {
+		return storeError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// CreateUser adds a new user with an empty crawler config and results.
+func (s *Store) CreateUser(u *api.User, password string) error {
+	roles, err := json.Marshal(u.Roles)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id := store.NewID()
+	_, err = s.exec(tx, "INSERT INTO users ("+userColumns+", password_hash) VALUES (?, ?, ?, ?, ?, ?)",
+		id, u.Email, u.FirstName, u.LastName, string(roles), password)
+	if err != nil {
+		return storeError(err)
+	}
+	_, err = s.exec(tx, `INSERT INTO crawler_configs (user_id, status, code, nip, notification_email, disabled, version)
+		VALUES (?, ?, '', '', ?, ?, 0)`, id, false, u.Email, false)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(tx, "INSERT INTO results (user_id, last_update, version) VALUES (?, ?, 0)",
+		id, time.Time{}.UTC())
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	u.ID = id
+	return nil
+}
+
+func (s *Store) insertClass(q querier, userID string, position int, class *api.Class) error {
+	resultsJSON, totalJSON, err := encodeClassResults(class)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(q, "INSERT INTO classes (user_id, position, "+classColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		userID, position, class.ID, class.Name, class.Group, class.Year, resultsJSON, totalJSON, class.Final)
+	return err
+}
+
+// incResultsVersion increments the results version after a class update.
+func (s *Store) incResultsVersion(q querier, userID string) error {
+	res, err := s.exec(q, "UPDATE results SET version = version + 1 WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// conflictOrNotFound returns the error for a versioned update that didn't
+// match any row.
+func (s *Store) conflictOrNotFound(q querier, table string, userID string) error {
+	var n int
+	err := s.queryRow(q, "SELECT COUNT(*) FROM "+table+" WHERE user_id = ?", userID).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return store.ErrNotFound
+	}
+	return store.ErrConflict
+}
+
+func (s *Store) exec(q querier, query string, args ...interface{}) (sql.Result, error) {
+	return q.Exec(s.rebind(query), args...)
+}
+
+func (s *Store) query(q querier, query string, args ...interface{}) (*sql.Rows, error) {
+	return q.Query(s.rebind(query), args...)
+}
+
+func (s *Store) queryRow(q querier, query string, args ...interface{}) *sql.Row {
+	return q.QueryRow(s.rebind(query), args...)
+}
+
+// rebind replaces the ? placeholders of a query with the numbered ones
+// used by postgres.
+func (s *Store) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var buf bytes.Buffer
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			buf.WriteRune(r)
+			continue
+		}
+		n++
+		buf.WriteString("$" + strconv.Itoa(n))
+	}
+	return buf.String()
+}
+
+// storeError converts the database errors that have a store equivalent.
+func storeError(err error) error {
+	if err == sql.ErrNoRows {
+		return store.ErrNotFound
+	}
+	switch err := err.(type) {
+	case sqlite3.Error:
+		if err.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return store.ErrDuplicate
+		}
+	case *pq.Error:
+		if err.Code == uniqueViolation {
+			return store.ErrDuplicate
+		}
+	}
+	return err
+}
+
+// classAffected returns the error for a class update or delete that didn't
+// match any class.
+func (s *Store) classAffected(q querier, res sql.Result, userID string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return s.classNotFound(q, userID)
+	}
+	return nil
+}
+
+// classNotFound returns store.ErrNotFound if the user doesn't exist and
+// results.ErrClassNotFound otherwise.
+func (s *Store) classNotFound(q querier, userID string) error {
+	if err := s.resultsExist(q, userID); err != nil {
+		return err
+	}
+	return results.ErrClassNotFound
+}
+
+// resultsExist returns store.ErrNotFound if the user doesn't exist.
+func (s *Store) resultsExist(q querier, userID string) error {
+	if err := s.conflictOrNotFound(q, "results", userID); err != store.ErrConflict {
+		return err
+	}
+	return nil
+}
+
+func scanUser(row scanner) (*api.User, error) {
+	var roles string
+	u := &api.User{}
+	err := row.Scan(&u.ID, &u.Email, &u.FirstName, &u.LastName, &roles)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(roles), &u.Roles); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func scanClass(row scanner) (*api.Class, error) {
+	var resultsJSON, totalJSON string
+	class := &api.Class{}
+	err := row.Scan(&class.ID, &class.Name, &class.Group, &class.Year, &resultsJSON, &totalJSON, &class.Final)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(resultsJSON), &class.Results); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(totalJSON), &class.Total); err != nil {
+		return nil, err
+	}
+	return class, nil
+}
+
+// encodeClassResults returns the results and total of a class as json, they
+// are stored in text columns.
+func encodeClassResults(class *api.Class) (string, string, error) {
+	resultsJSON, err := json.Marshal(class.Results)
+	if err != nil {
+		return "", "", err
+	}
+	totalJSON, err := json.Marshal(class.Total)
+	if err != nil {
+		return "", "", err
+	}
+	return string(resultsJSON), string(totalJSON), nil
+}
+
+// encodeSecret encodes an encrypted value so it can be stored in a text
+// column.
+func encodeSecret(encrypted string) string {
+	return base64.StdEncoding.EncodeToString([]byte(encrypted))
+}
+
+func decodeSecret(encoded string) (string, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(encoded)
+	return string(encrypted), err
+}
@@ -0,0 +1,714 @@
+// Package storetest contains the tests every store implementation must
+// pass. The tests of an implementation call Run with a function that
+// creates an empty store.
+package storetest
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	"github.com/janicduplessis/resultscrawler/pkg/store/crawlerconfig"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
+)
+
+// AESKey is the key the tests encrypt the crawler configs with.
+const AESKey = "1234abcd1234abcd"
+
+// concurrentUpdates is the number of updates made at the same time in the
+// concurrency tests.
+const concurrentUpdates = 10
+
+// Store is implemented by every store backend.
+type Store interface {
+	user.Store
+	crawlerconfig.Store
+	results.Store
+}
+
+// Credentials returns the crawler code and nip of a user as they are saved
+// by the store, without decrypting them.
+type Credentials func(s Store, userID string) (code, nip []byte, err error)
+
+var tests = []struct {
+	name string
+	fn   func(t *testing.T, s Store)
+}{
+	{"Users", testUsers},
+	{"DuplicateEmail", testDuplicateEmail},
+	{"ListUsers", testListUsers},
+	{"NotFound", testNotFound},
+	{"CrawlerConfig", testCrawlerConfig},
+	{"Results", testResults},
+	{"Classes", testClasses},
+	{"Changes", testChanges},
+	{"ConcurrentCrawlerConfigUpdates", testConcurrentCrawlerConfigUpdates},
+	{"ConcurrentClassUpdates", testConcurrentClassUpdates},
+}
+
+// Run runs the tests against the stores returned by newStore. Every test
+// gets a new empty store that must encrypt the crawler credentials with c.
+// credentials reads them from the store to check that they are encrypted.
+func Run(t *testing.T, newStore func(t *testing.T, c *crypto.Service) Store, credentials Credentials) {
+	c := NewCrypto(t)
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			fn(t, newStore(t, c))
+		})
+	}
+	t.Run("EncryptedCredentials", func(t *testing.T) {
+		testEncryptedCredentials(t, newStore(t, c), c, credentials)
+	})
+}
+
+// NewCrypto returns a service that encrypts with AESKey.
+func NewCrypto(t *testing.T) *crypto.Service {
+	c, err := crypto.NewService(AESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func createUser(t *testing.T, s Store, email string) *api.User {
+	u := &api.User{Email: email, FirstName: "Test", LastName: "User"}
+	if err := s.CreateUser(u, "hash"); err != nil {
+		t.Fatalf("Error creating user %s: %v", email, err)
+	}
+	if len(u.ID) == 0 {
+		t.Fatalf("User id not set for %s", email)
+	}
+	return u
+}
+
+func testUsers(t *testing.T, s Store) {
+	u := &api.User{Email: "test@test.com", FirstName: "Test", Roles: []string{api.RoleAdmin}}
+	if err := s.CreateUser(u, "hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetUser(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != u.ID || got.Email != u.Email || got.FirstName != u.FirstName {
+		t.Errorf("Bad user %+v, should be %+v", got, u)
+	}
+	if len(got.Roles) != 1 || got.Roles[0] != api.RoleAdmin {
+		t.Errorf("Bad roles %v", got.Roles)
+	}
+
+	got, hash, err := s.GetUserForLogin(u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.ID != u.ID || hash != "hash" {
+		t.Errorf("Bad login user %+v with hash %s", got, hash)
+	}
+
+	if _, _, err = s.GetUserForLogin("unknown@test.com"); err != store.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if err = s.UpdatePassword(u.ID, "new hash"); err != nil {
+		t.Fatal(err)
+	}
+	if _, hash, err = s.GetUserForLogin(u.Email); err != nil || hash != "new hash" {
+		t.Errorf("Bad hash %s after updating the password: %v", hash, err)
+	}
+
+	u.FirstName = "Updated"
+	u.Roles = nil
+	if err = s.UpdateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.GetUser(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != "Updated" || len(got.Roles) != 0 {
+		t.Errorf("User not updated %+v", got)
+	}
+
+	// Changing the returned user must not change the stored user.
+	got.FirstName = "Changed"
+	got, err = s.GetUser(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != "Updated" {
+		t.Errorf("Stored user changed without an update %+v", got)
+	}
+}
+
+func testDuplicateEmail(t *testing.T, s Store) {
+	u1 := createUser(t, s, "one@test.com")
+	createUser(t, s, "two@test.com")
+
+	if err := s.CreateUser(&api.User{Email: "one@test.com"}, "hash"); err != store.ErrDuplicate {
+		t.Errorf("Expected ErrDuplicate creating a user, got %v", err)
+	}
+
+	u1.Email = "two@test.com"
+	if err := s.UpdateUser(u1); err != store.ErrDuplicate {
+		t.Errorf("Expected ErrDuplicate updating a user, got %v", err)
+	}
+	got, err := s.GetUser(u1.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != "one@test.com" {
+		t.Errorf("Bad email %s, should be one@test.com", got.Email)
+	}
+}
+
+func testListUsers(t *testing.T, s Store) {
+	a := createUser(t, s, "a@test.com")
+	b := createUser(t, s, "b@test.com")
+	ab := createUser(t, s, "ab@test.com")
+
+	// a has its crawler on, b has it off and ab has it disabled.
+	for _, c := range []struct {
+		user     *api.User
+		status   bool
+		disabled bool
+	}{{a, true, false}, {b, false, false}, {ab, true, true}} {
+		config, err := s.GetCrawlerConfig(c.user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Status = c.status
+		config.Disabled = c.disabled
+		if err = s.UpdateCrawlerConfig(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ids []string
+	query := &user.Query{Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Too many pages")
+		}
+		page, err := s.ListUsers(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) > 2 {
+			t.Errorf("Bad page size %d, should be at most 2", len(page.Users))
+		}
+		for _, u := range page.Users {
+			ids = append(ids, u.ID)
+		}
+		if len(page.Next) == 0 {
+			break
+		}
+		query.After = page.Next
+	}
+	if len(ids) != 3 {
+		t.Fatalf("Bad user count %d, should be 3", len(ids))
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i-1] >= ids[i] {
+			t.Errorf("Users not ordered by id %v", ids)
+		}
+	}
+
+	for search, count := range map[string]int{"A": 2, "b@": 2, "user": 3, "%": 0, "_": 0} {
+		page, err := s.ListUsers(&user.Query{Search: search})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) != count {
+			t.Errorf("Bad user count %d for the search %s, should be %d", len(page.Users), search, count)
+		}
+	}
+
+	page, err := s.ListUsers(&user.Query{CrawlerEnabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Users) != 1 || page.Users[0].ID != a.ID {
+		t.Errorf("Bad users with the crawler enabled %+v", page.Users)
+	}
+
+	if err = s.SetLastUpdate(a.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	page, err = s.ListUsers(&user.Query{DueBefore: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Users) != 2 {
+		t.Errorf("Bad due user count %d, should be 2", len(page.Users))
+	}
+	for _, u := range page.Users {
+		if u.ID == a.ID {
+			t.Error("Recently updated user is due")
+		}
+	}
+
+	if _, err = s.ListUsers(&user.Query{After: "invalid"}); err != user.ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func testNotFound(t *testing.T, s Store) {
+	u := createUser(t, s, "test@test.com")
+
+	for id, expected := range map[string]error{
+		bson.NewObjectId().Hex(): store.ErrNotFound,
+		"invalid":                store.ErrInvalidID,
+	} {
+		if got, err := s.GetUser(id); err != expected || got != nil {
+			t.Errorf("Expected %v getting user %s, got %+v, %v", expected, id, got, err)
+		}
+		if err := s.UpdateUser(&api.User{ID: id, Email: "other@test.com"}); err != expected {
+			t.Errorf("Expected %v updating user %s, got %v", expected, id, err)
+		}
+		if err := s.UpdatePassword(id, "hash"); err != expected {
+			t.Errorf("Expected %v updating the password of %s, got %v", expected, id, err)
+		}
+		if _, err := s.GetCrawlerConfig(id); err != expected {
+			t.Errorf("Expected %v getting the crawler config of %s, got %v", expected, id, err)
+		}
+		if err := s.UpdateCrawlerConfig(&api.CrawlerConfig{UserID: id}); err != expected {
+			t.Errorf("Expected %v updating the crawler config of %s, got %v", expected, id, err)
+		}
+		if _, err := s.GetResults(id); err != expected {
+			t.Errorf("Expected %v getting the results of %s, got %v", expected, id, err)
+		}
+		if err := s.AddClass(id, &api.Class{Name: "MAT1600"}); err != expected {
+			t.Errorf("Expected %v adding a class to %s, got %v", expected, id, err)
+		}
+		if err := s.SetLastUpdate(id, time.Now()); err != expected {
+			t.Errorf("Expected %v setting the last update of %s, got %v", expected, id, err)
+		}
+		if err := s.AddChanges(id, []api.ResultsChange{{Time: time.Now()}}); err != expected {
+			t.Errorf("Expected %v adding changes to %s, got %v", expected, id, err)
+		}
+		if _, err := s.GetChanges(id); err != expected {
+			t.Errorf("Expected %v getting the changes of %s, got %v", expected, id, err)
+		}
+
+		// Unknown classes of an existing user and classes of unknown users.
+		class := &api.Class{ID: id, Name: "MAT1600"}
+		for userID, expected := range map[string]error{u.ID: results.ErrClassNotFound, id: expected} {
+			if _, err := s.UpdateClass(userID, class); err != expected {
+				t.Errorf("Expected %v updating class %s of %s, got %v", expected, id, userID, err)
+			}
+			if err := s.UpdateClassResults(userID, class); err != expected {
+				t.Errorf("Expected %v updating the results of class %s of %s, got %v", expected, id, userID, err)
+			}
+			if err := s.RemoveClass(userID, id); err != expected {
+				t.Errorf("Expected %v removing class %s of %s, got %v", expected, id, userID, err)
+			}
+		}
+	}
+
+	// Nothing was added to the existing user.
+	res, err := s.GetResults(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Classes) != 0 || res.Version != 0 {
+		t.Errorf("Results changed by failed operations %+v", res)
+	}
+}
+
+func testCrawlerConfig(t *testing.T, s Store) {
+	u := createUser(t, s, "test@test.com")
+
+	config, err := s.GetCrawlerConfig(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.UserID != u.ID || config.NotificationEmail != u.Email {
+		t.Errorf("Bad default crawler config %+v", config)
+	}
+
+	config.Code = "CODE12345678"
+	config.Nip = "12345"
+	config.Status = true
+	config.NotificationEmail = "notify@test.com"
+	version := config.Version
+	if err = s.UpdateCrawlerConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Version != version+1 {
+		t.Errorf("Bad version %d, should be %d", config.Version, version+1)
+	}
+	if config.Code != "CODE12345678" || config.Nip != "12345" {
+		t.Errorf("Update changed the secrets of the config %+v", config)
+	}
+
+	got, err := s.GetCrawlerConfig(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *config {
+		t.Errorf("Bad crawler config %+v, should be %+v", got, config)
+	}
+
+	// A stale version is a conflict and doesn't change the config.
+	stale := *config
+	stale.Version = version
+	stale.Code = "STALE"
+	if err = s.UpdateCrawlerConfig(&stale); err != store.ErrConflict {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	got, err = s.GetCrawlerConfig(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *config {
+		t.Errorf("Bad crawler config after a conflict %+v, should be %+v", got, config)
+	}
+}
+
+func testEncryptedCredentials(t *testing.T, s Store, c *crypto.Service, credentials Credentials) {
+	u := createUser(t, s, "test@test.com")
+	config, err := s.GetCrawlerConfig(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Code = "CODE12345678"
+	config.Nip = "12345"
+	if err = s.UpdateCrawlerConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	code, nip, err := credentials(s, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.NewService("abcd1234abcd1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []struct {
+		saved     []byte
+		plaintext string
+	}{{code, config.Code}, {nip, config.Nip}} {
+		if len(secret.saved) == 0 || bytes.Contains(secret.saved, []byte(secret.plaintext)) {
+			t.Errorf("Credentials saved in plain text %q", secret.saved)
+		}
+		if decrypted, err := c.Decrypt(secret.saved, []byte(u.ID)); err != nil || string(decrypted) != secret.plaintext {
+			t.Errorf("Bad decrypted credentials %q, %v, should be %s", decrypted, err, secret.plaintext)
+		}
+		if _, err := other.Decrypt(secret.saved, []byte(u.ID)); err == nil {
+			t.Error("Credentials decrypted with another key")
+		}
+		// The credentials are bound to the user.
+		if _, err := c.Decrypt(secret.saved, []byte(bson.NewObjectId().Hex())); err == nil {
+			t.Error("Credentials decrypted for another user")
+		}
+	}
+}
+
+func testResults(t *testing.T, s Store) {
+	u := createUser(t, s, "test@test.com")
+
+	res, err := s.GetResults(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UserID != u.ID || len(res.Classes) != 0 || !res.LastUpdate.IsZero() {
+		t.Errorf("Bad default results %+v", res)
+	}
+
+	class := &api.Class{Name: "MAT1600", Group: "20", Year: "20151"}
+	if err = s.AddClass(u.ID, class); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetResults(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != res.Version+1 {
+		t.Errorf("Bad version %d after adding a class, should be %d", got.Version, res.Version+1)
+	}
+
+	class.Results = []api.Result{{Name: "Intra", Normal: api.ResultInfo{Result: "80", Average: "70"}}}
+	class.Final = "A"
+	if err = s.UpdateClassResults(u.ID, class); err != nil {
+		t.Fatal(err)
+	}
+	lastUpdate := time.Now().Truncate(time.Second)
+	if err = s.SetLastUpdate(u.ID, lastUpdate); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.GetResults(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != res.Version+3 || !got.LastUpdate.Equal(lastUpdate) {
+		t.Errorf("Bad results %+v, should have version %d and last update %v", got, res.Version+3, lastUpdate)
+	}
+	if len(got.Classes) != 1 || got.Classes[0].ID != class.ID || got.Classes[0].Final != "A" ||
+		len(got.Classes[0].Results) != 1 || got.Classes[0].Results[0].Normal.Result != "80" {
+		t.Errorf("Bad classes %+v", got.Classes)
+	}
+
+	// Changing the returned results must not change the stored results.
+	got.Classes[0].Final = "C"
+	got.Classes[0].Results[0].Name = "Final"
+	got, err = s.GetResults(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Classes[0].Final != "A" || got.Classes[0].Results[0].Name != "Intra" {
+		t.Errorf("Stored results changed without an update %+v", got)
+	}
+}
+
+func testChanges(t *testing.T, s Store) {
+	u := createUser(t, s, "test@test.com")
+
+	changes, err := s.GetChanges(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("Bad changes count %d, should be 0", len(changes))
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	added := []api.ResultsChange{
+		{Time: now, Class: api.Class{ID: "1", Name: "MAT1600", Results: []api.Result{{Name: "Intra"}}}},
+		{Time: now, Class: api.Class{ID: "2", Name: "INF1120", Final: "A"}},
+	}
+	if err = s.AddChanges(u.ID, added); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddChanges(u.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	later := api.ResultsChange{Time: now.Add(time.Hour), Class: api.Class{ID: "1", Name: "MAT1600", Final: "B"}}
+	if err = s.AddChanges(u.ID, []api.ResultsChange{later}); err != nil {
+		t.Fatal(err)
+	}
+	added = append(added, later)
+
+	changes, err = s.GetChanges(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != len(added) {
+		t.Fatalf("Bad changes count %d, should be %d", len(changes), len(added))
+	}
+	for i, change := range changes {
+		if !change.Time.Equal(added[i].Time) || change.Class.ID != added[i].Class.ID ||
+			change.Class.Final != added[i].Class.Final || len(change.Class.Results) != len(added[i].Class.Results) {
+			t.Errorf("Bad change %d %+v, should be %+v", i, change, added[i])
+		}
+	}
+
+	// Changing the returned changes must not change the stored history.
+	changes[0].Class.Results[0].Name = "Final"
+	changes, err = s.GetChanges(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes[0].Class.Results[0].Name != "Intra" {
+		t.Errorf("Stored changes changed without an update %+v", changes[0])
+	}
+
+	// The history is kept per user.
+	other := createUser(t, s, "other@test.com")
+	if changes, err = s.GetChanges(other.ID); err != nil || len(changes) != 0 {
+		t.Errorf("Bad changes of another user %+v, %v", changes, err)
+	}
+}
+
+func testClasses(t *testing.T, s Store) {
+	u := createUser(t, s, "test@test.com")
+
+	class1 := &api.Class{Name: "MAT1600", Group: "20", Year: "20151"}
+	class2 := &api.Class{Name: "INF1120", Group: "10", Year: "20151"}
+	for _, class := range []*api.Class{class1, class2} {
+		if err := s.AddClass(u.ID, class); err != nil {
+			t.Fatal(err)
+		}
+		if len(class.ID) == 0 {
+			t.Fatalf("Class id not set for %s", class.Name)
+		}
+	}
+	if class1.ID == class2.ID {
+		t.Fatal("Classes have the same id")
+	}
+	checkClasses(t, s, u.ID, 2, class1, class2)
+
+	class1.Results = []api.Result{{Name: "Intra"}}
+	class1.Final = "A"
+	if err := s.UpdateClassResults(u.ID, class1); err != nil {
+		t.Fatal(err)
+	}
+	res := checkClasses(t, s, u.ID, 3, class1, class2)
+	if len(res.Classes[0].Results) != 1 || res.Classes[0].Final != "A" {
+		t.Errorf("Class results not updated %+v", res.Classes[0])
+	}
+
+	// Updating a class without changes keeps its results.
+	updated, err := s.UpdateClass(u.ID, &api.Class{ID: class1.ID, Name: class1.Name, Group: class1.Group, Year: class1.Year})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.Results) != 1 {
+		t.Errorf("Unchanged class lost its results %+v", updated)
+	}
+	checkClasses(t, s, u.ID, 3, class1, class2)
+
+	// Changing the group clears the results.
+	class1.Group = "30"
+	updated, err = s.UpdateClass(u.ID, class1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != class1.ID || updated.Group != "30" || len(updated.Results) != 0 || len(updated.Final) != 0 {
+		t.Errorf("Bad updated class %+v", updated)
+	}
+	res = checkClasses(t, s, u.ID, 4, class1, class2)
+	if res.Classes[0].Group != "30" || len(res.Classes[0].Results) != 0 {
+		t.Errorf("Class not updated %+v", res.Classes[0])
+	}
+
+	// The results crawled for the old group are for another class.
+	stale := *class1
+	stale.Group = "20"
+	stale.Final = "B"
+	if err = s.UpdateClassResults(u.ID, &stale); err != results.ErrClassNotFound {
+		t.Errorf("Expected ErrClassNotFound for a changed class, got %v", err)
+	}
+	res = checkClasses(t, s, u.ID, 4, class1, class2)
+	if len(res.Classes[0].Final) != 0 {
+		t.Errorf("Results of a changed class were saved %+v", res.Classes[0])
+	}
+
+	if err = s.RemoveClass(u.ID, class1.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkClasses(t, s, u.ID, 5, class2)
+	if err = s.RemoveClass(u.ID, class1.ID); err != results.ErrClassNotFound {
+		t.Errorf("Expected ErrClassNotFound, got %v", err)
+	}
+	if err = s.UpdateClassResults(u.ID, class1); err != results.ErrClassNotFound {
+		t.Errorf("Expected ErrClassNotFound, got %v", err)
+	}
+}
+
+// checkClasses checks the version of the user results and that they
+// contain the classes in order.
+func checkClasses(t *testing.T, s Store, userID string, version int, classes ...*api.Class) *api.Results {
+	res, err := s.GetResults(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != version {
+		t.Errorf("Bad version %d, should be %d", res.Version, version)
+	}
+	if len(res.Classes) != len(classes) {
+		t.Fatalf("Bad class count %d, should be %d", len(res.Classes), len(classes))
+	}
+	for i, class := range classes {
+		if res.Classes[i].ID != class.ID || res.Classes[i].Name != class.Name {
+			t.Errorf("Bad class %+v at %d, should be %s", res.Classes[i], i, class.Name)
+		}
+	}
+	return res
+}
+
+func testConcurrentCrawlerConfigUpdates(t *testing.T, s Store) {
+	u := createUser(t, s, "test@test.com")
+	config, err := s.GetCrawlerConfig(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, concurrentUpdates)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentUpdates; i++ {
+		update := *config
+		update.Code = bson.NewObjectId().Hex()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.UpdateCrawlerConfig(&update)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	checkOneUpdated(t, errs)
+
+	got, err := s.GetCrawlerConfig(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != config.Version+1 {
+		t.Errorf("Bad version %d, should be %d", got.Version, config.Version+1)
+	}
+}
+
+// testConcurrentClassUpdates checks that classes added at the same time are
+// all kept, each class is changed on its own.
+func testConcurrentClassUpdates(t *testing.T, s Store) {
+	u := createUser(t, s, "test@test.com")
+	res, err := s.GetResults(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, concurrentUpdates)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentUpdates; i++ {
+		class := &api.Class{Name: fmt.Sprintf("INF%d", 1000+i), Group: "10", Year: "20151"}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.AddClass(u.ID, class)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Error adding a class: %v", err)
+		}
+	}
+
+	got, err := s.GetResults(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Classes) != concurrentUpdates || got.Version != res.Version+concurrentUpdates {
+		t.Errorf("Bad results %d classes version %d, should be %d classes version %d",
+			len(got.Classes), got.Version, concurrentUpdates, res.Version+concurrentUpdates)
+	}
+}
+
+// checkOneUpdated checks that exactly one of concurrent updates of the same
+// version succeeded and the others got a conflict.
+func checkOneUpdated(t *testing.T, errs <-chan error) {
+	updated := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			updated++
+		case store.ErrConflict:
+		default:
+			t.Errorf("Expected ErrConflict, got %v", err)
+		}
+	}
+	if updated != 1 {
+		t.Errorf("Bad successful update count %d, should be 1", updated)
+	}
+}
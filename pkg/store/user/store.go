@@ -1,12 +1,78 @@
 package user
 
-import "github.com/janicduplessis/resultscrawler/pkg/api"
-
-// Store handles user related operations in the datastore.
-type Store interface {
-	GetUser(id string) (*api.User, error)
-	GetUserForLogin(email string) (*api.User, string, error)
-	ListUsers() ([]*api.User, error)
-	UpdateUser(user *api.User) error
-	CreateUser(user *api.User, password string) error
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+)
+
+// ErrInvalidCursor happens when the After cursor of a query was not
+// returned by ListUsers.
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// DefaultLimit is the number of users in a page when the query has no
+// limit.
+const DefaultLimit = 100
+
+type (
+	// Store handles user related operations in the datastore.
+	Store interface {
+		GetUser(id string) (*api.User, error)
+		// GetUserForLogin returns the user with the email and its password
+		// hash, or store.ErrNotFound.
+		GetUserForLogin(email string) (*api.User, string, error)
+		// ListUsers returns a page of the users matching the query, ordered
+		// by id.
+		ListUsers(query *Query) (*Page, error)
+		UpdateUser(user *api.User) error
+		// UpdatePassword replaces the password hash of the user.
+		UpdatePassword(id string, passwordHash string) error
+		CreateUser(user *api.User, password string) error
+	}
+
+	// Query filters and paginates the users returned by ListUsers. The zero
+	// value returns the first page of all users.
+	Query struct {
+		// After is the cursor of the page to get, from Page.Next.
+		After string
+		// Limit is the maximum number of users in the page, DefaultLimit if
+		// it is 0.
+		Limit int
+		// Search only returns users whose email, first name or last name
+		// contains it, ignoring case. SQLite only ignores the case of ascii
+		// letters.
+		Search string
+		// CrawlerEnabled only returns users who turned on their crawler and
+		// whose crawler is not disabled.
+		CrawlerEnabled bool
+		// DueBefore only returns users whose results were last updated
+		// before it, if it is set.
+		DueBefore time.Time
+	}
+
+	// Page is a page of users.
+	Page struct {
+		Users []*api.User
+		// Next is the cursor of the next page, empty on the last page.
+		Next string
+	}
+)
+
+// GetLimit returns the limit of the query or DefaultLimit.
+func (q *Query) GetLimit() int {
+	if q.Limit <= 0 {
+		return DefaultLimit
+	}
+	return q.Limit
+}
+
+// MatchSearch returns true if the email, first name or last name of u
+// contains search, ignoring case.
+func MatchSearch(u *api.User, search string) bool {
+	search = strings.ToLower(search)
+	return strings.Contains(strings.ToLower(u.Email), search) ||
+		strings.Contains(strings.ToLower(u.FirstName), search) ||
+		strings.Contains(strings.ToLower(u.LastName), search)
 }
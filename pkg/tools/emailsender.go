@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/smtp"
 	"strings"
+
+	"github.com/janicduplessis/resultscrawler/pkg/secrets"
 )
 
 // EmailSender is a helper for sending mails using smtp
@@ -18,6 +20,11 @@ type EmailConfig struct {
 	Password string
 }
 
+// String returns the config without the password so it can be logged.
+func (c *EmailConfig) String() string {
+	return fmt.Sprintf("{URL:%s User:%s Password:%s}", c.URL, c.User, secrets.Redact(c.Password))
+}
+
 // NewEmailSender creates a new email sender object.
 func NewEmailSender(config *EmailConfig) *EmailSender {
 	return &EmailSender{
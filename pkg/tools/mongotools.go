@@ -1,10 +1,13 @@
 package tools
 
 import (
+	"fmt"
 	"log"
 	"time"
 
 	"labix.org/v2/mgo"
+
+	"github.com/janicduplessis/resultscrawler/pkg/secrets"
 )
 
 // MongoHelper handles connection to a mongodb database.
@@ -21,6 +24,11 @@ type MongoConfig struct {
 	Password string
 }
 
+// String returns the config without the password so it can be logged.
+func (c *MongoConfig) String() string {
+	return fmt.Sprintf("{URL:%s Name:%s User:%s Password:%s}", c.URL, c.Name, c.User, secrets.Redact(c.Password))
+}
+
 // The ConnCloser interface provides an abstraction to close a db connection.
 type ConnCloser interface {
 	Close()
@@ -64,3 +72,10 @@ func (hndl *MongoHelper) Client() (*mgo.Database, ConnCloser) {
 	sessionCopy := hndl.mongoSession.Copy()
 	return sessionCopy.DB(hndl.config.Name), sessionCopy
 }
+
+// Ping checks that the database server is reachable.
+func (hndl *MongoHelper) Ping() error {
+	session := hndl.mongoSession.Copy()
+	defer session.Close()
+	return session.Ping()
+}
@@ -0,0 +1,263 @@
+package webserver
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
+	"github.com/janicduplessis/resultscrawler/pkg/ws"
+)
+
+const (
+	urlAdmin      = urlBase + "/admin"
+	urlAdminUsers = urlAdmin + "/users"
+	urlAdminJobs  = urlAdmin + "/jobs"
+
+	// Default and maximum number of users returned by the user search.
+	adminDefaultLimit = 50
+	adminMaxLimit     = 200
+
+	// Time an impersonation session is valid.
+	impersonationTTL = time.Hour
+	// Number of times changing the crawler config is attempted when it is
+	// modified concurrently.
+	maxConfigAttempts = 3
+)
+
+// adminMiddleware only lets administrators through. It must be used after
+// authMiddleware. Impersonation sessions can't use the admin api even if
+// the impersonated user is an administrator.
+func (server *Webserver) adminMiddleware(next ws.Handler) ws.Handler {
+	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		session := getSession(ctx)
+		if len(session.ImpersonatorID) > 0 {
+			server.handleError(w, newForbiddenError("Administrator role required"))
+			return
+		}
+		user, err := server.userStore.GetUser(session.UserID)
+		if err != nil {
+			server.handleError(w, err)
+			return
+		}
+		if !user.HasRole(api.RoleAdmin) {
+			log.Printf("Admin access refused for user %s", session.UserID)
+			server.handleError(w, newForbiddenError("Administrator role required"))
+			return
+		}
+
+		next.ServeHTTP(ctx, w, r)
+	}
+
+	return ws.HandlerFunc(fn)
+}
+
+// adminUsersHandler lists the users matching the q param, a page at a
+// time. The search is case insensitive and matches the email and names.
+func (server *Webserver) adminUsersHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := &user.Query{
+		After:  params.Get("after"),
+		Limit:  adminDefaultLimit,
+		Search: params.Get("q"),
+	}
+	if limitParam := params.Get("limit"); len(limitParam) > 0 {
+		var err error
+		query.Limit, err = strconv.Atoi(limitParam)
+		if err != nil || query.Limit <= 0 || query.Limit > adminMaxLimit {
+			server.handleError(w, newBadRequestError("Invalid limit", fieldError{
+				Field:   "limit",
+				Message: "Expected a number between 1 and " + strconv.Itoa(adminMaxLimit),
+			}))
+			return
+		}
+	}
+
+	page, err := server.userStore.ListUsers(query)
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+
+	response := &adminUsersResponse{
+		Users: make([]*adminUserModel, len(page.Users)),
+		Next:  page.Next,
+	}
+	for i, u := range page.Users {
+		response.Users[i] = getAdminUserModel(u)
+	}
+
+	err = sendJSON(w, response)
+	if err != nil {
+		server.handleError(w, err)
+	}
+}
+
+// adminUserHandler sends a user with the status of its crawler.
+func (server *Webserver) adminUserHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := ws.Params(ctx).ByName("userId")
+	response, err := server.getAdminUserDetails(userID)
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+
+	err = sendJSON(w, response)
+	if err != nil {
+		server.handleError(w, err)
+	}
+}
+
+// adminRefreshHandler queues a refresh for a user. Unlike user refreshes
+// it is not rate limited.
+func (server *Webserver) adminRefreshHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := ws.Params(ctx).ByName("userId")
+	if _, err := server.userStore.GetUser(userID); err != nil {
+		server.handleError(w, err)
+		return
+	}
+
+	job, err := server.crawlerClient.Refresh(userID)
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+	log.Printf("Admin %s queued a refresh for user %s", getUserID(ctx), userID)
+
+	w.Header().Set("Location", urlAdminJobs+"/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	err = sendJSON(w, job)
+	if err != nil {
+		server.handleError(w, err)
+	}
+}
+
+// adminJobHandler sends a refresh job of any user.
+func (server *Webserver) adminJobHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	job, err := server.crawlerClient.RefreshJob(ws.Params(ctx).ByName("jobId"))
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+
+	err = sendJSON(w, job)
+	if err != nil {
+		server.handleError(w, err)
+	}
+}
+
+func (server *Webserver) adminDisableCrawlerHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	server.setCrawlerDisabled(ctx, w, true)
+}
+
+func (server *Webserver) adminEnableCrawlerHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	server.setCrawlerDisabled(ctx, w, false)
+}
+
+// setCrawlerDisabled changes the disabled flag of the user crawler config
+// and sends the updated user details.
+func (server *Webserver) setCrawlerDisabled(ctx context.Context, w http.ResponseWriter, disabled bool) {
+	userID := ws.Params(ctx).ByName("userId")
+	if _, err := server.userStore.GetUser(userID); err != nil {
+		server.handleError(w, err)
+		return
+	}
+
+	var err error
+	for i := 0; i < maxConfigAttempts; i++ {
+		var config *api.CrawlerConfig
+		config, err = server.crawlerConfigStore.GetCrawlerConfig(userID)
+		if err != nil {
+			break
+		}
+		config.Disabled = disabled
+		err = server.crawlerConfigStore.UpdateCrawlerConfig(config)
+		if err != store.ErrConflict {
+			break
+		}
+	}
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+	log.Printf("Admin %s set crawler disabled to %t for user %s", getUserID(ctx), disabled, userID)
+
+	response, err := server.getAdminUserDetails(userID)
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+	err = sendJSON(w, response)
+	if err != nil {
+		server.handleError(w, err)
+	}
+}
+
+// adminImpersonateHandler creates a read-only session for a user so
+// support staff can see what the user sees.
+func (server *Webserver) adminImpersonateHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := ws.Params(ctx).ByName("userId")
+	if _, err := server.userStore.GetUser(userID); err != nil {
+		server.handleError(w, err)
+		return
+	}
+
+	adminID := getUserID(ctx)
+	expires := time.Now().Add(impersonationTTL)
+	token, err := server.createImpersonationSession(userID, adminID, impersonationTTL)
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+	log.Printf("Admin %s is impersonating user %s", adminID, userID)
+
+	err = sendJSON(w, &impersonateResponse{
+		Token:   token,
+		Expires: expires,
+	})
+	if err != nil {
+		server.handleError(w, err)
+	}
+}
+
+func (server *Webserver) getAdminUserDetails(userID string) (*adminUserDetailsModel, error) {
+	user, err := server.userStore.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	config, err := server.crawlerConfigStore.GetCrawlerConfig(userID)
+	if err != nil {
+		return nil, err
+	}
+	results, err := server.userResultsStore.GetResults(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &adminUserDetailsModel{
+		adminUserModel: *getAdminUserModel(user),
+		Crawler: &adminCrawlerModel{
+			Status:            config.Status,
+			Disabled:          config.Disabled,
+			HasCredentials:    len(config.Code) > 0 && len(config.Nip) > 0,
+			NotificationEmail: config.NotificationEmail,
+			LastUpdate:        results.LastUpdate,
+			Classes:           len(results.Classes),
+		},
+	}, nil
+}
+
+func getAdminUserModel(user *api.User) *adminUserModel {
+	return &adminUserModel{
+		ID:        user.ID,
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Roles:     user.Roles,
+	}
+}
@@ -0,0 +1,179 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
+)
+
+type (
+	// apiError is the error object sent to the client when a request fails.
+	apiError struct {
+		Status    int          `json:"-"`
+		Code      string       `json:"code"`
+		Message   string       `json:"message"`
+		Fields    []fieldError `json:"fields,omitempty"`
+		RequestID string       `json:"requestId,omitempty"`
+	}
+
+	// fieldError describes a problem with a specific field of the request.
+	fieldError struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	}
+
+	errorResponse struct {
+		Error *apiError `json:"error"`
+	}
+)
+
+// Error codes sent to the client.
+const (
+	codeBadRequest   = "bad_request"
+	codeUnauthorized = "unauthorized"
+	codeForbidden    = "forbidden"
+	codeNotFound     = "not_found"
+	codeConflict     = "conflict"
+	codePrecondition = "precondition_failed"
+	codeTooMany      = "too_many_requests"
+	codeInternal     = "internal_error"
+)
+
+// ErrNotFound happens when the requested resource does not exist.
+var ErrNotFound = errors.New("Resource not found")
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newBadRequestError(message string, fields ...fieldError) *apiError {
+	return &apiError{
+		Status:  http.StatusBadRequest,
+		Code:    codeBadRequest,
+		Message: message,
+		Fields:  fields,
+	}
+}
+
+func newForbiddenError(message string) *apiError {
+	return &apiError{
+		Status:  http.StatusForbidden,
+		Code:    codeForbidden,
+		Message: message,
+	}
+}
+
+func newNotFoundError(message string) *apiError {
+	return &apiError{
+		Status:  http.StatusNotFound,
+		Code:    codeNotFound,
+		Message: message,
+	}
+}
+
+func newConflictError() *apiError {
+	return &apiError{
+		Status:  http.StatusConflict,
+		Code:    codeConflict,
+		Message: store.ErrConflict.Error(),
+	}
+}
+
+func newPreconditionFailedError() *apiError {
+	return &apiError{
+		Status:  http.StatusPreconditionFailed,
+		Code:    codePrecondition,
+		Message: "The resource was modified since it was fetched",
+	}
+}
+
+func newTooManyRequestsError() *apiError {
+	return &apiError{
+		Status:  http.StatusTooManyRequests,
+		Code:    codeTooMany,
+		Message: "Too many requests, try again later",
+	}
+}
+
+func newInternalError() *apiError {
+	return &apiError{
+		Status:  http.StatusInternalServerError,
+		Code:    codeInternal,
+		Message: http.StatusText(http.StatusInternalServerError),
+	}
+}
+
+// newDecodeError converts an error from decoding the request body to a
+// bad request error.
+func newDecodeError(err error) *apiError {
+	switch err := err.(type) {
+	case *json.UnmarshalTypeError:
+		return newBadRequestError("Invalid request body", fieldError{
+			Field:   err.Field,
+			Message: fmt.Sprintf("Expected a %s, got a %s", err.Type.String(), err.Value),
+		})
+	case *json.SyntaxError:
+		return newBadRequestError(fmt.Sprintf("Invalid json at offset %d: %s", err.Offset, err.Error()))
+	default:
+		return newBadRequestError("Invalid request body: " + err.Error())
+	}
+}
+
+// toAPIError maps an error returned by a handler dependency to the error
+// sent to the client.
+func toAPIError(err error) *apiError {
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr
+	}
+	if err == ErrNotFound || err == store.ErrNotFound {
+		return newNotFoundError(ErrNotFound.Error())
+	}
+	if err == store.ErrInvalidID {
+		return newBadRequestError(err.Error())
+	}
+	if err == store.ErrDuplicate {
+		return &apiError{
+			Status:  http.StatusConflict,
+			Code:    codeConflict,
+			Message: err.Error(),
+		}
+	}
+	if err == results.ErrClassNotFound || err == api.ErrJobNotFound {
+		return newNotFoundError(err.Error())
+	}
+	if err == store.ErrConflict {
+		return newConflictError()
+	}
+	if err == user.ErrInvalidCursor {
+		return newBadRequestError(err.Error(), fieldError{
+			Field:   "after",
+			Message: "Use the next cursor of the previous page",
+		})
+	}
+	return newInternalError()
+}
+
+// sendError writes the error as json with the matching http status.
+func sendError(w http.ResponseWriter, apiErr *apiError) {
+	// Copy the error so the request id doesn't leak in shared errors.
+	res := *apiErr
+	res.RequestID = w.Header().Get(headerRequestID)
+
+	data, err := json.Marshal(&errorResponse{&res})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Status)
+	w.Write(data)
+}
@@ -0,0 +1,93 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janicduplessis/resultscrawler/pkg/ws"
+)
+
+const (
+	// Time between comments sent to keep the event stream connection open.
+	keepAliveInterval = 30 * time.Second
+
+	queryTokenName = "token"
+)
+
+// eventsHandler streams the events of the user using server-sent events.
+// Every event is sent with its type as the event name and the event json
+// as data.
+func (server *Webserver) eventsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || server.eventBus == nil {
+		server.handleError(w, ErrNotFound)
+		return
+	}
+
+	userID := getUserID(ctx)
+	sub := server.eventBus.Subscribe()
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if event.UserID != userID {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			if err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// queryTokenMiddleware moves the session token from the query string to
+// the session header. The token is removed from the url so it doesn't end
+// up in the logs.
+func (server *Webserver) queryTokenMiddleware(next ws.Handler) ws.Handler {
+	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		token := query.Get(queryTokenName)
+		if len(token) > 0 {
+			if len(r.Header.Get(headerName)) == 0 {
+				r.Header.Set(headerName, token)
+			}
+			query.Del(queryTokenName)
+			r.URL.RawQuery = query.Encode()
+		}
+
+		next.ServeHTTP(ctx, w, r)
+	}
+
+	return ws.HandlerFunc(fn)
+}
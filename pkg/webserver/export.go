@@ -0,0 +1,180 @@
+package webserver
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janicduplessis/resultscrawler/pkg/api"
+)
+
+const (
+	exportFormatJSON = "json"
+	exportFormatCSV  = "csv"
+
+	exportJSONName = "account.json"
+	redacted       = "REDACTED"
+)
+
+var exportCSVHeader = []string{
+	"class", "group", "name",
+	"result", "average", "standardDev",
+	"weightedResult", "weightedAverage", "weightedStandardDev",
+}
+
+// accountExportHandler sends everything we store about the user. The default
+// format is a single json document. When the csv format is requested the
+// response is a zip archive containing the json document and a csv file with
+// the results of every session.
+func (server *Webserver) accountExportHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = exportFormatJSON
+	}
+	if format != exportFormatJSON && format != exportFormatCSV {
+		server.handleError(w, newBadRequestError("Invalid export format", fieldError{
+			Field:   "format",
+			Message: fmt.Sprintf("Expected %s or %s", exportFormatJSON, exportFormatCSV),
+		}))
+		return
+	}
+
+	userID := getUserID(ctx)
+	export, err := server.getAccountExport(userID)
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+
+	filename := fmt.Sprintf("results-export-%s", export.ExportDate.Format("20060102"))
+	if format == exportFormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.json\"", filename))
+		err = json.NewEncoder(w).Encode(export)
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", filename))
+		err = writeExportArchive(w, export)
+	}
+	// At this point the headers are already sent so we can only log the error.
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (server *Webserver) getAccountExport(userID string) (*accountExport, error) {
+	user, err := server.userStore.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	config, err := server.crawlerConfigStore.GetCrawlerConfig(userID)
+	if err != nil {
+		return nil, err
+	}
+	results, err := server.userResultsStore.GetResults(userID)
+	if err != nil {
+		return nil, err
+	}
+	history, err := server.userResultsStore.GetChanges(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Never send back the UQAM credentials, the user already knows them.
+	redactedConfig := *config
+	if len(redactedConfig.Code) > 0 {
+		redactedConfig.Code = redacted
+	}
+	if len(redactedConfig.Nip) > 0 {
+		redactedConfig.Nip = redacted
+	}
+
+	return &accountExport{
+		ExportDate:    time.Now(),
+		User:          user,
+		CrawlerConfig: &redactedConfig,
+		Results:       results,
+		History:       history,
+	}, nil
+}
+
+// writeExportArchive writes a zip archive with the json export and a csv
+// file per session.
+func writeExportArchive(w io.Writer, export *accountExport) error {
+	archive := zip.NewWriter(w)
+
+	f, err := archive.Create(exportJSONName)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(f).Encode(export); err != nil {
+		return err
+	}
+
+	sessions := make(map[string][]api.Class)
+	for _, c := range export.Results.Classes {
+		sessions[c.Year] = append(sessions[c.Year], c)
+	}
+	years := make([]string, 0, len(sessions))
+	for year := range sessions {
+		years = append(years, year)
+	}
+	sort.Strings(years)
+
+	for _, year := range years {
+		f, err = archive.Create(fmt.Sprintf("results-%s.csv", year))
+		if err != nil {
+			return err
+		}
+		if err = writeSessionCSV(f, sessions[year]); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// writeSessionCSV writes one row per result, followed by the total and the
+// final grade of each class.
+func writeSessionCSV(w io.Writer, classes []api.Class) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportCSVHeader); err != nil {
+		return err
+	}
+	for _, c := range classes {
+		for _, res := range c.Results {
+			err := writer.Write([]string{
+				c.Name, c.Group, res.Name,
+				res.Normal.Result, res.Normal.Average, res.Normal.StandardDev,
+				res.Weighted.Result, res.Weighted.Average, res.Weighted.StandardDev,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err := writer.Write([]string{
+			c.Name, c.Group, "Total",
+			c.Total.Result, c.Total.Average, c.Total.StandardDev,
+			"", "", "",
+		})
+		if err != nil {
+			return err
+		}
+		if len(c.Final) > 0 {
+			err = writer.Write([]string{c.Name, c.Group, "Final", c.Final, "", "", "", "", ""})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -44,11 +44,55 @@ type (
 		LastUpdate time.Time   `json:"lastUpdate"`
 	}
 
+	adminUsersResponse struct {
+		Users []*adminUserModel `json:"users"`
+		// Next is the cursor of the next page, empty on the last page.
+		Next string `json:"next,omitempty"`
+	}
+
+	impersonateResponse struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}
+
+	accountExport struct {
+		ExportDate    time.Time           `json:"exportDate"`
+		User          *api.User           `json:"user"`
+		CrawlerConfig *api.CrawlerConfig  `json:"crawlerConfig"`
+		Results       *api.Results        `json:"results"`
+		History       []api.ResultsChange `json:"history"`
+	}
+
 	// models
 	userModel struct {
-		Email     string `json:"email"`
-		FirstName string `json:"firstName"`
-		LastName  string `json:"lastName"`
+		Email     string   `json:"email"`
+		FirstName string   `json:"firstName"`
+		LastName  string   `json:"lastName"`
+		Roles     []string `json:"roles,omitempty"`
+	}
+
+	adminUserModel struct {
+		ID        string   `json:"id"`
+		Email     string   `json:"email"`
+		FirstName string   `json:"firstName"`
+		LastName  string   `json:"lastName"`
+		Roles     []string `json:"roles,omitempty"`
+	}
+
+	adminUserDetailsModel struct {
+		adminUserModel
+		Crawler *adminCrawlerModel `json:"crawler"`
+	}
+
+	// adminCrawlerModel is the crawler status of a user. It never contains
+	// the user credentials.
+	adminCrawlerModel struct {
+		Status            bool      `json:"status"`
+		Disabled          bool      `json:"disabled"`
+		HasCredentials    bool      `json:"hasCredentials"`
+		NotificationEmail string    `json:"notificationEmail"`
+		LastUpdate        time.Time `json:"lastUpdate"`
+		Classes           int       `json:"classes"`
 	}
 
 	crawlerConfigClassModel struct {
@@ -0,0 +1,57 @@
+package webserver
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows an action once per interval for every key.
+type rateLimiter struct {
+	mut       sync.Mutex
+	interval  time.Duration
+	last      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		interval:  interval,
+		last:      make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow records the action for key if it is allowed. If it's not it
+// returns false and the time to wait before it is.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	now := time.Now()
+	if last, ok := l.last[key]; ok {
+		if wait := l.interval - now.Sub(last); wait > 0 {
+			return false, wait
+		}
+	}
+	l.last[key] = now
+
+	// Forget the keys that are allowed again once in a while.
+	if now.Sub(l.lastSweep) > l.interval {
+		for k, t := range l.last {
+			if now.Sub(t) > l.interval {
+				delete(l.last, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	return true, 0
+}
+
+// release forgets the last action for key so it is allowed again, when the
+// action failed.
+func (l *rateLimiter) release(key string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	delete(l.last, key)
+}
@@ -3,6 +3,7 @@
 package webserver
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,15 +12,17 @@ import (
 	"log"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
 	"code.google.com/p/go.net/context"
 	"github.com/dgrijalva/jwt-go"
-	"labix.org/v2/mgo/bson"
 
 	"github.com/janicduplessis/resultscrawler/pkg/api"
 	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/events"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
 	"github.com/janicduplessis/resultscrawler/pkg/store/crawlerconfig"
 	"github.com/janicduplessis/resultscrawler/pkg/store/results"
 	"github.com/janicduplessis/resultscrawler/pkg/store/user"
@@ -35,6 +38,10 @@ type (
 		RSAPublic          []byte
 		RSAPrivate         []byte
 		CrawlerClient      api.Crawler
+		EventBus           events.Bus
+		// PasswordHasher hashes the passwords, bcrypt with the default cost
+		// is used if it is nil.
+		PasswordHasher *crypto.PasswordHasher
 	}
 
 	// Webserver serves as a global context for the server.
@@ -46,6 +53,9 @@ type (
 		rsaPrivate         []byte
 		router             *ws.Router
 		crawlerClient      api.Crawler
+		eventBus           events.Bus
+		refreshLimiter     *rateLimiter
+		passwordHasher     *crypto.PasswordHasher
 		httpPort           string
 		httpsPort          string
 	}
@@ -62,10 +72,16 @@ const (
 	urlLogin          = urlBase + "/auth/login"
 	urlRegister       = urlBase + "/auth/register"
 	urlLogout         = urlBase + "/auth/logout"
-
-	userKey          key = 1
-	sessionUserIDKey     = "userid"
-	headerName           = "X-Access-Token"
+	urlAccountExport  = urlBase + "/account/export"
+	urlEvents         = urlBase + "/events"
+
+	userKey                key = 1
+	sessionKey             key = 2
+	sessionUserIDKey           = "userid"
+	sessionImpersonatorKey     = "impersonator"
+	sessionExpiresKey          = "exp"
+	headerName                 = "X-Access-Token"
+	headerRequestID            = "X-Request-ID"
 )
 
 const (
@@ -77,13 +93,29 @@ const (
 	statusInvalidInfos        // The registration infos are invalid.
 )
 
+// Minimum time between manual refreshes for a user.
+const refreshInterval = time.Minute
+
 // ErrUnauthorized happens when an unauthorized access occur.
 var ErrUnauthorized = errors.New("Unauthorized access")
 
+// session contains the info of an authentication token.
+type session struct {
+	UserID string
+	// ImpersonatorID is the id of the admin using the session when it was
+	// created to impersonate the user. These sessions are read-only.
+	ImpersonatorID string
+}
+
 // NewWebserver creates a new webserver object.
 func NewWebserver(config *Config) *Webserver {
 	router := ws.NewRouter()
 
+	passwordHasher := config.PasswordHasher
+	if passwordHasher == nil {
+		passwordHasher, _ = crypto.NewPasswordHasher(&crypto.PasswordConfig{})
+	}
+
 	webserver := &Webserver{
 		userStore:          config.UserStore,
 		crawlerConfigStore: config.CrawlerConfigStore,
@@ -92,11 +124,19 @@ func NewWebserver(config *Config) *Webserver {
 		rsaPrivate:         config.RSAPrivate,
 		router:             router,
 		crawlerClient:      config.CrawlerClient,
+		eventBus:           config.EventBus,
+		refreshLimiter:     newRateLimiter(refreshInterval),
+		passwordHasher:     passwordHasher,
 	}
 
 	// Define middleware groups
-	commonHandlers := ws.NewMiddlewareGroup(webserver.errorMiddleware, webserver.logMiddleware)
+	commonHandlers := ws.NewMiddlewareGroup(webserver.requestIDMiddleware, webserver.errorMiddleware, webserver.logMiddleware)
 	registeredHandlers := commonHandlers.Append(webserver.authMiddleware)
+	adminHandlers := registeredHandlers.Append(webserver.adminMiddleware)
+	// Browsers can't set headers on event streams so the token can also
+	// be passed in the query string.
+	streamHandlers := ws.NewMiddlewareGroup(webserver.requestIDMiddleware, webserver.queryTokenMiddleware,
+		webserver.errorMiddleware, webserver.logMiddleware, webserver.authMiddleware)
 
 	// Static files
 	router.ServeFiles("/app/*filepath", http.Dir("public"))
@@ -114,11 +154,24 @@ func NewWebserver(config *Config) *Webserver {
 	router.DELETE(urlCrawlerClass+"/:classId", registeredHandlers.Then(webserver.crawlerDeleteClassHandler))
 
 	router.POST(urlCrawlerRefresh, registeredHandlers.Then(webserver.crawlerRefreshHandler))
+	router.GET(urlCrawlerRefresh+"/:jobId", registeredHandlers.Then(webserver.crawlerRefreshJobHandler))
 
 	router.POST(urlLogin, commonHandlers.Then(webserver.loginHandler))
 	router.POST(urlRegister, commonHandlers.Then(webserver.registerHandler))
 	router.POST(urlLogout, registeredHandlers.Then(webserver.logoutHandler))
 
+	router.GET(urlAccountExport, registeredHandlers.Then(webserver.accountExportHandler))
+
+	router.GET(urlEvents, streamHandlers.Then(webserver.eventsHandler))
+
+	router.GET(urlAdminUsers, adminHandlers.Then(webserver.adminUsersHandler))
+	router.GET(urlAdminUsers+"/:userId", adminHandlers.Then(webserver.adminUserHandler))
+	router.POST(urlAdminUsers+"/:userId/refresh", adminHandlers.Then(webserver.adminRefreshHandler))
+	router.POST(urlAdminUsers+"/:userId/crawler/disable", adminHandlers.Then(webserver.adminDisableCrawlerHandler))
+	router.POST(urlAdminUsers+"/:userId/crawler/enable", adminHandlers.Then(webserver.adminEnableCrawlerHandler))
+	router.POST(urlAdminUsers+"/:userId/impersonate", adminHandlers.Then(webserver.adminImpersonateHandler))
+	router.GET(urlAdminJobs+"/:jobId", adminHandlers.Then(webserver.adminJobHandler))
+
 	return webserver
 }
 
@@ -162,7 +215,7 @@ func (server *Webserver) loginHandler(ctx context.Context, w http.ResponseWriter
 	request := &loginRequest{}
 	err := readJSON(r, request)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
@@ -170,11 +223,11 @@ func (server *Webserver) loginHandler(ctx context.Context, w http.ResponseWriter
 
 	// Check if the user exists.
 	user, passHash, err := server.userStore.GetUserForLogin(request.Email)
-	if err != nil {
-		server.serverError(w, err)
+	if err != nil && err != store.ErrNotFound {
+		server.handleError(w, err)
 		return
 	}
-	if user == nil {
+	if err == store.ErrNotFound {
 		// If the user is not found returns an invalid login status.
 		response := &loginResponse{
 			Status: statusInvalidLogin,
@@ -182,16 +235,16 @@ func (server *Webserver) loginHandler(ctx context.Context, w http.ResponseWriter
 		}
 		err = sendJSON(w, response)
 		if err != nil {
-			server.serverError(w, err)
+			server.handleError(w, err)
 		}
 		log.Printf("Invalid login attempt. Email: %s, IP: %s", request.Email, r.RemoteAddr)
 		return
 	}
 
 	// At this point we have a valid email, check the password.
-	res, err := crypto.CompareHashAndPassword(passHash, request.Password)
+	res, err := server.passwordHasher.Compare(passHash, request.Password)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 	if !res {
@@ -202,17 +255,23 @@ func (server *Webserver) loginHandler(ctx context.Context, w http.ResponseWriter
 		}
 		err = sendJSON(w, response)
 		if err != nil {
-			server.serverError(w, err)
+			server.handleError(w, err)
 		}
 
 		log.Println("Invalid password.")
 		return
 	}
 
-	// Good password, start the session and returns user info.
+	// Good password, hash it again if the hashing policy changed since it
+	// was hashed.
+	if server.passwordHasher.NeedsRehash(passHash) {
+		server.rehashPassword(user.ID, request.Password)
+	}
+
+	// Start the session and returns user info.
 	token, err := server.createSession(w, r, user.ID)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
@@ -223,41 +282,47 @@ func (server *Webserver) loginHandler(ctx context.Context, w http.ResponseWriter
 			Email:     user.Email,
 			FirstName: user.FirstName,
 			LastName:  user.LastName,
+			Roles:     user.Roles,
 		},
 	}
 
 	err = sendJSON(w, response)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 	}
 
 	log.Printf("Succesful login for user %s", user.Email)
 }
 
+// rehashPassword saves a new hash of the password of a user. The login
+// still succeeds if it fails, the password is hashed again at the next
+// login.
+func (server *Webserver) rehashPassword(userID string, password string) {
+	passwordHash, err := server.passwordHasher.Hash(password)
+	if err == nil {
+		err = server.userStore.UpdatePassword(userID, passwordHash)
+	}
+	if err != nil {
+		log.Printf("Error rehashing the password of user %s: %v", userID, err)
+	}
+}
+
 func (server *Webserver) registerHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	request := &registerRequest{}
 	err := readJSON(r, request)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
 	// Make sure the email is not already used.
-	user, _, err := server.userStore.GetUserForLogin(request.Email)
-	if err != nil {
-		server.serverError(w, err)
+	_, _, err = server.userStore.GetUserForLogin(request.Email)
+	if err == nil {
+		server.sendInvalidEmail(w)
 		return
 	}
-	if user != nil {
-		// Send an invalid email response.
-		response := &registerResponse{
-			Status: statusInvalidEmail,
-		}
-
-		err = sendJSON(w, response)
-		if err != nil {
-			server.serverError(w, err)
-		}
+	if err != store.ErrNotFound {
+		server.handleError(w, err)
 		return
 	}
 
@@ -265,29 +330,34 @@ func (server *Webserver) registerHandler(ctx context.Context, w http.ResponseWri
 
 	// Here all the registration infos are good, create the user.
 	// Hash the password for storage.
-	passwordHash, err := crypto.GenerateFromPassword(request.Password)
+	passwordHash, err := server.passwordHasher.Hash(request.Password)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
-	user = &api.User{
+	user := &api.User{
 		Email:     request.Email,
 		FirstName: request.FirstName,
 		LastName:  request.LastName,
 	}
 
 	// Create the user in the datastore.
+	// The email can still be taken by a concurrent registration.
 	err = server.userStore.CreateUser(user, passwordHash)
+	if err == store.ErrDuplicate {
+		server.sendInvalidEmail(w)
+		return
+	}
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
 	// Once registration is succesful create a session.
 	token, err := server.createSession(w, r, user.ID)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
@@ -299,16 +369,29 @@ func (server *Webserver) registerHandler(ctx context.Context, w http.ResponseWri
 			user.Email,
 			user.FirstName,
 			user.LastName,
+			user.Roles,
 		},
 	}
 	err = sendJSON(w, response)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 	}
 
 	log.Printf("Succesful registration for user %s", user.Email)
 }
 
+// sendInvalidEmail sends the register response for an email that is
+// already used.
+func (server *Webserver) sendInvalidEmail(w http.ResponseWriter) {
+	response := &registerResponse{
+		Status: statusInvalidEmail,
+	}
+	err := sendJSON(w, response)
+	if err != nil {
+		server.handleError(w, err)
+	}
+}
+
 func (server *Webserver) logoutHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	//userID := getUserID(ctx)
 
@@ -320,7 +403,11 @@ func (server *Webserver) resultsHandler(ctx context.Context, w http.ResponseWrit
 	userID := getUserID(ctx)
 	results, err := server.userResultsStore.GetResults(userID)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
+		return
+	}
+
+	if notModified(w, r, results.Version) {
 		return
 	}
 
@@ -337,7 +424,7 @@ func (server *Webserver) resultsHandler(ctx context.Context, w http.ResponseWrit
 
 	err = sendJSON(w, response)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 	}
 }
 
@@ -345,13 +432,23 @@ func (server *Webserver) crawlerGetConfigHandler(ctx context.Context, w http.Res
 	userID := getUserID(ctx)
 	config, err := server.crawlerConfigStore.GetCrawlerConfig(userID)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
+		return
+	}
+
+	if notModified(w, r, config.Version) {
 		return
 	}
 
+	// Administrators impersonating the user can't see their credentials.
+	if len(getSession(ctx).ImpersonatorID) > 0 {
+		config.Code = ""
+		config.Nip = ""
+	}
+
 	err = sendJSON(w, config)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 	}
 }
 
@@ -359,7 +456,7 @@ func (server *Webserver) crawlerSaveConfigHandler(ctx context.Context, w http.Re
 	request := &api.CrawlerConfig{}
 	err := readJSON(r, request)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
@@ -368,7 +465,19 @@ func (server *Webserver) crawlerSaveConfigHandler(ctx context.Context, w http.Re
 	userID := getUserID(ctx)
 	config, err := server.crawlerConfigStore.GetCrawlerConfig(userID)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
+		return
+	}
+
+	// If the client sent the version it based its changes on, make sure
+	// nobody changed the config since.
+	version, ok, err := ifMatchVersion(r)
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+	if ok && version != config.Version {
+		server.handleError(w, newPreconditionFailedError())
 		return
 	}
 
@@ -379,22 +488,28 @@ func (server *Webserver) crawlerSaveConfigHandler(ctx context.Context, w http.Re
 
 	err = server.crawlerConfigStore.UpdateCrawlerConfig(config)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
+		return
 	}
+	setETag(w, config.Version)
 }
 
 func (server *Webserver) crawlerGetClassesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(ctx)
 	results, err := server.userResultsStore.GetResults(userID)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
+		return
+	}
+
+	if notModified(w, r, results.Version) {
 		return
 	}
 
 	response := getClassesModel(results.Classes)
 	err = sendJSON(w, response)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 	}
 }
 
@@ -402,36 +517,25 @@ func (server *Webserver) crawlerCreateClassHandler(ctx context.Context, w http.R
 	request := crawlerConfigClassModel{}
 	err := readJSON(r, &request)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
 	userID := getUserID(ctx)
-	results, err := server.userResultsStore.GetResults(userID)
-	if err != nil {
-		server.serverError(w, err)
-		return
-	}
-	log.Printf("%+v", results)
-
-	classID := bson.NewObjectId().Hex()
-
-	results.Classes = append(results.Classes, api.Class{
-		ID:    classID,
+	class := &api.Class{
 		Name:  request.Name,
 		Group: request.Group,
 		Year:  request.Year,
-	})
-
-	err = server.userResultsStore.UpdateResults(results)
+	}
+	err = server.userResultsStore.AddClass(userID, class)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
-	request.ID = classID
-	err = sendJSON(w, &request)
+
+	err = sendJSON(w, getClassModel(class))
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 	}
 }
 
@@ -442,32 +546,25 @@ func (server *Webserver) crawlerEditClassHandler(ctx context.Context, w http.Res
 	request := crawlerConfigClassModel{}
 	err := readJSON(r, &request)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
 	userID := getUserID(ctx)
-	results, err := server.userResultsStore.GetResults(userID)
+	class, err := server.userResultsStore.UpdateClass(userID, &api.Class{
+		ID:    classID,
+		Name:  request.Name,
+		Group: request.Group,
+		Year:  request.Year,
+	})
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 		return
 	}
 
-	for i, c := range results.Classes {
-		if c.ID == classID {
-			results.Classes[i] = api.Class{
-				ID:    c.ID,
-				Name:  request.Name,
-				Group: request.Group,
-				Year:  request.Year,
-			}
-			break
-		}
-	}
-
-	err = server.userResultsStore.UpdateResults(results)
+	err = sendJSON(w, getClassModel(class))
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 	}
 }
 
@@ -476,47 +573,74 @@ func (server *Webserver) crawlerDeleteClassHandler(ctx context.Context, w http.R
 	classID := params.ByName("classId")
 
 	userID := getUserID(ctx)
-	results, err := server.userResultsStore.GetResults(userID)
+	err := server.userResultsStore.RemoveClass(userID, classID)
 	if err != nil {
-		server.serverError(w, err)
-		return
+		server.handleError(w, err)
 	}
+}
 
-	log.Printf("before: %v", results.Classes)
-
-	for i, c := range results.Classes {
-		if c.ID == classID {
-			results.Classes = append(results.Classes[:i], results.Classes[i+1:]...)
-			break
-		}
+func (server *Webserver) crawlerRefreshHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(ctx)
+	if ok, wait := server.refreshLimiter.allow(userID); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		server.handleError(w, newTooManyRequestsError())
+		return
 	}
 
-	log.Printf("after: %v", results.Classes)
+	job, err := server.crawlerClient.Refresh(userID)
+	if err != nil {
+		// The refresh was not queued so it doesn't count.
+		server.refreshLimiter.release(userID)
+		server.handleError(w, err)
+		return
+	}
 
-	err = server.userResultsStore.UpdateResults(results)
+	w.Header().Set("Location", urlCrawlerRefresh+"/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	err = sendJSON(w, job)
 	if err != nil {
-		server.serverError(w, err)
+		server.handleError(w, err)
 	}
 }
 
-func (server *Webserver) crawlerRefreshHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+func (server *Webserver) crawlerRefreshJobHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := ws.Params(ctx)
+	jobID := params.ByName("jobId")
+
 	userID := getUserID(ctx)
-	if err := server.crawlerClient.Refresh(userID); err != nil {
-		server.serverError(w, err)
+	job, err := server.crawlerClient.RefreshJob(jobID)
+	if err != nil {
+		server.handleError(w, err)
+		return
+	}
+	// Users can only see their own jobs.
+	if job.UserID != userID {
+		server.handleError(w, api.ErrJobNotFound)
+		return
+	}
+
+	err = sendJSON(w, job)
+	if err != nil {
+		server.handleError(w, err)
 	}
 }
 
 // Middlewares
 func (server *Webserver) authMiddleware(next ws.Handler) ws.Handler {
 	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-		userID, err := server.getSessionUserID(r)
+		session, err := server.getSession(r)
 		if err != nil {
 			log.Println(err)
 			server.authError(w)
 			return
 		}
+		if len(session.ImpersonatorID) > 0 && r.Method != "GET" && r.Method != "HEAD" {
+			server.handleError(w, newForbiddenError("Impersonation sessions are read-only"))
+			return
+		}
 
-		ctx = context.WithValue(ctx, userKey, userID)
+		ctx = context.WithValue(ctx, userKey, session.UserID)
+		ctx = context.WithValue(ctx, sessionKey, session)
 
 		next.ServeHTTP(ctx, w, r)
 	}
@@ -529,7 +653,7 @@ func (server *Webserver) errorMiddleware(next ws.Handler) ws.Handler {
 		defer func() {
 			if err := recover(); err != nil {
 				log.Printf("panic: %+v\n%s", err, debug.Stack())
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				sendError(w, newInternalError())
 			}
 		}()
 
@@ -541,11 +665,12 @@ func (server *Webserver) errorMiddleware(next ws.Handler) ws.Handler {
 
 func (server *Webserver) logMiddleware(next ws.Handler) ws.Handler {
 	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-		log.Printf("Request start %s", r.URL.String())
+		requestID := w.Header().Get(headerRequestID)
+		log.Printf("Request start %s %s", requestID, r.URL.String())
 		start := time.Now()
 		defer func() {
 			elapsed := time.Since(start)
-			log.Printf("Request end %s. Took %.f ms.", r.URL.String(), elapsed.Seconds()*1000)
+			log.Printf("Request end %s %s. Took %.f ms.", requestID, r.URL.String(), elapsed.Seconds()*1000)
 		}()
 		next.ServeHTTP(ctx, w, r)
 	}
@@ -553,27 +678,41 @@ func (server *Webserver) logMiddleware(next ws.Handler) ws.Handler {
 	return ws.HandlerFunc(fn)
 }
 
+// requestIDMiddleware tags every request with a random id. It is sent back
+// in the X-Request-ID header and in error responses to help match client
+// reports with the server logs.
+func (server *Webserver) requestIDMiddleware(next ws.Handler) ws.Handler {
+	fn := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerRequestID, hex.EncodeToString(crypto.GenerateRandomKey(8)))
+
+		next.ServeHTTP(ctx, w, r)
+	}
+
+	return ws.HandlerFunc(fn)
+}
+
 // Session helpers
-func (server *Webserver) getSessionUserID(r *http.Request) (string, error) {
+func (server *Webserver) getSession(r *http.Request) (*session, error) {
 	tokenHeader := r.Header.Get(headerName)
 	// validate the token
 	token, err := jwt.Parse(tokenHeader, func(token *jwt.Token) (interface{}, error) {
 		return server.rsaPublic, nil
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if !token.Valid {
-		return "", ErrUnauthorized
+		return nil, ErrUnauthorized
 	}
 
 	userID, ok := token.Claims[sessionUserIDKey].(string)
 	if !ok || len(userID) == 0 {
-		return "", ErrUnauthorized
+		return nil, ErrUnauthorized
 	}
+	impersonatorID, _ := token.Claims[sessionImpersonatorKey].(string)
 
-	return userID, nil
+	return &session{userID, impersonatorID}, nil
 }
 
 func (server *Webserver) createSession(w http.ResponseWriter, r *http.Request, userID string) (string, error) {
@@ -586,6 +725,16 @@ func (server *Webserver) createSession(w http.ResponseWriter, r *http.Request, u
 	return token.SignedString(server.rsaPrivate)
 }
 
+// createImpersonationSession creates a read-only session for userID used by
+// the admin impersonatorID. It expires after ttl.
+func (server *Webserver) createImpersonationSession(userID, impersonatorID string, ttl time.Duration) (string, error) {
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims[sessionUserIDKey] = userID
+	token.Claims[sessionImpersonatorKey] = impersonatorID
+	token.Claims[sessionExpiresKey] = time.Now().Add(ttl).Unix()
+	return token.SignedString(server.rsaPrivate)
+}
+
 func (server *Webserver) endSession(w http.ResponseWriter, r *http.Request) error {
 	// Nothing to do here anymore.
 	return nil
@@ -594,12 +743,21 @@ func (server *Webserver) endSession(w http.ResponseWriter, r *http.Request) erro
 // Error helpers
 func (server *Webserver) authError(w http.ResponseWriter) {
 	log.Println("Unauthorized request attempt")
-	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	sendError(w, &apiError{
+		Status:  http.StatusUnauthorized,
+		Code:    codeUnauthorized,
+		Message: http.StatusText(http.StatusUnauthorized),
+	})
 }
 
-func (server *Webserver) serverError(w http.ResponseWriter, err error) {
-	log.Println(err)
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+// handleError sends the error to the client. Errors that are not the
+// client's fault are logged.
+func (server *Webserver) handleError(w http.ResponseWriter, err error) {
+	apiErr := toAPIError(err)
+	if apiErr.Status == http.StatusInternalServerError {
+		log.Printf("Request %s failed: %s", w.Header().Get(headerRequestID), err)
+	}
+	sendError(w, apiErr)
 }
 
 // JSON helpers
@@ -607,13 +765,16 @@ func readJSON(r *http.Request, obj interface{}) error {
 	defer r.Body.Close()
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 	if err != nil {
-		return err
+		return newDecodeError(err)
 	}
 	err = r.Body.Close()
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(body, obj)
+	if err = json.Unmarshal(body, obj); err != nil {
+		return newDecodeError(err)
+	}
+	return nil
 }
 
 func sendJSON(w http.ResponseWriter, obj interface{}) error {
@@ -628,6 +789,49 @@ func sendJSON(w http.ResponseWriter, obj interface{}) error {
 	return err
 }
 
+// ETag helpers
+
+// setETag sets the ETag header from the version of the resource.
+func setETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", fmt.Sprintf("\"%d\"", version))
+}
+
+// notModified sets the ETag header and returns true with a 304 status if
+// the client already has this version of the resource.
+func notModified(w http.ResponseWriter, r *http.Request, version int) bool {
+	setETag(w, version)
+	if r.Header.Get("If-None-Match") == w.Header().Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// ifMatchVersion returns the version in the If-Match header. The boolean is
+// false if the header is absent or matches any version.
+func ifMatchVersion(r *http.Request) (int, bool, error) {
+	header := r.Header.Get("If-Match")
+	if len(header) == 0 || header == "*" {
+		return 0, false, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), "\""))
+	if err != nil {
+		return 0, false, newBadRequestError("Invalid If-Match header", fieldError{
+			Field:   "If-Match",
+			Message: "Expected an ETag returned by the server",
+		})
+	}
+	return version, true, nil
+}
+
+func getSession(ctx context.Context) *session {
+	s, ok := ctx.Value(sessionKey).(*session)
+	if !ok {
+		panic("No session in context. Make sure the handler is authentified")
+	}
+	return s
+}
+
 func getUserID(ctx context.Context) string {
 	userID, ok := ctx.Value(userKey).(string)
 	if !ok {
@@ -639,13 +843,17 @@ func getUserID(ctx context.Context) string {
 // Model helpers
 func getClassesModel(classes []api.Class) []*crawlerConfigClassModel {
 	result := make([]*crawlerConfigClassModel, len(classes))
-	for i, c := range classes {
-		result[i] = &crawlerConfigClassModel{
-			ID:    c.ID,
-			Name:  c.Name,
-			Group: c.Group,
-			Year:  c.Year,
-		}
+	for i := range classes {
+		result[i] = getClassModel(&classes[i])
 	}
 	return result
 }
+
+func getClassModel(class *api.Class) *crawlerConfigClassModel {
+	return &crawlerConfigClassModel{
+		ID:    class.ID,
+		Name:  class.Name,
+		Group: class.Group,
+		Year:  class.Year,
+	}
+}
@@ -1,14 +1,25 @@
 package webserver
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
 
 	"github.com/janicduplessis/resultscrawler/pkg/api"
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/events"
 	"github.com/janicduplessis/resultscrawler/pkg/store/fakestore"
 )
 
@@ -44,9 +55,10 @@ func TestLoginGood(t *testing.T) {
 	ts, webserver := initServer()
 	defer ts.Close()
 
+	passwordHash, _ := crypto.GenerateFromPassword("h4ck3r")
 	webserver.userStore.CreateUser(&api.User{
 		Email: "420blazeit@gmail.com",
-	}, "h4ck3r")
+	}, passwordHash)
 
 	request := loginRequest{
 		Email:      "420blazeit@gmail.com",
@@ -72,11 +84,666 @@ func TestLoginGood(t *testing.T) {
 	}
 }
 
+func TestLoginRehash(t *testing.T) {
+	ts, webserver := initServer()
+	defer ts.Close()
+
+	// The password was hashed with bcrypt, the server now uses argon2id.
+	passwordHash, _ := crypto.GenerateFromPassword("h4ck3r")
+	u := &api.User{Email: "420blazeit@gmail.com"}
+	webserver.userStore.CreateUser(u, passwordHash)
+	hasher, err := crypto.NewPasswordHasher(&crypto.PasswordConfig{
+		Algorithm:     crypto.AlgorithmArgon2id,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webserver.passwordHasher = hasher
+
+	request := loginRequest{Email: u.Email, Password: "h4ck3r"}
+	for i := 0; i < 2; i++ {
+		res, err := post(ts.URL+urlLogin, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := &loginResponse{}
+		if err = parse(res, response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Status != statusOK {
+			t.Errorf("Bad login status %d, should be %d", response.Status, statusOK)
+		}
+		_, hash, err := webserver.userStore.GetUserForLogin(u.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasher.NeedsRehash(hash) {
+			t.Errorf("Password was not rehashed, hash is %s", hash)
+		}
+	}
+}
+
+func TestAccountExport(t *testing.T) {
+	ts, webserver := initServer()
+	defer ts.Close()
+
+	user := &api.User{
+		Email: "export@gmail.com",
+	}
+	webserver.userStore.CreateUser(user, "pass")
+	config, _ := webserver.crawlerConfigStore.GetCrawlerConfig(user.ID)
+	config.Code = "ABCD12345678"
+	config.Nip = "12345"
+	webserver.crawlerConfigStore.UpdateCrawlerConfig(config)
+	webserver.userResultsStore.AddChanges(user.ID, []api.ResultsChange{
+		{Time: time.Now(), Class: api.Class{ID: "1", Name: "MAT1600", Final: "A"}},
+	})
+	token, _ := webserver.createSession(nil, nil, user.ID)
+
+	res, err := get(ts.URL+urlAccountExport, token)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusOK)
+		return
+	}
+	response := &accountExport{}
+	if err = parse(res, response); err != nil {
+		t.Error(err)
+		return
+	}
+	if response.User == nil || response.User.Email != user.Email {
+		t.Errorf("Unexpected user %+v in export", response.User)
+	}
+	if response.CrawlerConfig.Code != redacted || response.CrawlerConfig.Nip != redacted {
+		t.Errorf("Credentials not redacted in export %+v", response.CrawlerConfig)
+	}
+	if len(response.History) != 1 || response.History[0].Class.Final != "A" {
+		t.Errorf("Bad history %+v in export", response.History)
+	}
+	config, _ = webserver.crawlerConfigStore.GetCrawlerConfig(user.ID)
+	if config.Code != "ABCD12345678" {
+		t.Error("Export modified the stored crawler config")
+	}
+}
+
+func TestAccountExportCSV(t *testing.T) {
+	ts, webserver := initServer()
+	defer ts.Close()
+
+	user := &api.User{Email: "export@gmail.com"}
+	webserver.userStore.CreateUser(user, "pass")
+	userResults, _ := webserver.userResultsStore.GetResults(user.ID)
+	userResults.Classes = []api.Class{
+		{
+			Name:  "INF1120",
+			Group: "10",
+			Year:  "20153",
+			Results: []api.Result{{
+				Name:     "Intra",
+				Normal:   api.ResultInfo{Result: "80", Average: "70", StandardDev: "10"},
+				Weighted: api.ResultInfo{Result: "24", Average: "21", StandardDev: "3"},
+			}},
+			Total: api.ResultInfo{Result: "80", Average: "70", StandardDev: "10"},
+			Final: "A",
+		},
+		{Name: "MAT1600", Group: "20", Year: "20151"},
+	}
+	webserver.userResultsStore.(*fakestore.FakeStore).SetResults(userResults)
+	token, _ := webserver.createSession(nil, nil, user.ID)
+
+	res, err := get(ts.URL+urlAccountExport+"?format=csv", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Bad status code %d, should be %d", res.StatusCode, http.StatusOK)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string][][]string)
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+		if f.Name == exportJSONName {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := csv.NewReader(r).ReadAll()
+		r.Close()
+		if err != nil {
+			t.Fatalf("Bad csv %s: %v", f.Name, err)
+		}
+		files[f.Name] = rows
+	}
+	expectedNames := []string{exportJSONName, "results-20151.csv", "results-20153.csv"}
+	if strings.Join(names, ",") != strings.Join(expectedNames, ",") {
+		t.Errorf("Bad archive files %v, should be %v", names, expectedNames)
+	}
+
+	expected := map[string][][]string{
+		"results-20151.csv": {
+			exportCSVHeader,
+			{"MAT1600", "20", "Total", "", "", "", "", "", ""},
+		},
+		"results-20153.csv": {
+			exportCSVHeader,
+			{"INF1120", "10", "Intra", "80", "70", "10", "24", "21", "3"},
+			{"INF1120", "10", "Total", "80", "70", "10", "", "", ""},
+			{"INF1120", "10", "Final", "A", "", "", "", "", ""},
+		},
+	}
+	for name, rows := range expected {
+		got := files[name]
+		if len(got) != len(rows) {
+			t.Errorf("Bad number of rows %d in %s, should be %d", len(got), name, len(rows))
+			continue
+		}
+		for i := range rows {
+			if strings.Join(got[i], ",") != strings.Join(rows[i], ",") {
+				t.Errorf("Bad row %d in %s: %v, should be %v", i, name, got[i], rows[i])
+			}
+		}
+	}
+}
+
+func TestInvalidRequestBody(t *testing.T) {
+	ts, _ := initServer()
+	defer ts.Close()
+
+	res, err := post(ts.URL+urlLogin, map[string]int{"email": 1})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusBadRequest)
+		return
+	}
+	response := &errorResponse{}
+	if err = parse(res, response); err != nil {
+		t.Error(err)
+		return
+	}
+	apiErr := response.Error
+	if apiErr == nil || apiErr.Code != codeBadRequest || len(apiErr.RequestID) == 0 {
+		t.Errorf("Unexpected error response %+v", apiErr)
+		return
+	}
+	if len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "email" {
+		t.Errorf("Unexpected field errors %+v, expected an error for email", apiErr.Fields)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	ts, _ := initServer()
+	defer ts.Close()
+
+	res, err := get(ts.URL+urlCrawlerConfig, "invalid")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusUnauthorized)
+		return
+	}
+	response := &errorResponse{}
+	if err = parse(res, response); err != nil {
+		t.Error(err)
+		return
+	}
+	if response.Error == nil || response.Error.Code != codeUnauthorized {
+		t.Errorf("Unexpected error response %+v", response.Error)
+	}
+}
+
+func TestEditClass(t *testing.T) {
+	ts, webserver := initServer()
+	defer ts.Close()
+
+	user := &api.User{
+		Email: "class@gmail.com",
+	}
+	webserver.userStore.CreateUser(user, "pass")
+	results, _ := webserver.userResultsStore.GetResults(user.ID)
+	results.Classes = []api.Class{
+		api.Class{
+			ID:    "classid",
+			Name:  "MAT1600",
+			Group: "20",
+			Year:  "20151",
+			Results: []api.Result{
+				api.Result{Name: "Exam 1"},
+			},
+			Final: "A",
+		},
+	}
+	webserver.userResultsStore.(*fakestore.FakeStore).SetResults(results)
+	token, _ := webserver.createSession(nil, nil, user.ID)
+
+	// Same class, the results must be kept.
+	request := &crawlerConfigClassModel{Name: "MAT1600", Group: "20", Year: "20151"}
+	res, err := do("PUT", ts.URL+urlCrawlerClass+"/classid", token, request)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusOK)
+		return
+	}
+	response := &crawlerConfigClassModel{}
+	if err = parse(res, response); err != nil {
+		t.Error(err)
+		return
+	}
+	if response.ID != "classid" || response.Name != "MAT1600" {
+		t.Errorf("Unexpected class %+v", response)
+	}
+	results, _ = webserver.userResultsStore.GetResults(user.ID)
+	if len(results.Classes[0].Results) != 1 || results.Classes[0].Final != "A" {
+		t.Errorf("Results were cleared for the same class %+v", results.Classes[0])
+	}
+
+	// Different group, the results must be cleared.
+	request.Group = "30"
+	res, err = do("PUT", ts.URL+urlCrawlerClass+"/classid", token, request)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	results, _ = webserver.userResultsStore.GetResults(user.ID)
+	if len(results.Classes[0].Results) != 0 || results.Classes[0].Group != "30" {
+		t.Errorf("Results were not cleared for a different class %+v", results.Classes[0])
+	}
+}
+
+func TestEditDeleteUnknownClass(t *testing.T) {
+	ts, webserver := initServer()
+	defer ts.Close()
+
+	user := &api.User{
+		Email: "unknown@gmail.com",
+	}
+	webserver.userStore.CreateUser(user, "pass")
+	token, _ := webserver.createSession(nil, nil, user.ID)
+
+	request := &crawlerConfigClassModel{Name: "MAT1600", Group: "20", Year: "20151"}
+	res, err := do("PUT", ts.URL+urlCrawlerClass+"/unknown", token, request)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Bad status code %d for edit, should be %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	res, err = do("DELETE", ts.URL+urlCrawlerClass+"/unknown", token, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Bad status code %d for delete, should be %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestCrawlerConfigVersion(t *testing.T) {
+	ts, webserver := initServer()
+	defer ts.Close()
+
+	user := &api.User{
+		Email: "version@gmail.com",
+	}
+	webserver.userStore.CreateUser(user, "pass")
+	token, _ := webserver.createSession(nil, nil, user.ID)
+
+	res, err := get(ts.URL+urlCrawlerConfig, token)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+	if etag != `"0"` {
+		t.Errorf("Unexpected ETag %s, expected \"0\"", etag)
+		return
+	}
+
+	// Not modified.
+	req, _ := http.NewRequest("GET", ts.URL+urlCrawlerConfig, nil)
+	req.Header.Set(headerName, token)
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusNotModified)
+	}
+
+	// Save with the current version.
+	config := &api.CrawlerConfig{Code: "ABCD12345678", Nip: "12345", Status: true}
+	save := func() (*http.Response, error) {
+		data, _ := json.Marshal(config)
+		req, _ := http.NewRequest("POST", ts.URL+urlCrawlerConfig, bytes.NewReader(data))
+		req.Header.Set(headerName, token)
+		req.Header.Set("If-Match", etag)
+		return http.DefaultClient.Do(req)
+	}
+	res, err = save()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") != `"1"` {
+		t.Errorf("Bad status code %d and ETag %s, should be %d and \"1\"", res.StatusCode, res.Header.Get("ETag"), http.StatusOK)
+	}
+
+	// Save again with the outdated version.
+	res, err = save()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusPreconditionFailed)
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	ts, webserver := initServer()
+	defer ts.Close()
+
+	user := &api.User{
+		Email: "events@gmail.com",
+	}
+	webserver.userStore.CreateUser(user, "pass")
+	token, _ := webserver.createSession(nil, nil, user.ID)
+
+	res, err := http.Get(ts.URL + urlEvents + "?token=" + token)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusOK)
+		return
+	}
+
+	// Events for other users must not be sent.
+	webserver.eventBus.Publish(events.NewEvent(events.NewResults, "otheruser"))
+	webserver.eventBus.Publish(events.NewEvent(events.NewResults, user.ID))
+
+	reader := bufio.NewReader(res.Body)
+	name, _ := reader.ReadString('\n')
+	data, _ := reader.ReadString('\n')
+	if name != "event: new-results\n" {
+		t.Errorf("Unexpected event name %q", name)
+	}
+	event := &events.Event{}
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), event); err != nil {
+		t.Error(err)
+		return
+	}
+	if event.UserID != user.ID {
+		t.Errorf("Received an event for another user %+v", event)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	ts, webserver := initServer()
+	defer ts.Close()
+
+	user := &api.User{
+		Email: "refresh@gmail.com",
+	}
+	webserver.userStore.CreateUser(user, "pass")
+	token, _ := webserver.createSession(nil, nil, user.ID)
+
+	// A failed refresh doesn't count for the rate limit.
+	crawlerClient := webserver.crawlerClient.(*FakeCrawlerClient)
+	crawlerClient.err = errors.New("Crawler unavailable")
+	res, err := do("POST", ts.URL+urlCrawlerRefresh, token, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusInternalServerError)
+	}
+	crawlerClient.err = nil
+
+	res, err = do("POST", ts.URL+urlCrawlerRefresh, token, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusAccepted {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusAccepted)
+		return
+	}
+	job := &api.RefreshJob{}
+	if err = parse(res, job); err != nil {
+		t.Error(err)
+		return
+	}
+	if res.Header.Get("Location") != urlCrawlerRefresh+"/"+job.ID {
+		t.Errorf("Unexpected location %s", res.Header.Get("Location"))
+	}
+
+	// Refreshing again right away is not allowed.
+	res, err = do("POST", ts.URL+urlCrawlerRefresh, token, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests || len(res.Header.Get("Retry-After")) == 0 {
+		t.Errorf("Bad status code %d, should be %d with a Retry-After header", res.StatusCode, http.StatusTooManyRequests)
+	}
+
+	res, err = get(ts.URL+urlCrawlerRefresh+"/"+job.ID, token)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusOK)
+		return
+	}
+	job = &api.RefreshJob{}
+	if err = parse(res, job); err != nil {
+		t.Error(err)
+		return
+	}
+	if job.Status != api.JobDone {
+		t.Errorf("Unexpected job status %s", job.Status)
+	}
+
+	// Other users can't see the job.
+	otherToken, _ := webserver.createSession(nil, nil, "otheruser")
+	res, err = get(ts.URL+urlCrawlerRefresh+"/"+job.ID, otherToken)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Bad status code %d, should be %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	ts, webserver := initServer()
+	defer ts.Close()
+
+	admin := &api.User{
+		Email: "admin@gmail.com",
+		Roles: []string{api.RoleAdmin},
+	}
+	webserver.userStore.CreateUser(admin, "pass")
+	adminToken, _ := webserver.createSession(nil, nil, admin.ID)
+	user := &api.User{
+		Email:     "student@gmail.com",
+		FirstName: "Some",
+		LastName:  "Student",
+	}
+	webserver.userStore.CreateUser(user, "pass")
+	userToken, _ := webserver.createSession(nil, nil, user.ID)
+
+	expectStatus := func(method, url, token string, status int) *http.Response {
+		res, err := do(method, ts.URL+url, token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Errorf("%s %s: Bad status code %d, should be %d", method, url, res.StatusCode, status)
+		}
+		return res
+	}
+
+	// Regular users can't use the admin api.
+	expectStatus("GET", urlAdminUsers, userToken, http.StatusForbidden).Body.Close()
+
+	var res *http.Response
+	var users *adminUsersResponse
+	for _, search := range []string{"STU", "some", "student"} {
+		res = expectStatus("GET", urlAdminUsers+"?q="+search, adminToken, http.StatusOK)
+		users = &adminUsersResponse{}
+		if err := parse(res, users); err != nil {
+			t.Fatal(err)
+		}
+		if len(users.Users) != 1 || users.Users[0].ID != user.ID || len(users.Next) > 0 {
+			t.Errorf("Unexpected users for %s %+v", search, users)
+		}
+	}
+
+	// Get all users one at a time.
+	var ids []string
+	next := ""
+	for i := 0; i < 3; i++ {
+		res = expectStatus("GET", urlAdminUsers+"?limit=1&after="+next, adminToken, http.StatusOK)
+		users = &adminUsersResponse{}
+		if err := parse(res, users); err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range users.Users {
+			ids = append(ids, u.ID)
+		}
+		next = users.Next
+		if len(next) == 0 {
+			break
+		}
+	}
+	if len(ids) != 2 || ids[0] == ids[1] {
+		t.Errorf("Unexpected users %v", ids)
+	}
+
+	// Unknown and malformed user ids.
+	expectStatus("GET", urlAdminUsers+"/"+bson.NewObjectId().Hex(), adminToken, http.StatusNotFound).Body.Close()
+	expectStatus("GET", urlAdminUsers+"/invalid", adminToken, http.StatusBadRequest).Body.Close()
+
+	res = expectStatus("POST", urlAdminUsers+"/"+user.ID+"/crawler/disable", adminToken, http.StatusOK)
+	details := &adminUserDetailsModel{}
+	if err := parse(res, details); err != nil {
+		t.Fatal(err)
+	}
+	if details.ID != user.ID || details.Crawler == nil || !details.Crawler.Disabled {
+		t.Errorf("Unexpected user details %+v", details)
+	}
+	config, _ := webserver.crawlerConfigStore.GetCrawlerConfig(user.ID)
+	if !config.Disabled {
+		t.Error("Crawler should be disabled")
+	}
+
+	res = expectStatus("POST", urlAdminUsers+"/"+user.ID+"/refresh", adminToken, http.StatusAccepted)
+	job := &api.RefreshJob{}
+	if err := parse(res, job); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus("GET", urlAdminJobs+"/"+job.ID, adminToken, http.StatusOK).Body.Close()
+
+	config, _ = webserver.crawlerConfigStore.GetCrawlerConfig(user.ID)
+	config.Code = "ABCD12345678"
+	config.Nip = "12345"
+	webserver.crawlerConfigStore.UpdateCrawlerConfig(config)
+
+	res = expectStatus("POST", urlAdminUsers+"/"+user.ID+"/impersonate", adminToken, http.StatusOK)
+	impersonate := &impersonateResponse{}
+	if err := parse(res, impersonate); err != nil {
+		t.Fatal(err)
+	}
+
+	// Impersonation sessions can read the user data but not change it or
+	// use the admin api.
+	config = &api.CrawlerConfig{}
+	if err := parse(expectStatus("GET", urlCrawlerConfig, impersonate.Token, http.StatusOK), config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Code) > 0 || len(config.Nip) > 0 {
+		t.Errorf("Credentials sent to an impersonation session %+v", config)
+	}
+	config = &api.CrawlerConfig{}
+	if err := parse(expectStatus("GET", urlCrawlerConfig, userToken, http.StatusOK), config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Code != "ABCD12345678" || config.Nip != "12345" {
+		t.Errorf("Credentials not sent to the user %+v", config)
+	}
+	expectStatus("POST", urlCrawlerRefresh, impersonate.Token, http.StatusForbidden).Body.Close()
+	expectStatus("GET", urlAdminUsers, impersonate.Token, http.StatusForbidden).Body.Close()
+}
+
 type FakeCrawlerClient struct {
+	jobs map[string]*api.RefreshJob
+	err  error
 }
 
-func (c *FakeCrawlerClient) Refresh(userID string) error {
-	return nil
+func (c *FakeCrawlerClient) Refresh(userID string) (*api.RefreshJob, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	job := &api.RefreshJob{
+		ID:     "job" + userID,
+		UserID: userID,
+		Status: api.JobQueued,
+	}
+	c.jobs[job.ID] = &api.RefreshJob{ID: job.ID, UserID: userID, Status: api.JobDone}
+	return job, nil
+}
+
+func (c *FakeCrawlerClient) RefreshJob(jobID string) (*api.RefreshJob, error) {
+	job, ok := c.jobs[jobID]
+	if !ok {
+		return nil, api.ErrJobNotFound
+	}
+	return job, nil
 }
 
 func initServer() (*httptest.Server, *Webserver) {
@@ -88,7 +755,8 @@ func initServer() (*httptest.Server, *Webserver) {
 		UserResultsStore:   store,
 		RSAPublic:          []byte(testRSAPublic),
 		RSAPrivate:         []byte(testRSAPrivate),
-		CrawlerClient:      &FakeCrawlerClient{},
+		CrawlerClient:      &FakeCrawlerClient{jobs: make(map[string]*api.RefreshJob)},
+		EventBus:           events.NewLocalBus(),
 	})
 	return httptest.NewServer(webserver.router), webserver
 }
@@ -101,6 +769,27 @@ func post(url string, obj interface{}) (*http.Response, error) {
 	return http.Post(url, "json", bytes.NewReader(data))
 }
 
+func get(url string, token string) (*http.Response, error) {
+	return do("GET", url, token, nil)
+}
+
+func do(method string, url string, token string, obj interface{}) (*http.Response, error) {
+	var body io.Reader
+	if obj != nil {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(headerName, token)
+	return http.DefaultClient.Do(req)
+}
+
 func parse(res *http.Response, obj interface{}) error {
 	defer res.Body.Close()
 	data, err := ioutil.ReadAll(res.Body)
@@ -142,6 +831,12 @@ kT6xp4rzXhjBRCuPoMXCGPnAFKd3NnjWbjwcESG/PgG1XG8M/GyZveWHKU0g3IRY
 ElYGSP02sQk3nGiV5bxi8ikgXjoc1XsrWSUqvYfN2pkG9eXpgGs=
 -----END PRIVATE KEY-----`
 	testRSAPublic = `-----BEGIN PUBLIC KEY-----
-AAAAB3NzaC1yc2EAAAADAQABAAABAQDCvE9/XlrkyRgRI9tEtsVfCweoyOKbpAXos8tHl2aoSnquo1YDoKcwjUgADTIa7LS6Q868uKKWi6FxYnTGfD74bPt+tpenQ/sLQYi+t1ZOoW/5CHf5vr2MadInAwpN4VS8F406NXcjOXKK5xOBSfSS/VM9/AXk6SwhUtWZohqhHHFEzFBWtJBvPRSFpElK94sMgmMoKmwR4zWmZO3EVy2AkK7BLNrgwshOPosZZ2WzzDqeh0IPRCcz+nhV11MWyK9iDAuPDPOTlcfqIyFjM5yj7x7DdjenwYocBEHQr+OY8B1xm7/A90/I9YM5e8QqZ6V8jmrvlWPQQWa3b4/hGZOT
+MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAwrxPf15a5MkYESPbRLbF
+XwsHqMjim6QF6LPLR5dmqEp6rqNWA6CnMI1IAA0yGuy0ukPOvLiilouhcWJ0xnw+
++Gz7fraXp0P7C0GIvrdWTqFv+Qh3+b69jGnSJwMKTeFUvBeNOjV3IzlyiucTgUn0
+kv1TPfwF5OksIVLVmaIaoRxxRMxQVrSQbz0UhaRJSveLDIJjKCpsEeM1pmTtxFct
+gJCuwSza4MLITj6LGWdls8w6nodCD0QnM/p4VddTFsivYgwLjwzzk5XH6iMhYzOc
+o+8ew3Y3p8GKHARB0K/jmPAdcZu/wPdPyPWDOXvEKmelfI5q75Vj0EFmt2+P4RmT
+kwIDAQAB
 -----END PUBLIC KEY-----`
 )
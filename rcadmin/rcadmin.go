@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/secrets"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	boltstore "github.com/janicduplessis/resultscrawler/pkg/store/bolt"
+	"github.com/janicduplessis/resultscrawler/pkg/store/crawlerconfig"
+	"github.com/janicduplessis/resultscrawler/pkg/store/mongo"
+	sqlstore "github.com/janicduplessis/resultscrawler/pkg/store/sql"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
+	"github.com/janicduplessis/resultscrawler/pkg/tools"
+)
+
+// adminStore is implemented by every store backend.
+type adminStore interface {
+	user.Store
+	crawlerconfig.Store
+	store.Migrator
+}
+
+type config struct {
+	// Store is the store backend, mongo, sql or bolt. Mongo is used if it
+	// is empty.
+	Store    string
+	Database *tools.MongoConfig
+	SQL      *sqlstore.Config
+	BoltPath string
+	// The encryption keys, only used by rotate-keys.
+	AESSecretKey  string
+	AESKeyDir     string
+	AESPrimaryKey string
+}
+
+type command struct {
+	Name  string
+	Usage string
+	Run   func(config *config, args []string) error
+}
+
+const (
+	configFile = "config.json"
+
+	storeMongo = "mongo"
+	storeSQL   = "sql"
+	storeBolt  = "bolt"
+)
+
+var (
+	storeBackend = flag.String("store", "", "Store backend, mongo, sql or bolt")
+	sqlDriver    = flag.String("sql-driver", "", "SQL driver, sqlite3 or postgres")
+	sqlDSN       = flag.String("sql-dsn", "", "SQL data source name")
+	boltPath     = flag.String("bolt-path", "", "Bolt database file")
+	dbURL        = flag.String("db-url", "", "DB url")
+	dbUser       = flag.String("db-user", "", "DB user")
+	dbPassword   = flag.String("db-password", "", "DB password")
+	dbName       = flag.String("db-name", "", "DB name")
+	aesSecret    = flag.String("aes-secret", "", "AES secret key")
+	aesKeyDir    = flag.String("aes-key-dir", "", "Directory of the AES key files")
+	aesPrimary   = flag.String("aes-primary-key", "", "Id of the AES key used to encrypt")
+)
+
+var commands = []*command{
+	{"migrate", "Apply the pending database migrations", migrateCommand},
+	{"migrations", "List the database migrations and when they were applied", migrationsCommand},
+	{"backup", "Copy the bolt database to a file: backup <file>", backupCommand},
+	{"rotate-keys", "Encrypt the crawler credentials with the primary AES key", rotateKeysCommand},
+}
+
+func main() {
+	log.SetFlags(0)
+
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			if err := cmd.Run(readConfig(), flag.Args()[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %s\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: rcadmin [flags] <command>\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.Name, cmd.Usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func migrateCommand(config *config, args []string) error {
+	migrator, err := openStore(config, nil)
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Migrate()
+	for _, m := range applied {
+		log.Printf("Applied migration %d: %s", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		log.Println("The database is up to date")
+	}
+	return migrator.EnsureIndexes()
+}
+
+func migrationsCommand(config *config, args []string) error {
+	migrator, err := openStore(config, nil)
+	if err != nil {
+		return err
+	}
+	migrations, err := migrator.Migrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		applied := "pending"
+		if !m.Applied.IsZero() {
+			applied = m.Applied.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%3d  %-20s  %s\n", m.Version, applied, m.Name)
+	}
+	return nil
+}
+
+func backupCommand(config *config, args []string) error {
+	if config.Store != storeBolt {
+		return errors.New("Backups are only supported by the bolt store")
+	}
+	if len(args) != 1 {
+		return errors.New("Usage: rcadmin backup <file>")
+	}
+	boltStore, err := boltstore.Open(config.BoltPath, nil)
+	if err != nil {
+		return err
+	}
+	if err = boltStore.BackupFile(args[0]); err != nil {
+		return err
+	}
+	log.Printf("Copied %s to %s", config.BoltPath, args[0])
+	return nil
+}
+
+// rotateKeysCommand saves every crawler config again so its code and nip
+// are encrypted with the primary key and AES-GCM. The old keys can be
+// removed once it is done, and the legacy AES-CFB reads turned off once it
+// reports that it found no legacy credentials.
+func rotateKeysCommand(config *config, args []string) error {
+	keyring, err := crypto.LoadKeyring(config.AESSecretKey, config.AESKeyDir, config.AESPrimaryKey)
+	if err != nil {
+		return err
+	}
+	keyring.SetAllowLegacy(true)
+	c, err := crypto.NewKeyringService(keyring)
+	if err != nil {
+		return err
+	}
+	s, err := openStore(config, c)
+	if err != nil {
+		return err
+	}
+	if err = s.EnsureIndexes(); err != nil {
+		return err
+	}
+
+	rotated := 0
+	query := &user.Query{}
+	for {
+		page, err := s.ListUsers(query)
+		if err != nil {
+			return err
+		}
+		for _, u := range page.Users {
+			ok, err := rotateCrawlerConfig(s, u.ID)
+			if err != nil {
+				return fmt.Errorf("User %s: %v", u.Email, err)
+			}
+			if ok {
+				rotated++
+			}
+		}
+		if len(page.Next) == 0 {
+			break
+		}
+		query.After = page.Next
+	}
+	log.Printf("Encrypted %d crawler configs with key %s", rotated, c.Primary())
+	log.Printf("Found %d legacy AES-CFB values", c.LegacyReads())
+	if c.LegacyReads() == 0 {
+		log.Printf("AESAllowLegacy can be set to false")
+	}
+	return nil
+}
+
+// rotateCrawlerConfig saves the crawler config of a user again, if it has
+// credentials, retrying when the user changes it at the same time.
+func rotateCrawlerConfig(s crawlerconfig.Store, userID string) (bool, error) {
+	for {
+		crawlerConfig, err := s.GetCrawlerConfig(userID)
+		if err != nil {
+			return false, err
+		}
+		if len(crawlerConfig.Code) == 0 && len(crawlerConfig.Nip) == 0 {
+			return false, nil
+		}
+		err = s.UpdateCrawlerConfig(crawlerConfig)
+		if err != store.ErrConflict {
+			return err == nil, err
+		}
+	}
+}
+
+// openStore opens the store backend of the config. The crawler credentials
+// are encrypted with c, it can be nil for the commands that don't read them.
+func openStore(config *config, c *crypto.Service) (adminStore, error) {
+	switch config.Store {
+	case "", storeMongo:
+		return mongo.New(tools.NewMongoHelper(config.Database), c), nil
+	case storeSQL:
+		sqlStore, err := sqlstore.Open(config.SQL, c)
+		if err != nil {
+			return nil, err
+		}
+		return sqlStore, nil
+	case storeBolt:
+		boltStore, err := boltstore.Open(config.BoltPath, c)
+		if err != nil {
+			return nil, err
+		}
+		return boltStore, nil
+	}
+	return nil, fmt.Errorf("Unknown store %s", config.Store)
+}
+
+func readConfig() *config {
+	conf := &config{
+		Database: new(tools.MongoConfig),
+		SQL:      new(sqlstore.Config),
+	}
+
+	readFileConfig(conf)
+	readEnvConfig(conf)
+	readFlagConfig(conf)
+	resolveSecrets(conf)
+
+	return conf
+}
+
+func readFileConfig(config *config) {
+	// Get server config
+	file, err := ioutil.ReadFile(configFile)
+
+	// return if no config files
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(file, config); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readEnvConfig(config *config) {
+	val := os.Getenv("RC_STORE")
+	if len(val) > 0 {
+		config.Store = val
+	}
+	val = os.Getenv("RC_SQL_DRIVER")
+	if len(val) > 0 {
+		config.SQL.Driver = val
+	}
+	val = os.Getenv("RC_SQL_DSN")
+	if len(val) > 0 {
+		config.SQL.DSN = val
+	}
+	val = os.Getenv("RC_SQL_PASSWORD")
+	if len(val) > 0 {
+		config.SQL.Password = val
+	}
+	val = os.Getenv("RC_BOLT_PATH")
+	if len(val) > 0 {
+		config.BoltPath = val
+	}
+	val = os.Getenv("RC_DB_SERVICE_HOST")
+	val2 := os.Getenv("RC_DB_SERVICE_PORT")
+	if len(val) > 0 && len(val2) > 0 {
+		config.Database.URL = fmt.Sprintf("%s:%s", val, val2)
+	}
+	val = os.Getenv("RC_DB_USER")
+	if len(val) > 0 {
+		config.Database.User = val
+	}
+	val = os.Getenv("RC_DB_PASSWORD")
+	if len(val) > 0 {
+		config.Database.Password = val
+	}
+	val = os.Getenv("RC_DB_NAME")
+	if len(val) > 0 {
+		config.Database.Name = val
+	}
+	val = os.Getenv("RC_AES_SECRET_KEY")
+	if len(val) > 0 {
+		config.AESSecretKey = val
+	}
+	val = os.Getenv("RC_AES_KEY_DIR")
+	if len(val) > 0 {
+		config.AESKeyDir = val
+	}
+	val = os.Getenv("RC_AES_PRIMARY_KEY")
+	if len(val) > 0 {
+		config.AESPrimaryKey = val
+	}
+}
+
+func readFlagConfig(config *config) {
+	val := *storeBackend
+	if len(val) > 0 {
+		config.Store = val
+	}
+	val = *sqlDriver
+	if len(val) > 0 {
+		config.SQL.Driver = val
+	}
+	val = *sqlDSN
+	if len(val) > 0 {
+		config.SQL.DSN = val
+	}
+	val = *boltPath
+	if len(val) > 0 {
+		config.BoltPath = val
+	}
+	val = *dbURL
+	if len(val) > 0 {
+		config.Database.URL = val
+	}
+	val = *dbUser
+	if len(val) > 0 {
+		config.Database.User = val
+	}
+	val = *dbPassword
+	if len(val) > 0 {
+		config.Database.Password = val
+	}
+	val = *dbName
+	if len(val) > 0 {
+		config.Database.Name = val
+	}
+	val = *aesSecret
+	if len(val) > 0 {
+		config.AESSecretKey = val
+	}
+	val = *aesKeyDir
+	if len(val) > 0 {
+		config.AESKeyDir = val
+	}
+	val = *aesPrimary
+	if len(val) > 0 {
+		config.AESPrimaryKey = val
+	}
+}
+
+// resolveSecrets replaces the secret references of the config, like
+// file:///run/secrets/aes_key, with the secrets.
+func resolveSecrets(config *config) {
+	if err := secrets.NewResolver().ResolveConfig(config); err != nil {
+		log.Fatal(err)
+	}
+}
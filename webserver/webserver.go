@@ -6,29 +6,81 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/janicduplessis/resultscrawler/pkg/crawler"
 	"github.com/janicduplessis/resultscrawler/pkg/crypto"
+	"github.com/janicduplessis/resultscrawler/pkg/events"
+	"github.com/janicduplessis/resultscrawler/pkg/secrets"
+	"github.com/janicduplessis/resultscrawler/pkg/store"
+	boltstore "github.com/janicduplessis/resultscrawler/pkg/store/bolt"
+	"github.com/janicduplessis/resultscrawler/pkg/store/cache"
+	"github.com/janicduplessis/resultscrawler/pkg/store/crawlerconfig"
 	"github.com/janicduplessis/resultscrawler/pkg/store/mongo"
+	"github.com/janicduplessis/resultscrawler/pkg/store/results"
+	sqlstore "github.com/janicduplessis/resultscrawler/pkg/store/sql"
+	"github.com/janicduplessis/resultscrawler/pkg/store/user"
 	"github.com/janicduplessis/resultscrawler/pkg/tools"
 	"github.com/janicduplessis/resultscrawler/pkg/webserver"
 )
 
 const (
 	configFile = "config.json"
+	// cacheStatsInterval is how often the store cache stats are logged.
+	cacheStatsInterval = time.Hour
+
+	storeMongo = "mongo"
+	storeSQL   = "sql"
+	storeBolt  = "bolt"
 )
 
+// dataStore is implemented by every store backend.
+type dataStore interface {
+	user.Store
+	crawlerconfig.Store
+	results.Store
+	store.Migrator
+}
+
 type config struct {
-	ServerPort           string
-	ServerTLSPort        string
-	Database             *tools.MongoConfig
-	AESSecretKey         string // 16 bytes
+	ServerPort    string
+	ServerTLSPort string
+	// Store is the store backend, mongo, sql or bolt. Mongo is used if it
+	// is empty.
+	Store    string
+	Database *tools.MongoConfig
+	SQL      *sqlstore.Config
+	BoltPath string
+	// CacheTTL is how long the results read from the store are cached,
+	// like "30s". The cache is off if it is empty.
+	CacheTTL     string
+	AESSecretKey string // 16, 24 or 32 bytes
+	// AESKeyDir contains more encryption keys, one per file named by the
+	// key id. AESPrimaryKey is the id of the key used to encrypt, the
+	// AESSecretKey if it is empty.
+	AESKeyDir     string
+	AESPrimaryKey string
+	// AESAllowLegacy allows reading the credentials encrypted with
+	// AES-CFB. It is true by default so the credentials saved before the
+	// upgrade keep working, set it to false once rcadmin rotate-keys
+	// upgraded all of them.
+	AESAllowLegacy bool
+	// Password is the password hashing policy.
+	Password             *crypto.PasswordConfig
 	RSAPublic            string
 	RSAPrivate           string
 	TLSCert              string
 	TLSPriv              string
 	CrawlerWebserviceURL string
+	CrawlerAPISecret     string
+	// Certificate, key and CA files to use mutual TLS with the crawler
+	// webservice.
+	CrawlerTLSCert string
+	CrawlerTLSKey  string
+	CrawlerTLSCA   string
 }
 
 func main() {
@@ -36,24 +88,64 @@ func main() {
 
 	flag.Parse()
 	config := readConfig()
-	crypto.Init(config.AESSecretKey)
+	passwordHasher, err := crypto.NewPasswordHasher(config.Password)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyring, err := crypto.LoadKeyring(config.AESSecretKey, config.AESKeyDir, config.AESPrimaryKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyring.SetAllowLegacy(config.AESAllowLegacy)
+	cryptoService, err := crypto.NewKeyringService(keyring)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Inject dependencies
-	mongoHelper := tools.NewMongoHelper(config.Database)
+	dataStore := openStore(config, cryptoService)
 
-	userStore := mongo.New(mongoHelper)
-	crawlerConfigStore := mongo.New(mongoHelper)
-	userResultsStore := mongo.New(mongoHelper)
+	crawlerConfig := &crawler.ClientConfig{
+		Addr:   config.CrawlerWebserviceURL,
+		Secret: config.CrawlerAPISecret,
+	}
+	if len(config.CrawlerTLSCert) > 0 {
+		tlsConfig, err := crawler.LoadClientTLS(config.CrawlerTLSCert, config.CrawlerTLSKey, config.CrawlerTLSCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		crawlerConfig.TLS = tlsConfig
+	}
+	crawlerClient := crawler.NewClient(crawlerConfig)
+	// Receive the crawler events to stream them to the clients.
+	eventBus := events.NewRemoteBus(crawlerConfig.URL()+crawler.EventsPath, &http.Client{
+		Transport: crawlerConfig.Transport(),
+		Timeout:   time.Minute,
+	})
+	go eventBus.Start()
 
-	crawlerClient := crawler.NewClient(config.CrawlerWebserviceURL)
+	var userResultsStore results.Store = dataStore
+	if ttl := parseCacheTTL(config); ttl > 0 {
+		storeCache := cache.New(dataStore, ttl)
+		// The crawler saves the results in the database directly.
+		storeCache.InvalidateOnEvents(eventBus)
+		userResultsStore = storeCache
+		go func() {
+			for range time.Tick(cacheStatsInterval) {
+				log.Printf("store cache: %+v", storeCache.Stats())
+			}
+		}()
+	}
 
 	server := webserver.NewWebserver(&webserver.Config{
-		UserStore:          userStore,
-		CrawlerConfigStore: crawlerConfigStore,
+		UserStore:          dataStore,
+		CrawlerConfigStore: dataStore,
 		UserResultsStore:   userResultsStore,
 		RSAPublic:          []byte(config.RSAPublic),
 		RSAPrivate:         []byte(config.RSAPrivate),
 		CrawlerClient:      crawlerClient,
+		EventBus:           eventBus,
+		PasswordHasher:     passwordHasher,
 	})
 
 	log.Println("Server started")
@@ -61,13 +153,58 @@ func main() {
 	log.Println("Server stopped")
 }
 
+// openStore opens the store backend of the config and checks that its
+// migrations are applied. The crawler credentials are encrypted with c.
+func openStore(config *config, c *crypto.Service) dataStore {
+	var dataStore dataStore
+	switch config.Store {
+	case "", storeMongo:
+		dataStore = mongo.New(tools.NewMongoHelper(config.Database), c)
+	case storeSQL:
+		sqlStore, err := sqlstore.Open(config.SQL, c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dataStore = sqlStore
+	case storeBolt:
+		boltStore, err := boltstore.Open(config.BoltPath, c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dataStore = boltStore
+	default:
+		log.Fatalf("Unknown store %s", config.Store)
+	}
+	if err := dataStore.EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	return dataStore
+}
+
+// parseCacheTTL returns the cache duration of the config, 0 if the cache
+// is off.
+func parseCacheTTL(config *config) time.Duration {
+	if len(config.CacheTTL) == 0 {
+		return 0
+	}
+	ttl, err := time.ParseDuration(config.CacheTTL)
+	if err != nil {
+		log.Fatalf("Invalid cache ttl %s: %v", config.CacheTTL, err)
+	}
+	return ttl
+}
+
 func readConfig() *config {
 	conf := &config{
-		Database: new(tools.MongoConfig),
+		Database:       new(tools.MongoConfig),
+		SQL:            new(sqlstore.Config),
+		AESAllowLegacy: true,
+		Password:       new(crypto.PasswordConfig),
 	}
 
 	readFileConfig(conf)
 	readEnvConfig(conf)
+	resolveSecrets(conf)
 	validateConfig(conf)
 
 	return conf
@@ -96,6 +233,31 @@ func readEnvConfig(config *config) {
 	if len(val) > 0 {
 		config.ServerTLSPort = val
 	}
+	// Store
+	val = os.Getenv("RC_STORE")
+	if len(val) > 0 {
+		config.Store = val
+	}
+	val = os.Getenv("RC_SQL_DRIVER")
+	if len(val) > 0 {
+		config.SQL.Driver = val
+	}
+	val = os.Getenv("RC_SQL_DSN")
+	if len(val) > 0 {
+		config.SQL.DSN = val
+	}
+	val = os.Getenv("RC_SQL_PASSWORD")
+	if len(val) > 0 {
+		config.SQL.Password = val
+	}
+	val = os.Getenv("RC_BOLT_PATH")
+	if len(val) > 0 {
+		config.BoltPath = val
+	}
+	val = os.Getenv("RC_CACHE_TTL")
+	if len(val) > 0 {
+		config.CacheTTL = val
+	}
 	// DB
 	val = os.Getenv("RC_DB_SERVICE_HOST")
 	val2 := os.Getenv("RC_DB_SERVICE_PORT")
@@ -119,6 +281,35 @@ func readEnvConfig(config *config) {
 	if len(val) > 0 {
 		config.AESSecretKey = val
 	}
+	val = os.Getenv("RC_AES_KEY_DIR")
+	if len(val) > 0 {
+		config.AESKeyDir = val
+	}
+	val = os.Getenv("RC_AES_PRIMARY_KEY")
+	if len(val) > 0 {
+		config.AESPrimaryKey = val
+	}
+	val = os.Getenv("RC_AES_ALLOW_LEGACY")
+	if len(val) > 0 {
+		allow, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Fatalf("Invalid RC_AES_ALLOW_LEGACY %s", val)
+		}
+		config.AESAllowLegacy = allow
+	}
+	// Passwords
+	val = os.Getenv("RC_PASSWORD_ALGORITHM")
+	if len(val) > 0 {
+		config.Password.Algorithm = val
+	}
+	val = os.Getenv("RC_PASSWORD_BCRYPT_COST")
+	if len(val) > 0 {
+		cost, err := strconv.Atoi(val)
+		if err != nil {
+			log.Fatalf("Invalid bcrypt cost %s", val)
+		}
+		config.Password.BcryptCost = cost
+	}
 	//RSA
 	val = os.Getenv("RC_RSA_PUBLIC")
 	if len(val) > 0 {
@@ -142,13 +333,45 @@ func readEnvConfig(config *config) {
 	if len(val) > 0 && len(val2) > 0 {
 		config.CrawlerWebserviceURL = fmt.Sprintf("%s:%s", val, val2)
 	}
+	val = os.Getenv("RC_CRAWLER_API_SECRET")
+	if len(val) > 0 {
+		config.CrawlerAPISecret = val
+	}
+	val = os.Getenv("RC_CRAWLER_TLS_CERT")
+	if len(val) > 0 {
+		config.CrawlerTLSCert = val
+	}
+	val = os.Getenv("RC_CRAWLER_TLS_KEY")
+	if len(val) > 0 {
+		config.CrawlerTLSKey = val
+	}
+	val = os.Getenv("RC_CRAWLER_TLS_CA")
+	if len(val) > 0 {
+		config.CrawlerTLSCA = val
+	}
+}
+
+// resolveSecrets replaces the secret references of the config, like
+// file:///run/secrets/aes_key, with the secrets.
+func resolveSecrets(config *config) {
+	if err := secrets.NewResolver().ResolveConfig(config); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func validateConfig(config *config) {
 	// TODO: actually validate the config.
 	// for now it will just get printed.
-	log.Printf("AES: %v", config.AESSecretKey)
+	log.Printf("AES: %v", secrets.Redact(config.AESSecretKey))
+	log.Printf("AES key dir: %v", config.AESKeyDir)
+	log.Printf("AES primary key: %v", config.AESPrimaryKey)
+	log.Printf("AES allow legacy: %v", config.AESAllowLegacy)
+	log.Printf("password: %+v", config.Password)
+	log.Printf("store: %v", config.Store)
 	log.Printf("db: %+v", config.Database)
+	log.Printf("sql: %+v", config.SQL)
+	log.Printf("bolt path: %v", config.BoltPath)
+	log.Printf("cache ttl: %v", config.CacheTTL)
 	log.Printf("server port: %v", config.ServerPort)
 	log.Printf("server tls port: %v", config.ServerTLSPort)
 	log.Printf("crawler webservice url: %v", config.CrawlerWebserviceURL)